@@ -37,12 +37,8 @@ func main() {
 	bgpinfo := cf.Section("bgpinfo").Key("server").String()
 
 	// Set up log file
-	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("failed to open logfile: %v\n", err)
-	}
+	f := com.SetLogOutput(logfile, com.LogRotateConfig(cf.Section("log")))
 	defer f.Close()
-	log.SetOutput(f)
 
 	req, err := getASNs()
 	if err != nil {
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golang/protobuf/proto"
@@ -18,11 +21,16 @@ import (
 )
 
 type config struct {
-	port    string
-	logfile string
-	dbname  string
-	user    string
-	pass    string
+	port       string
+	healthPort string
+	logfile    string
+	logRotate  com.RotateConfig
+	dbname     string
+	user       string
+	pass       string
+
+	// originsKeep is how long per-ASN origin counts are kept. 0 keeps them forever.
+	originsKeep time.Duration
 }
 
 type server struct {
@@ -30,10 +38,8 @@ type server struct {
 	db  *sql.DB
 }
 
-// readConfig is here to read all the config.ini options. Ensure they are correct.
-func readConfig() config {
-
-	// read config
+// loadConfigFile loads config.ini from the same directory as the binary.
+func loadConfigFile() *ini.File {
 	exe, err := os.Executable()
 	if err != nil {
 		log.Fatal(err)
@@ -44,9 +50,42 @@ func readConfig() config {
 		log.Fatalf("failed to read config file: %v\n", err)
 	}
 
+	return cf
+}
+
+// checkConfig validates the config file without starting the server.
+func checkConfig(cf *ini.File) error {
+	var c com.ConfigCheck
+
+	c.Required("grpc", "port", cf.Section("grpc").Key("port").String())
+	c.Port("grpc", "port", cf.Section("grpc").Key("port").String())
+	c.Port("health", "port", cf.Section("health").Key("port").String())
+
+	c.Writable("log", "file", cf.Section("log").Key("file").String())
+	for _, key := range []string{"maxsize", "maxbackups", "maxage"} {
+		c.Uint("log", key, cf.Section("log").Key(key).String())
+	}
+
+	c.Uint("origins", "keep", cf.Section("origins").Key("keep").String())
+
+	for _, key := range []string{"database", "username", "password"} {
+		c.Required("sql", key, cf.Section("sql").Key(key).String())
+	}
+
+	return c.Err()
+}
+
+// readConfig is here to read all the config.ini options. Ensure they are correct.
+func readConfig(cf *ini.File) config {
 	var cfg config
 	cfg.port = fmt.Sprintf(":" + cf.Section("grpc").Key("port").String())
+	if port := cf.Section("health").Key("port").String(); port != "" {
+		cfg.healthPort = ":" + port
+	}
 	cfg.logfile = fmt.Sprintf(cf.Section("log").Key("file").String())
+	cfg.logRotate = com.LogRotateConfig(cf.Section("log"))
+	// keep is in days. The default covers the longest top movers period of a year.
+	cfg.originsKeep = time.Duration(cf.Section("origins").Key("keep").MustInt(400)) * 24 * time.Hour
 	cfg.dbname = fmt.Sprintf("%s", cf.Section("sql").Key("database").String())
 	cfg.user = cf.Section("sql").Key("username").String()
 	cfg.pass = cf.Section("sql").Key("password").String()
@@ -56,17 +95,25 @@ func readConfig() config {
 }
 
 func main() {
+	checkconfig := flag.Bool("checkconfig", false, "validate config.ini and exit")
+	flag.Parse()
+
+	cf := loadConfigFile()
+	if *checkconfig {
+		if err := checkConfig(cf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config OK")
+		return
+	}
 
 	var bgpinfoServer server
-	bgpinfoServer.cfg = readConfig()
+	bgpinfoServer.cfg = readConfig(cf)
 
 	// Set up log file
-	f, err := os.OpenFile(bgpinfoServer.cfg.logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("failed to open logfile: %v\n", err)
-	}
+	f := com.SetLogOutput(bgpinfoServer.cfg.logfile, bgpinfoServer.cfg.logRotate)
 	defer f.Close()
-	log.SetOutput(f)
 
 	// Create sql handle and test database connection
 	sqlserver := fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s",
@@ -83,6 +130,19 @@ func main() {
 	bgpinfoServer.db = db
 	defer db.Close()
 
+	// Origin counts were added after the other tables, so may need creating.
+	if err := createOriginsHelper(db); err != nil {
+		log.Printf("Top movers will not be available: %v", err)
+	}
+
+	// HTTP liveness and readiness checks are optional.
+	if bgpinfoServer.cfg.healthPort != "" {
+		log.Printf("Health checks listening on port %s\n", bgpinfoServer.cfg.healthPort)
+		go func() {
+			log.Printf("Health check server stopped: %v", http.ListenAndServe(bgpinfoServer.cfg.healthPort, healthMux(db)))
+		}()
+	}
+
 	// set up gRPC server
 	log.Printf("Listening on port %s\n", bgpinfoServer.cfg.port)
 	lis, err := net.Listen("tcp", bgpinfoServer.cfg.port)
@@ -102,6 +162,11 @@ func (s *server) AddLatest(ctx context.Context, v *pb.Values) (*pb.Result, error
 	// get correct struct
 	update := com.ProtoToStruct(v)
 
+	// A dry run only reports what would be added.
+	if v.GetDryRun() {
+		return dryRunHelper(update, s.db)
+	}
+
 	// update database
 	err := addLatestHelper(update, s.db)
 	if err != nil {
@@ -109,6 +174,19 @@ func (s *server) AddLatest(ctx context.Context, v *pb.Values) (*pb.Result, error
 		return nil, err
 	}
 
+	// Per-ASN counts are only used for trends, so don't fail the update on them.
+	if err := addOriginsHelper(v.GetTime(), v.GetOrigins(), s.db); err != nil {
+		log.Printf("Got error adding origins in AddLatest: %s\n", err)
+	}
+	if keep := uint64(s.cfg.originsKeep.Seconds()); keep > 0 && v.GetTime() > keep {
+		pruned, err := pruneOriginsHelper(v.GetTime()-keep, s.db)
+		if err != nil {
+			log.Printf("Got error pruning origins in AddLatest: %s\n", err)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d old origin counts", pruned)
+		}
+	}
+
 	return &pb.Result{
 		Success: true,
 	}, nil
@@ -219,3 +297,31 @@ func (s *server) UpdateAsnames(ctx context.Context, asn *pb.AsnamesRequest) (*pb
 	return res, nil
 
 }
+
+func (s *server) GetTopMovers(ctx context.Context, t *pb.TopMoversRequest) (*pb.TopMoversResponse, error) {
+	// Pull the ASNs with the largest change in originated prefixes.
+	log.Println("Running GetTopMovers")
+
+	res, err := getTopMoversHelper(t, s.db)
+	if err != nil {
+		log.Printf("Got error in GetTopMovers: %s\n", err)
+		return nil, err
+	}
+
+	return res, nil
+
+}
+
+func (s *server) GetAsnCounts(ctx context.Context, e *pb.Empty) (*pb.AsnCountsResponse, error) {
+	// Pull the source AS counts, now and a week ago.
+	log.Println("Running GetAsnCounts")
+
+	res, err := getASNCountsHelper(s.db)
+	if err != nil {
+		log.Printf("Got error in GetAsnCounts: %s\n", err)
+		return nil, err
+	}
+
+	return res, nil
+
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
@@ -102,6 +103,7 @@ func createTestDatabase() {
 	tx.Exec(`DROP TABLE IF EXISTS INFO`)
 	tx.Exec(`DROP TABLE IF EXISTS ASNUMNAME`)
 	tx.Exec(`DROP TABLE IF EXISTS ASNUMNAME_NEW`)
+	tx.Exec(`DROP TABLE IF EXISTS ORIGINS`)
 	tx.Exec(`CREATE TABLE INFO (
 		TIME int(12) NOT NULL DEFAULT 0,
 		V4COUNT int(10) NOT NULL,
@@ -195,6 +197,10 @@ func createTestDatabase() {
 	if err := tx.Commit(); err != nil {
 		log.Panic("Unable to create test database")
 	}
+	// ORIGINS is created as it would be on an existing database.
+	if err := createOriginsHelper(db); err != nil {
+		log.Panic(err)
+	}
 
 }
 
@@ -310,3 +316,224 @@ func TestAddLatest(t *testing.T) {
 
 	}
 }
+
+func TestGetTopMovers(t *testing.T) {
+	createTestDatabase()
+	db, _ := sql.Open("sqlite3", "./testdata/bgpinfo.db")
+	defer db.Close()
+
+	// A week and a day of history. The day old counts should be ignored.
+	end := uint64(1600000000)
+	history := map[uint64][]*pb.OriginCount{
+		end - 691200: {
+			{AsNumber: 13335, V4Count: 1, V6Count: 1},
+		},
+		end - 604800: {
+			{AsNumber: 13335, V4Count: 1000, V6Count: 100},
+			{AsNumber: 15169, V4Count: 500, V6Count: 50},
+			{AsNumber: 3356, V4Count: 300, V6Count: 30},
+			{AsNumber: 6939, V4Count: 200, V6Count: 20},
+		},
+		end - 86400: {
+			{AsNumber: 13335, V4Count: 5000, V6Count: 500},
+		},
+		end: {
+			{AsNumber: 13335, V4Count: 1010, V6Count: 100},
+			{AsNumber: 15169, V4Count: 450, V6Count: 80},
+			{AsNumber: 6939, V4Count: 200, V6Count: 20},
+			{AsNumber: 2906, V4Count: 25, V6Count: 5},
+		},
+	}
+	for time, origins := range history {
+		if err := addOriginsHelper(time, origins, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec(`INSERT INTO ASNUMNAME (ASNUMBER, ASNAME, LOCALE) VALUES (15169, 'GOOGLE', 'US')`)
+
+	var tests = []struct {
+		name string
+		req  *pb.TopMoversRequest
+		want []*pb.Mover
+	}{
+		{
+			name: "IPv4 top three",
+			req: &pb.TopMoversRequest{
+				Family: pb.AddressFamily_IPV4,
+				Count:  3,
+			},
+			want: []*pb.Mover{
+				{AsNumber: 3356, Delta: -300},
+				{AsNumber: 15169, AsName: "GOOGLE", Delta: -50},
+				{AsNumber: 2906, Delta: 25},
+			},
+		},
+		{
+			name: "IPv6 default count",
+			req: &pb.TopMoversRequest{
+				Family: pb.AddressFamily_IPV6,
+			},
+			want: []*pb.Mover{
+				{AsNumber: 3356, Delta: -30},
+				{AsNumber: 15169, AsName: "GOOGLE", Delta: 30},
+				{AsNumber: 2906, Delta: 5},
+				{AsNumber: 6939},
+				{AsNumber: 13335},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getTopMoversHelper(tc.req, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GetStart() != end-604800 || got.GetEnd() != end {
+				t.Errorf("got period %d-%d, want %d-%d", got.GetStart(), got.GetEnd(), end-604800, end)
+			}
+			if len(got.GetMovers()) != len(tc.want) {
+				t.Fatalf("got %d movers, want %d: %v", len(got.GetMovers()), len(tc.want), got.GetMovers())
+			}
+			for i, want := range tc.want {
+				m := got.GetMovers()[i]
+				if m.GetAsNumber() != want.GetAsNumber() || m.GetAsName() != want.GetAsName() || m.GetDelta() != want.GetDelta() {
+					t.Errorf("mover %d: got %v, want %v", i, m, want)
+				}
+			}
+		})
+	}
+
+	// A month of history isn't available.
+	if _, err := getTopMoversHelper(&pb.TopMoversRequest{Period: pb.MovementRequest_MONTH}, db); err == nil {
+		t.Error("expected an error when there isn't enough history")
+	}
+}
+
+func TestPruneOrigins(t *testing.T) {
+	createTestDatabase()
+	db, _ := sql.Open("sqlite3", "./testdata/bgpinfo.db")
+	defer db.Close()
+
+	for _, time := range []uint64{100, 200, 300} {
+		if err := addOriginsHelper(time, []*pb.OriginCount{
+			{AsNumber: 13335, V4Count: 1000},
+			{AsNumber: 15169, V4Count: 500},
+		}, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Creating the table again leaves what's there.
+	if err := createOriginsHelper(db); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := pruneOriginsHelper(200, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Errorf("pruned %d rows, want 2", pruned)
+	}
+	var oldest, rows int
+	if err := db.QueryRow(`SELECT MIN(TIME), COUNT(*) FROM ORIGINS`).Scan(&oldest, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if oldest != 200 || rows != 4 {
+		t.Errorf("got %d rows from time %d, want 4 from time 200", rows, oldest)
+	}
+}
+
+func TestGetASNCounts(t *testing.T) {
+	createTestDatabase()
+	db, _ := sql.Open("sqlite3", "./testdata/bgpinfo.db")
+	defer db.Close()
+
+	insert := `INSERT INTO INFO (TIME, V4COUNT, V6COUNT, AS4_LEN, AS6_LEN, AS10_LEN, AS4_ONLY, AS6_ONLY, AS_BOTH)
+		VALUES (?, 0, 0, ?, ?, ?, ?, ?, ?)`
+	end := 1600000000
+	db.Exec(insert, end, 70100, 26000, 73500, 47500, 3400, 22600)
+
+	// Without a week of history only the current counts are returned.
+	got, err := getASNCountsHelper(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetTime() != uint64(end) || got.GetCurrent().GetAs10() != 73500 || got.GetWeekAgo() != nil {
+		t.Errorf("got %v, want only the current counts", got)
+	}
+
+	// The latest counts a week or more before are used. A day old counts are ignored.
+	db.Exec(insert, end-691200, 1, 1, 1, 1, 1, 1)
+	db.Exec(insert, end-604800, 70000, 25900, 73400, 47500, 3400, 22500)
+	db.Exec(insert, end-86400, 2, 2, 2, 2, 2, 2)
+	got, err = getASNCountsHelper(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, w := got.GetCurrent(), got.GetWeekAgo()
+	if c.GetAs4() != 70100 || c.GetAs6() != 26000 || c.GetAs4Only() != 47500 || c.GetAs6Only() != 3400 || c.GetAsBoth() != 22600 {
+		t.Errorf("got current counts %v", c)
+	}
+	if w.GetAs4() != 70000 || w.GetAs6() != 25900 || w.GetAs10() != 73400 || w.GetAsBoth() != 22500 {
+		t.Errorf("got week ago counts %v", w)
+	}
+}
+
+func TestAddLatestDryRun(t *testing.T) {
+	createTestDatabase()
+	db, _ := sql.Open("sqlite3", "./testdata/bgpinfo.db")
+	defer db.Close()
+	srv := server{db: db}
+
+	count := func(time uint64) int {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM INFO WHERE TIME = ?`, time).Scan(&n)
+		return n
+	}
+
+	update := &pb.Values{
+		Time: 1600000000,
+		PrefixCount: &pb.PrefixCount{
+			Total_4:  900000,
+			Active_4: 850000,
+			Total_6:  110000,
+			Active_6: 100000,
+		},
+		Peers: &pb.PeerCount{
+			PeerCount_4: 2,
+			PeerUp_4:    2,
+			PeerCount_6: 2,
+			PeerUp_6:    1,
+		},
+		DryRun: true,
+	}
+	got, err := srv.AddLatest(context.Background(), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.GetSuccess() || !strings.Contains(got.GetResult(), "V4Count:850000") {
+		t.Errorf("got %v, want a successful result with the row", got)
+	}
+	if n := count(update.GetTime()); n != 0 {
+		t.Errorf("dry run added %d rows, want none", n)
+	}
+
+	// An update already in the database is reported, as are bad counts.
+	addLatestHelper(com.ProtoToStruct(update), db)
+	update.PrefixCount.Active_6 = 0
+	got, err = srv.AddLatest(context.Background(), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetSuccess() {
+		t.Errorf("got a successful dry run, want problems")
+	}
+	for _, want := range []string{"active prefix count is zero", "already exists"} {
+		if !strings.Contains(got.GetResult(), want) {
+			t.Errorf("result %q does not contain %q", got.GetResult(), want)
+		}
+	}
+	if n := count(update.GetTime()); n != 1 {
+		t.Errorf("got %d rows, want only the one added before", n)
+	}
+}
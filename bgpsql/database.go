@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -57,6 +58,111 @@ func addLatestHelper(b *com.BgpUpdate, db *sql.DB) error {
 
 }
 
+// validateUpdate returns any problems that suggest the update is not fit to add.
+func validateUpdate(b *com.BgpUpdate) []string {
+	var problems []string
+	if b.Time == 0 {
+		problems = append(problems, "time is not set")
+	}
+	if b.V4Count == 0 || b.V6Count == 0 {
+		problems = append(problems, fmt.Sprintf("active prefix count is zero: %d IPv4, %d IPv6", b.V4Count, b.V6Count))
+	}
+	if b.V4Count > b.V4Total || b.V6Count > b.V6Total {
+		problems = append(problems, fmt.Sprintf("more active than total prefixes: %d/%d IPv4, %d/%d IPv6",
+			b.V4Count, b.V4Total, b.V6Count, b.V6Total))
+	}
+	if b.PeersUp > b.PeersConfigured || b.Peers6Up > b.Peers6Configured {
+		problems = append(problems, fmt.Sprintf("more peers up than configured: %d/%d IPv4, %d/%d IPv6",
+			b.PeersUp, b.PeersConfigured, b.Peers6Up, b.Peers6Configured))
+	}
+	return problems
+}
+
+// dryRunHelper checks an update without adding it. The result holds the row that would
+// be added along with any problems, and is only a success if there are none.
+func dryRunHelper(b *com.BgpUpdate, db *sql.DB) (*pb.Result, error) {
+	if db == nil {
+		log.Fatalf("db object is nil")
+	}
+	problems := validateUpdate(b)
+
+	var existing int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM INFO WHERE TIME = ?`, b.Time).Scan(&existing); err != nil {
+		return &pb.Result{
+			Success: false,
+		}, fmt.Errorf("unable to check for an existing update: %w", err)
+	}
+	if existing > 0 {
+		problems = append(problems, fmt.Sprintf("an update already exists for time %d", b.Time))
+	}
+
+	result := fmt.Sprintf("would add: %+v", *b)
+	if len(problems) > 0 {
+		result = fmt.Sprintf("%s\nproblems: %s", result, strings.Join(problems, "; "))
+	}
+
+	return &pb.Result{
+		Success: len(problems) == 0,
+		Result:  result,
+	}, nil
+}
+
+// createOriginsHelper creates the ORIGINS table if it's not already there, so an
+// existing database picks it up without being migrated by hand.
+func createOriginsHelper(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ORIGINS (
+		TIME int(12) NOT NULL,
+		ASNUMBER int(10) NOT NULL,
+		V4COUNT int(10) NOT NULL,
+		V6COUNT int(10) NOT NULL,
+		PRIMARY KEY (TIME, ASNUMBER)
+	)`)
+	if err != nil {
+		return fmt.Errorf("Unable to create origins table: %w", err)
+	}
+	return nil
+}
+
+// add the amount of prefixes each ASN originates to the ORIGINS table.
+// ORIGINS has the columns TIME, ASNUMBER, V4COUNT and V6COUNT.
+func addOriginsHelper(t uint64, origins []*pb.OriginCount, db *sql.DB) error {
+	if len(origins) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Unable to start transaction: %w", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO ORIGINS (TIME, ASNUMBER, V4COUNT, V6COUNT)
+		values (?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Unable to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, o := range origins {
+		if _, err := stmt.Exec(t, o.GetAsNumber(), o.GetV4Count(), o.GetV6Count()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Unable to update origins: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Unable to complete transaction: %w", err)
+	}
+	return nil
+}
+
+// pruneOriginsHelper removes the origin counts from before the cutoff, returning
+// the number of rows removed. There's a row per ASN for every update, so they're
+// only kept as long as the longest top movers period needs them.
+func pruneOriginsHelper(before uint64, db *sql.DB) (int64, error) {
+	res, err := db.Exec(`DELETE FROM ORIGINS WHERE TIME < ?`, before)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to prune origins: %w", err)
+	}
+	return res.RowsAffected()
+}
+
 func getPrefixCountHelper(db *sql.DB) (*pb.PrefixCountResponse, error) {
 	if db == nil {
 		log.Fatalf("db object is nil")
@@ -157,28 +263,38 @@ func getPieSubnetsHelper(db *sql.DB) (*pb.PieSubnetsResponse, error) {
 
 }
 
-func getMovementTotalsHelper(m *pb.MovementRequest, db *sql.DB) (*pb.MovementTotalsResponse, error) {
-	// time helpers
+// periodSeconds returns the length of the time period in seconds.
+func periodSeconds(p pb.MovementRequest_TimePeriod) int {
 	secondsInWeek := 604800
 	secondsInMonth := 2628000
 	secondsIn6Months := secondsInMonth * 6
 	secondsInYear := secondsIn6Months * 2
+
+	switch p {
+	case pb.MovementRequest_MONTH:
+		return secondsInMonth
+	case pb.MovementRequest_SIXMONTH:
+		return secondsIn6Months
+	case pb.MovementRequest_ANNUAL:
+		return secondsInYear
+	default:
+		return secondsInWeek
+	}
+}
+
+func getMovementTotalsHelper(m *pb.MovementRequest, db *sql.DB) (*pb.MovementTotalsResponse, error) {
 	end := int(time.Now().Unix() - 66600)
+	start := strconv.Itoa(end - periodSeconds(m.GetPeriod()))
 
-	var start string
 	var denomiator int
 	switch m.GetPeriod() {
 	case pb.MovementRequest_WEEK:
-		start = strconv.Itoa(end - secondsInWeek)
 		denomiator = 2
 	case pb.MovementRequest_MONTH:
-		start = strconv.Itoa(end - secondsInMonth)
 		denomiator = 7
 	case pb.MovementRequest_SIXMONTH:
-		start = strconv.Itoa(end - secondsIn6Months)
 		denomiator = 30
 	case pb.MovementRequest_ANNUAL:
-		start = strconv.Itoa(end - secondsInYear)
 		denomiator = 60
 	}
 	query := fmt.Sprintf(`SELECT TIME, V4COUNT, V6COUNT FROM INFO WHERE TIME >=
@@ -348,3 +464,96 @@ func updateTweetBitHelper(t uint64, db *sql.DB) (*pb.Result, error) {
 	}, nil
 
 }
+
+// getTopMoversHelper returns the ASNs whose originated prefix count changed the most
+// between the latest origin counts and the counts from the period before that.
+func getTopMoversHelper(t *pb.TopMoversRequest, db *sql.DB) (*pb.TopMoversResponse, error) {
+	count := t.GetCount()
+	if count == 0 {
+		count = 10
+	}
+	column := "V6COUNT"
+	if t.GetFamily() == pb.AddressFamily_IPV4 {
+		column = "V4COUNT"
+	}
+
+	var end, start sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(TIME) FROM ORIGINS`).Scan(&end); err != nil {
+		return nil, fmt.Errorf("Unable to retrieve data: %w", err)
+	}
+	query := fmt.Sprintf(`SELECT MAX(TIME) FROM ORIGINS WHERE TIME <= '%d'`,
+		end.Int64-int64(periodSeconds(t.GetPeriod())))
+	if err := db.QueryRow(query).Scan(&start); err != nil {
+		return nil, fmt.Errorf("Unable to retrieve data: %w", err)
+	}
+	if !end.Valid || !start.Valid {
+		return nil, fmt.Errorf("not enough origin history for the period %v", t.GetPeriod())
+	}
+
+	// An ASN missing from either end originated nothing at that time.
+	query = fmt.Sprintf(`SELECT ASNUMBER,
+		SUM(CASE WHEN TIME = '%d' THEN %s ELSE -%s END) AS DELTA
+		FROM ORIGINS WHERE TIME IN ('%d', '%d') GROUP BY ASNUMBER
+		ORDER BY ABS(DELTA) DESC, ASNUMBER LIMIT %d`,
+		end.Int64, column, column, start.Int64, end.Int64, count)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := &pb.TopMoversResponse{
+		Start: uint64(start.Int64),
+		End:   uint64(end.Int64),
+	}
+	for rows.Next() {
+		var m pb.Mover
+		if err := rows.Scan(&m.AsNumber, &m.Delta); err != nil {
+			return nil, err
+		}
+		res.Movers = append(res.Movers, &m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Names are nice to have, so don't fail if they can't be found.
+	for _, m := range res.GetMovers() {
+		name, err := getAsnameHelper(&pb.GetAsnameRequest{AsNumber: m.GetAsNumber()}, db)
+		if err != nil {
+			log.Printf("Unable to get name for AS%d: %v", m.GetAsNumber(), err)
+			continue
+		}
+		m.AsName = name.GetAsName()
+	}
+
+	return res, nil
+}
+
+func getASNCountsHelper(db *sql.DB) (*pb.AsnCountsResponse, error) {
+	res := &pb.AsnCountsResponse{
+		Current: &pb.AsCount{},
+	}
+	c := res.Current
+	err := db.QueryRow(`SELECT TIME, AS4_LEN, AS6_LEN, AS10_LEN, AS4_ONLY, AS6_ONLY, AS_BOTH
+		FROM INFO ORDER BY TIME DESC LIMIT 1`).Scan(
+		&res.Time, &c.As4, &c.As6, &c.As10, &c.As4Only, &c.As6Only, &c.AsBoth)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve data: %w", err)
+	}
+
+	// A new database won't have a week of history yet.
+	w := &pb.AsCount{}
+	query := fmt.Sprintf(`SELECT AS4_LEN, AS6_LEN, AS10_LEN, AS4_ONLY, AS6_ONLY, AS_BOTH
+		FROM INFO WHERE TIME <= '%d' ORDER BY TIME DESC LIMIT 1`, int64(res.Time)-604800)
+	err = db.QueryRow(query).Scan(&w.As4, &w.As6, &w.As10, &w.As4Only, &w.As6Only, &w.AsBoth)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, fmt.Errorf("Unable to retrieve data: %w", err)
+	default:
+		res.WeekAgo = w
+	}
+
+	return res, nil
+}
@@ -3,11 +3,17 @@
 package main
 
 import (
-	"database/sql"
+	"fmt"
 	"log"
+	"net/http"
 	"os/exec"
 )
 
+// pinger is satisfied by *sql.DB.
+type pinger interface {
+	Ping() error
+}
+
 //TODO: This does nothing right now!
 
 func isHealthy() bool {
@@ -16,7 +22,7 @@ func isHealthy() bool {
 }
 
 // Can we ping the datbase
-func dbHealth(db *sql.DB) bool {
+func dbHealth(db pinger) bool {
 	err := db.Ping()
 	if err != nil {
 		log.Printf("unable to ping database for healthcheck: %v\n", err)
@@ -52,3 +58,20 @@ func minCount() bool {
 func minPeers() bool {
 	return true
 }
+
+// healthMux serves /healthz, which is always ok while the process is up,
+// and /readyz, which is only ok if the database can be reached.
+func healthMux(db pinger) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !dbHealth(db) {
+			http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
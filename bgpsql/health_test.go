@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeDB is a database that can be made unreachable.
+type fakeDB struct {
+	err error
+}
+
+func (f *fakeDB) Ping() error {
+	return f.err
+}
+
+func TestHealthMux(t *testing.T) {
+	db := &fakeDB{}
+	mux := healthMux(db)
+
+	var tests = []struct {
+		name   string
+		path   string
+		err    error
+		status int
+	}{
+		{
+			name:   "Live",
+			path:   "/healthz",
+			status: http.StatusOK,
+		},
+		{
+			name:   "Live with database down",
+			path:   "/healthz",
+			err:    errors.New("connection refused"),
+			status: http.StatusOK,
+		},
+		{
+			name:   "Ready",
+			path:   "/readyz",
+			status: http.StatusOK,
+		},
+		{
+			name:   "Not ready with database down",
+			path:   "/readyz",
+			err:    errors.New("connection refused"),
+			status: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db.err = tc.err
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.status {
+				t.Errorf("got status %d, want %d", w.Code, tc.status)
+			}
+		})
+	}
+}
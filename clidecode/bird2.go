@@ -1,25 +1,66 @@
 package clidecode
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	c "github.com/mellowdrifter/bgp_infrastructure/common"
 )
 
 // Bird2Conn will be a connection to a Bird2 instance. In reality this
 // will need to be on the local server
-type Bird2Conn struct{}
+type Bird2Conn struct {
+	// LocalPrefROA maps a local-pref value to a ROA status (RValid, RUnknown, RInvalid).
+	// When set, GetROA infers the ROA status from the local-pref on the route
+	// instead of asking bird to evaluate roa_check directly.
+	LocalPrefROA map[uint32]int
+}
+
+// Capabilities returns the optional lookups the router supports. Bird2 supports them all.
+func (b Bird2Conn) Capabilities() DecoderCaps {
+	return DecoderCaps{
+		ASPath:           true,
+		ROA:              true,
+		Invalids:         true,
+		RouteSince:       true,
+		LargeCommunities: true,
+		RoutesWhere:      true,
+		Filtered:         true,
+		Communities:      true,
+		NextHop:          true,
+	}
+}
+
+// Ping returns an error if bird isn't answering.
+func (b Bird2Conn) Ping(ctx context.Context) error {
+	out, err := c.GetOutputContext(ctx, "/usr/sbin/birdc show status")
+	if err != nil {
+		return err
+	}
+	return decodeStatus(out)
+}
+
+// decodeStatus will return an error unless the bird status is up. birdc prints
+// its connection errors rather than exiting with one, so the output is checked.
+// example output - Daemon is up and running
+func decodeStatus(in string) error {
+	if strings.Contains(in, "Daemon is up and running") {
+		return nil
+	}
+	return fmt.Errorf("bird is not running: %s", strings.TrimSpace(in))
+}
 
 // GetBGPTotal returns rib, fib ipv4. rib, fib ipv6
-func (b Bird2Conn) GetBGPTotal() (Totals, error) {
+func (b Bird2Conn) GetBGPTotal(ctx context.Context) (Totals, error) {
 	cmd := "/usr/sbin/birdc show route count | grep routes | awk {'print $3, $6'}"
 
 	var t Totals
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return t, err
 	}
@@ -34,7 +75,7 @@ func (b Bird2Conn) GetBGPTotal() (Totals, error) {
 }
 
 // GetPeers returns ipv4 peer configured, established. ipv6 peers configured, established
-func (b Bird2Conn) GetPeers() (Peers, error) {
+func (b Bird2Conn) GetPeers(ctx context.Context) (Peers, error) {
 	var peers []uint32
 	cmds := []string{
 		"/usr/sbin/birdc show protocols | awk {'print $1'} | grep _v4 | grep -Ev 'BIRD|device1|name|info|kernel1' | wc -l",
@@ -46,7 +87,7 @@ func (b Bird2Conn) GetPeers() (Peers, error) {
 	var p Peers
 
 	for _, cmd := range cmds {
-		out, err := c.GetOutput(cmd)
+		out, err := c.GetOutputContext(ctx, cmd)
 		if err != nil {
 			return p, err
 		}
@@ -68,16 +109,16 @@ func (b Bird2Conn) GetPeers() (Peers, error) {
 // as4Only: ASNs originating IPv4 only
 // as6Only: ASNs originaring IPv6 only
 // asBoth:  ASNs originating both IPv4 and IPv6
-func (b Bird2Conn) GetTotalSourceASNs() (ASNs, error) {
+func (b Bird2Conn) GetTotalSourceASNs(ctx context.Context) (ASNs, error) {
 	cmd1 := "/usr/sbin/birdc show route primary table master4 | awk '{print $NF}' | tr -d '[]ASie?' | sed -e '1,2d'"
 	cmd2 := "/usr/sbin/birdc show route primary table master6 | awk '{print $NF}' | tr -d '[]ASie?' | sed -e '1,2d'"
 
 	var s ASNs
-	as4, err := c.GetOutput(cmd1)
+	as4, err := c.GetOutputContext(ctx, cmd1)
 	if err != nil {
 		return s, err
 	}
-	as6, err := c.GetOutput(cmd2)
+	as6, err := c.GetOutputContext(ctx, cmd2)
 	if err != nil {
 		return s, err
 	}
@@ -111,8 +152,51 @@ func (b Bird2Conn) GetTotalSourceASNs() (ASNs, error) {
 	return s, nil
 }
 
+// GetOriginCounts returns the amount of prefixes each ASN originates.
+func (b Bird2Conn) GetOriginCounts(ctx context.Context) (map[uint32]Origin, error) {
+	cmd1 := "/usr/sbin/birdc show route primary table master4 | awk '{print $NF}' | tr -d '[]ASie?' | sed -e '1,2d'"
+	cmd2 := "/usr/sbin/birdc show route primary table master6 | awk '{print $NF}' | tr -d '[]ASie?' | sed -e '1,2d'"
+
+	as4, err := c.GetOutputContext(ctx, cmd1)
+	if err != nil {
+		return nil, err
+	}
+	as6, err := c.GetOutputContext(ctx, cmd2)
+	if err != nil {
+		return nil, err
+	}
+
+	return countOrigins(as4, as6), nil
+}
+
+// countOrigins counts how many times each ASN appears in the list of
+// IPv4 and IPv6 origins. Anything that isn't an ASN is skipped.
+func countOrigins(as4, as6 string) map[uint32]Origin {
+	origins := make(map[uint32]Origin)
+	for _, f := range strings.Fields(as4) {
+		asn, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			continue
+		}
+		o := origins[uint32(asn)]
+		o.V4++
+		origins[uint32(asn)] = o
+	}
+	for _, f := range strings.Fields(as6) {
+		asn, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			continue
+		}
+		o := origins[uint32(asn)]
+		o.V6++
+		origins[uint32(asn)] = o
+	}
+
+	return origins
+}
+
 // GetROAs returns total amount of all ROA states
-func (b Bird2Conn) GetROAs() (Roas, error) {
+func (b Bird2Conn) GetROAs(ctx context.Context) (Roas, error) {
 	var r Roas
 	var roas []uint32
 	cmds := []string{
@@ -125,7 +209,7 @@ func (b Bird2Conn) GetROAs() (Roas, error) {
 	}
 
 	for _, cmd := range cmds {
-		out, err := c.GetOutput(cmd)
+		out, err := c.GetOutputContext(ctx, cmd)
 		if err != nil {
 			return r, err
 		}
@@ -145,7 +229,7 @@ func (b Bird2Conn) GetROAs() (Roas, error) {
 
 // GetInvalids returns a map of ASNs that are advertising RPKI invalid prefixes.
 // It also includes all those prefixes being advertised.
-func (b Bird2Conn) GetInvalids() (map[string][]string, error) {
+func (b Bird2Conn) GetInvalids(ctx context.Context) (map[string][]string, error) {
 	inv := make(map[string][]string)
 	num := regexp.MustCompile(`[\d]+`)
 	cmds := []string{
@@ -154,7 +238,7 @@ func (b Bird2Conn) GetInvalids() (map[string][]string, error) {
 	}
 
 	for _, cmd := range cmds {
-		out, err := c.GetOutput(cmd)
+		out, err := c.GetOutputContext(ctx, cmd)
 		if err != nil {
 			return inv, err
 		}
@@ -172,13 +256,13 @@ func (b Bird2Conn) GetInvalids() (map[string][]string, error) {
 
 // GetMasks returns the total count of each mask value
 // First item is IPv4, second item is IPv6
-func (b Bird2Conn) GetMasks() ([]map[string]uint32, error) {
+func (b Bird2Conn) GetMasks(ctx context.Context) ([]map[string]uint32, error) {
 	v6 := make(map[string]uint32)
 	v4 := make(map[string]uint32)
 	var m []map[string]uint32
 
 	cmd := "/usr/sbin/birdc show route primary table master6 | awk {'print $1'} | sed -e '1,2d'"
-	subnetsV6, err := c.GetOutput(cmd)
+	subnetsV6, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return m, err
 	}
@@ -188,7 +272,7 @@ func (b Bird2Conn) GetMasks() ([]map[string]uint32, error) {
 	}
 
 	cmd2 := "/usr/sbin/birdc show route primary table master4 | awk {'print $1'} | sed -e '1,2d'"
-	subnetsV4, err := c.GetOutput(cmd2)
+	subnetsV4, err := c.GetOutputContext(ctx, cmd2)
 	if err != nil {
 		return m, err
 	}
@@ -205,7 +289,7 @@ func (b Bird2Conn) GetMasks() ([]map[string]uint32, error) {
 
 // GetLargeCommunities returns the amount of prefixes that have large communities attached (RFC8092)
 // TODO: Not sure this is doing the right thing
-func (b Bird2Conn) GetLargeCommunities() (Large, error) {
+func (b Bird2Conn) GetLargeCommunities(ctx context.Context) (Large, error) {
 	var l Large
 	var comm []uint32
 	cmds := []string{
@@ -214,7 +298,7 @@ func (b Bird2Conn) GetLargeCommunities() (Large, error) {
 	}
 
 	for _, cmd := range cmds {
-		out, err := c.GetOutput(cmd)
+		out, err := c.GetOutputContext(ctx, cmd)
 		if err != nil {
 			return l, err
 		}
@@ -227,47 +311,33 @@ func (b Bird2Conn) GetLargeCommunities() (Large, error) {
 }
 
 // GetIPv4FromSource returns all the IPv4 networks sourced from a source ASN.
-func (b Bird2Conn) GetIPv4FromSource(asn uint32) ([]*net.IPNet, error) {
+func (b Bird2Conn) GetIPv4FromSource(ctx context.Context, asn uint32) ([]*net.IPNet, error) {
 	cmd := fmt.Sprintf("/usr/sbin/birdc 'show route primary table master4 where bgp_path ~ [= * %d =]' | grep -Ev 'BIRD|device1|name|info|kernel1|Table' | awk '{print $1}'", asn)
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return []*net.IPNet{}, err
 	}
 
-	var ips []*net.IPNet
-
-	for _, address := range strings.Fields(out) {
-		_, net, _ := net.ParseCIDR(address)
-		ips = append(ips, net)
-	}
-
-	return ips, nil
+	return decodePrefixes(out), nil
 }
 
 // GetIPv6FromSource returns all the IPv6 networks sourced from a source ASN.
-func (b Bird2Conn) GetIPv6FromSource(asn uint32) ([]*net.IPNet, error) {
+func (b Bird2Conn) GetIPv6FromSource(ctx context.Context, asn uint32) ([]*net.IPNet, error) {
 	cmd := fmt.Sprintf("/usr/sbin/birdc 'show route primary table master6 where bgp_path ~ [= * %d =]' | grep -Ev 'BIRD|device1|name|info|kernel1|Table' | awk '{print $1}'", asn)
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
 
-	var ips []*net.IPNet
-
-	for _, address := range strings.Fields(out) {
-		_, net, _ := net.ParseCIDR(address)
-		ips = append(ips, net)
-	}
-
-	return ips, nil
+	return decodePrefixes(out), nil
 }
 
 // GetASPathFromIP will return the AS path, as well as as-set if any from a source IP.
-func (b Bird2Conn) GetASPathFromIP(ip net.IP) (ASPath, bool, error) {
+func (b Bird2Conn) GetASPathFromIP(ctx context.Context, ip net.IP) (ASPath, bool, error) {
 	var aspath ASPath
 
 	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary all for %s | grep -Ev 'BIRD|device1|name|info|kernel1|Table' | grep as_path | awk '{$1=\"\"; print $0}'", ip.String())
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return aspath, false, err
 	}
@@ -313,25 +383,270 @@ func decodeASPaths(in string) ([]uint32, []uint32) {
 }
 
 // GetRoute will return the current FIB entry, if any, from a source IP.
-func (b Bird2Conn) GetRoute(ip net.IP) (*net.IPNet, bool, error) {
+func (b Bird2Conn) GetRoute(ctx context.Context, ip net.IP) (*net.IPNet, bool, error) {
 	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary for %s | grep -Ev 'BIRD|device1|name|info|kernel1|Table' | awk '{print $1}'", ip.String())
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return nil, false, err
 	}
 
-	_, net, err := net.ParseCIDR(out)
+	prefixes := decodePrefixes(out)
+	if len(prefixes) == 0 {
+		return nil, false, nil
+	}
+
+	return prefixes[0], true, nil
+}
+
+// GetNextHop will return the next hop of the current route, if any, from a source IP.
+func (b Bird2Conn) GetNextHop(ctx context.Context, ip net.IP) (NextHop, bool, error) {
+	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary for %s", ip.String())
+	out, err := c.GetOutputContext(ctx, cmd)
+	if err != nil {
+		return NextHop{}, false, err
+	}
+
+	nh, ok := decodeNextHop(out)
+	return nh, ok, nil
+}
+
+// decodeNextHop will return the first next hop of a route. A multipath route has
+// one via line for each next hop.
+// example output - via 192.0.2.1 on eth0 weight 1
+func decodeNextHop(in string) (NextHop, bool) {
+	for _, line := range strings.Split(in, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "via":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				continue
+			}
+			nh := NextHop{IP: ip}
+			if len(fields) >= 4 && fields[2] == "on" {
+				nh.Interface = fields[3]
+			}
+			return nh, true
+		case "dev":
+			return NextHop{Interface: fields[1]}, true
+		}
+	}
+	return NextHop{}, false
+}
+
+// GetRoutesWhere returns the primary route for every prefix in any table matching
+// the bird filter expression, e.g. net ~ [ 10.0.0.0/8+ ].
+func (b Bird2Conn) GetRoutesWhere(ctx context.Context, filter string) ([]Route, error) {
+	// The filter is passed to birdc within single quotes.
+	if strings.Contains(filter, "'") {
+		return nil, fmt.Errorf("invalid filter %q", filter)
+	}
+	cmd := fmt.Sprintf("/usr/sbin/birdc 'show route primary table all where %s'", filter)
+	out, err := c.GetOutputContext(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRoutes(out), nil
+}
+
+// decodeRoutes returns a route for each line of bird output starting with a prefix.
+// example output - 1.1.1.0/24 unicast [peer1 2021-02-01 10:12:34] * (100) [AS13335i]
+func decodeRoutes(in string) []Route {
+	origin := regexp.MustCompile(`\[AS(\d+)[ie?]\]`)
+	var routes []Route
+	for _, line := range strings.Split(in, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		prefix, ok := decodePrefix(fields[0])
+		if !ok {
+			continue
+		}
+		route := Route{Prefix: prefix}
+		if match := origin.FindStringSubmatch(line); match != nil {
+			route.Origin = c.StringToUint32(match[1])
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// decodePrefixes returns the prefix at the start of each line of bird output.
+// Lines that don't start with a prefix, such as the extra next hops of a
+// multipath route, are skipped rather than returned as nil.
+func decodePrefixes(in string) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, line := range strings.Split(in, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if prefix, ok := decodePrefix(fields[0]); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// decodePrefix parses a single prefix as rendered by bird. Any interface zone
+// (fe80::1%eth0/64) is stripped, and IPv6 is returned in its compressed form
+// however bird rendered it.
+func decodePrefix(in string) (*net.IPNet, bool) {
+	in = strings.Trim(in, "[]")
+	if i := strings.Index(in, "%"); i != -1 {
+		j := strings.Index(in, "/")
+		if j < i {
+			return nil, false
+		}
+		in = in[:i] + in[j:]
+	}
+	ip, prefix, err := net.ParseCIDR(in)
+	if err != nil {
+		return nil, false
+	}
+	// IPv4 routes should never be rendered as IPv6.
+	if ip.To4() != nil && strings.Contains(in, ":") {
+		return nil, false
+	}
+	return prefix, true
+}
+
+// GetRouteSince will return the time the current FIB entry last changed, if known.
+func (b Bird2Conn) GetRouteSince(ctx context.Context, ip net.IP) (time.Time, bool, error) {
+	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary for %s | grep -Ev 'BIRD|device1|name|info|kernel1|Table'", ip.String())
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	since, ok := decodeRouteSince(out, time.Now())
+	return since, ok, nil
+}
+
+// GetFilteredRoute will return a route, if any, from a source IP that was received but rejected by import policy.
+// bird only keeps rejected routes for protocols with import keep filtered set.
+func (b Bird2Conn) GetFilteredRoute(ctx context.Context, ip net.IP) (*net.IPNet, bool, error) {
+	cmd := fmt.Sprintf("/usr/sbin/birdc show route filtered for %s | grep -Ev 'BIRD|device1|name|info|kernel1|Table' | awk '{print $1}'", ip.String())
+	out, err := c.GetOutputContext(ctx, cmd)
+	if err != nil {
+		return nil, false, err
+	}
+
+	prefixes := decodePrefixes(out)
+	if len(prefixes) == 0 {
 		return nil, false, nil
 	}
 
-	return net, true, nil
+	return prefixes[0], true, nil
+}
+
+// GetCommunities will return the BGP communities on the current route, if any, from a source IP.
+func (b Bird2Conn) GetCommunities(ctx context.Context, ip net.IP) (Communities, bool, error) {
+	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary all for %s | grep -E 'unicast|BGP\\.(community|ext_community|large_community):'", ip.String())
+	out, err := c.GetOutputContext(ctx, cmd)
+	if err != nil {
+		return Communities{}, false, err
+	}
+
+	// If no route exists, no communities will exist
+	if !strings.Contains(out, "unicast") {
+		return Communities{}, false, nil
+	}
+
+	return decodeCommunities(out), true, nil
+}
+
+// decodeCommunities will return the standard, extended and large communities
+// from bird route attributes. Anything that doesn't parse is skipped.
+// example output - BGP.large_community: (65000, 1, 2) (65000, 3, 4)
+func decodeCommunities(in string) Communities {
+	rxp := regexp.MustCompile(`\(([^)]*)\)`)
+	var comms Communities
+	for _, line := range strings.Split(in, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, match := range rxp.FindAllStringSubmatch(parts[1], -1) {
+			fields := strings.Split(match[1], ",")
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			switch parts[0] {
+			case "BGP.community":
+				if v, ok := parseUints(fields, 16); ok && len(v) == 2 {
+					comms.Standard = append(comms.Standard, Community{ASN: v[0], Value: v[1]})
+				}
+			case "BGP.large_community":
+				if v, ok := parseUints(fields, 32); ok && len(v) == 3 {
+					comms.Large = append(comms.Large, LargeCommunity{ASN: v[0], Data1: v[1], Data2: v[2]})
+				}
+			case "BGP.ext_community":
+				// The value can be in hex for generic communities.
+				if len(fields) != 3 {
+					continue
+				}
+				if v, err := strconv.ParseUint(fields[2], 0, 32); err == nil {
+					comms.Extended = append(comms.Extended, ExtendedCommunity{Type: fields[0], Admin: fields[1], Value: uint32(v)})
+				}
+			}
+		}
+	}
+	return comms
+}
+
+// parseUints parses each field as an unsigned number of up to bits in size.
+func parseUints(fields []string, bits int) ([]uint32, bool) {
+	vals := make([]uint32, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseUint(f, 10, bits)
+		if err != nil {
+			return nil, false
+		}
+		vals = append(vals, uint32(v))
+	}
+	return vals, true
+}
+
+// decodeRouteSince will return the last change time from a bird route line.
+// Depending on the configured timeformat, bird shows either a full date and time,
+// a date only, or a time only for routes that changed today.
+// example output - 1.1.1.0/24 unicast [peer1 2021-02-01 10:12:34] * (100) [AS13335i]
+func decodeRouteSince(in string, now time.Time) (time.Time, bool) {
+	rxp := regexp.MustCompile(`\[\S+ (\d{4}-\d{2}-\d{2}(?: \d{2}:\d{2}:\d{2}(?:\.\d+)?)?|\d{2}:\d{2}:\d{2}(?:\.\d+)?)`)
+	match := rxp.FindStringSubmatch(in)
+	if match == nil {
+		return time.Time{}, false
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+		if since, err := time.ParseInLocation(layout, match[1], now.Location()); err == nil {
+			return since, true
+		}
+	}
+
+	// Only the time is shown, so the change happened within the last day.
+	t, err := time.ParseInLocation("15:04:05.999999999", match[1], now.Location())
+	if err != nil {
+		return time.Time{}, false
+	}
+	since := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), now.Location())
+	if since.After(now) {
+		since = since.AddDate(0, 0, -1)
+	}
+
+	return since, true
 }
 
 // GetOriginFromIP will return the origin ASN from a source IP.
-func (b Bird2Conn) GetOriginFromIP(ip net.IP) (uint32, bool, error) {
+func (b Bird2Conn) GetOriginFromIP(ctx context.Context, ip net.IP) (uint32, bool, error) {
 	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary all for %s | grep -Ev 'BIRD|device1|name|info|kernel1|Table' | grep as_path | sed 's/{.*}//' | awk {'print $NF'}", ip.String())
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return 0, false, err
 	}
@@ -352,7 +667,11 @@ func (b Bird2Conn) GetOriginFromIP(ip net.IP) (uint32, bool, error) {
 
 // GetROA will return the ROA status from a prefix and ASN.
 // This function does not check for the existance of the prefix in the table.
-func (b Bird2Conn) GetROA(prefix *net.IPNet, asn uint32) (int, bool, error) {
+func (b Bird2Conn) GetROA(ctx context.Context, prefix *net.IPNet, asn uint32) (int, bool, error) {
+	if len(b.LocalPrefROA) > 0 {
+		return b.getROAFromLocalPref(ctx, prefix)
+	}
+
 	var table string
 	if strings.Contains(prefix.String(), ":") {
 		table = "roa_v6"
@@ -361,14 +680,55 @@ func (b Bird2Conn) GetROA(prefix *net.IPNet, asn uint32) (int, bool, error) {
 	}
 
 	cmd := fmt.Sprintf("/usr/sbin/birdc 'eval roa_check(%s, %s, %d)'", table, prefix, asn)
-	out, err := c.GetOutput(cmd)
+	out, err := c.GetOutputContext(ctx, cmd)
 	if err != nil {
 		return 0, false, err
 	}
 
-	// Get the enum value
-	// example output - (enum 35)1
-	val := out[len(out)-1:]
+	status, err := decodeROAState(out)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return status, true, nil
+}
+
+// getROAFromLocalPref will return the ROA status inferred from the local-pref of the route.
+func (b Bird2Conn) getROAFromLocalPref(ctx context.Context, prefix *net.IPNet) (int, bool, error) {
+	cmd := fmt.Sprintf("/usr/sbin/birdc show route primary all for %s | grep local_pref", prefix)
+	out, err := c.GetOutputContext(ctx, cmd)
+	if err != nil {
+		return 0, false, err
+	}
+
+	status, ok := roaFromLocalPref(out, b.LocalPrefROA)
+	return status, ok, nil
+}
+
+// roaFromLocalPref maps the local-pref in bird route output to a ROA status.
+// Any local-pref not in the mapping is treated as unknown.
+func roaFromLocalPref(in string, prefs map[uint32]int) (int, bool) {
+	pref, ok := decodeLocalPref(in)
+	if !ok {
+		return RUnknown, false
+	}
+
+	status, ok := prefs[pref]
+	if !ok {
+		return RUnknown, true
+	}
+
+	return status, true
+}
+
+// decodeROAState will return the ROA status from the output of eval roa_check.
+// example output - (enum 35)1
+func decodeROAState(in string) (int, error) {
+	rxp := regexp.MustCompile(`\(enum \d+\)(\d+)`)
+	match := rxp.FindStringSubmatch(in)
+	if match == nil {
+		return 0, fmt.Errorf("unable to decode ROA state from %q", in)
+	}
 
 	// Check for an existing ROA
 	// 0 = ROA_UNKNOWN
@@ -380,5 +740,22 @@ func (b Bird2Conn) GetROA(prefix *net.IPNet, asn uint32) (int, bool, error) {
 		"1": RValid,
 	}
 
-	return statuses[val], true, nil
+	status, ok := statuses[match[1]]
+	if !ok {
+		return 0, fmt.Errorf("unknown ROA state %s", match[1])
+	}
+
+	return status, nil
+}
+
+// decodeLocalPref will return the local-pref value from bird route output.
+// example output - BGP.local_pref: 200
+func decodeLocalPref(in string) (uint32, bool) {
+	rxp := regexp.MustCompile(`BGP\.local_pref:\s*(\d+)`)
+	match := rxp.FindStringSubmatch(in)
+	if match == nil {
+		return 0, false
+	}
+
+	return c.StringToUint32(match[1]), true
 }
@@ -1,8 +1,11 @@
 package clidecode
 
 import (
+	"fmt"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDecodeASPaths(t *testing.T) {
@@ -83,3 +86,404 @@ func BenchmarkDecodeASPaths(b *testing.B) {
 		}
 	}
 }
+
+func TestDecodeROAState(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			in:   "(enum 35)1",
+			want: RValid,
+		},
+		{
+			name: "Invalid",
+			in:   "(enum 35)2",
+			want: RInvalid,
+		},
+		{
+			name: "Unknown",
+			in:   "(enum 35)0",
+			want: RUnknown,
+		},
+		{
+			name:    "Unexpected state",
+			in:      "(enum 35)7",
+			wantErr: true,
+		},
+		{
+			name:    "Garbage",
+			in:      "syntax error",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := decodeROAState(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, wanted error: %t", tc.name, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %d, wanted %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestROAFromLocalPref(t *testing.T) {
+	const output = `Table master4:
+1.1.1.0/24           unicast [peer1 2021-02-01] * (100) [AS13335i]
+	via 192.0.2.1 on eth0
+	Type: BGP univ
+	BGP.origin: IGP
+	BGP.as_path: 3356 13335
+	BGP.next_hop: 192.0.2.1
+	BGP.local_pref: %d`
+
+	prefs := map[uint32]int{
+		300: RValid,
+		150: RUnknown,
+		10:  RInvalid,
+	}
+
+	tests := []struct {
+		name      string
+		pref      uint32
+		want      int
+		wantExist bool
+	}{
+		{
+			name:      "Valid",
+			pref:      300,
+			want:      RValid,
+			wantExist: true,
+		},
+		{
+			name:      "Invalid",
+			pref:      10,
+			want:      RInvalid,
+			wantExist: true,
+		},
+		{
+			name:      "Unknown",
+			pref:      150,
+			want:      RUnknown,
+			wantExist: true,
+		},
+		{
+			name:      "Unmapped local-pref",
+			pref:      200,
+			want:      RUnknown,
+			wantExist: true,
+		},
+	}
+
+	for _, tc := range tests {
+		got, exists := roaFromLocalPref(fmt.Sprintf(output, tc.pref), prefs)
+		if exists != tc.wantExist {
+			t.Errorf("%s: got exists %t, wanted %t", tc.name, exists, tc.wantExist)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %d, wanted %d", tc.name, got, tc.want)
+		}
+	}
+
+	// No route, so no local-pref.
+	if _, exists := roaFromLocalPref("", prefs); exists {
+		t.Errorf("expected no local-pref to be found in empty output")
+	}
+}
+
+func TestDecodeRouteSince(t *testing.T) {
+	now := time.Date(2021, time.February, 3, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		in     string
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			name:   "Date and time",
+			in:     "1.1.1.0/24           unicast [peer1_v4 2021-02-01 10:12:34] * (100) [AS13335i]",
+			want:   time.Date(2021, time.February, 1, 10, 12, 34, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "Date and time with milliseconds and from",
+			in:     "2606:4700::/32       unicast [peer1_v6 2021-02-01 10:12:34.567 from 2001:db8::1] * (100) [AS13335i]",
+			want:   time.Date(2021, time.February, 1, 10, 12, 34, 567000000, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "Date only",
+			in:     "1.1.1.0/24           unicast [peer1_v4 2021-01-19] * (100) [AS13335i]",
+			want:   time.Date(2021, time.January, 19, 0, 0, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "Time only, earlier today",
+			in:     "1.1.1.0/24           unicast [peer1_v4 09:30:00.000] * (100) [AS13335i]",
+			want:   time.Date(2021, time.February, 3, 9, 30, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "Time only, yesterday",
+			in:     "1.1.1.0/24           unicast [peer1_v4 23:15:00] * (100) [AS13335i]",
+			want:   time.Date(2021, time.February, 2, 23, 15, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name: "No route",
+			in:   "",
+		},
+	}
+
+	for _, tc := range tests {
+		got, ok := decodeRouteSince(tc.in, now)
+		if ok != tc.wantOk {
+			t.Errorf("%s: got ok %t, wanted %t", tc.name, ok, tc.wantOk)
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: got %v, wanted %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCountOrigins(t *testing.T) {
+	as4 := "13335\n15169\n13335\n\n3356\n"
+	as6 := "13335\n15169\nbad\n"
+	want := map[uint32]Origin{
+		13335: {V4: 2, V6: 1},
+		15169: {V4: 1, V6: 1},
+		3356:  {V4: 1},
+	}
+	if got := countOrigins(as4, as6); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDecodePrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "Compressed and expanded IPv6",
+			in: `2606:4700::/32       unicast [peer1_v6 2021-02-01] * (100) [AS13335i]
+	via 2001:db8::1 on eth0
+2001:0db8:0000:0100::/56 unicast [peer1_v6 2021-02-01] * (100) [AS64496i]
+2001:4860::/32       unicast [peer1_v6 2021-02-01] * (100) [AS15169i]
+                     unicast [peer2_v6 2021-02-01] (100) [AS15169i]`,
+			want: []string{"2606:4700::/32", "2001:db8:0:100::/56", "2001:4860::/32"},
+		},
+		{
+			name: "Uppercase IPv6 with host bits",
+			in:   "2001:DB8::1/32",
+			want: []string{"2001:db8::/32"},
+		},
+		{
+			name: "Interface zone",
+			in:   "fe80::1%eth0/64 unicast [direct1 2021-02-01] * (240)",
+			want: []string{"fe80::/64"},
+		},
+		{
+			name: "IPv4 output from the awk pipeline",
+			in:   "1.1.1.0/24\n\n8.8.8.0/24\nunicast\n",
+			want: []string{"1.1.1.0/24", "8.8.8.0/24"},
+		},
+		{
+			name: "IPv4 rendered as IPv6",
+			in:   "::ffff:1.1.1.0/120",
+		},
+		{
+			name: "Network not in table",
+			in:   "Network not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range decodePrefixes(tt.in) {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRoutes(t *testing.T) {
+	// Captured from: birdc 'show route primary table all where net ~ [ 1.0.0.0/8+, 2606:4700::/32+ ]'
+	in := `BIRD 2.0.7 ready.
+Table master4:
+1.1.1.0/24           unicast [peer1_v4 2021-02-01 10:12:34] * (100) [AS13335i]
+	via 192.0.2.1 on eth0
+1.0.0.0/24           unicast [peer1_v4 2021-02-01 10:12:34] * (100) [AS13335i]
+	via 192.0.2.1 on eth0
+1.2.3.0/24           unicast [peer2_v4 09:01:22.123] * (100) [AS2906?]
+	via 192.0.2.2 on eth0
+1.0.0.0/8            unreachable [static1 2021-02-01] * (200)
+
+Table master6:
+2606:4700::/32       unicast [peer1_v6 2021-02-01] * (100) [AS13335i]
+	via 2001:db8::1 on eth0
+                     unicast [peer2_v6 2021-02-01] (100) [AS13335i]
+	via 2001:db8::2 on eth0
+2606:4700:10::/44    unicast [peer1_v6 2021-02-01] * (100) [AS13335i]
+	via 2001:db8::1 on eth0
+`
+	want := []string{
+		"1.1.1.0/24 13335",
+		"1.0.0.0/24 13335",
+		"1.2.3.0/24 2906",
+		"1.0.0.0/8 0",
+		"2606:4700::/32 13335",
+		"2606:4700:10::/44 13335",
+	}
+
+	var got []string
+	for _, r := range decodeRoutes(in) {
+		got = append(got, fmt.Sprintf("%s %d", r.Prefix, r.Origin))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if routes := decodeRoutes("BIRD 2.0.7 ready.\nTable master4:\n"); len(routes) != 0 {
+		t.Errorf("got %v, want no routes", routes)
+	}
+}
+
+func TestDecodeCommunities(t *testing.T) {
+	in := `8.8.8.0/24           unicast [peer1_v4 2021-02-01 10:12:34] * (100) [AS15169i]
+	via 192.0.2.1 on eth0
+	Type: BGP univ
+	BGP.origin: IGP
+	BGP.as_path: 3356 15169
+	BGP.next_hop: 192.0.2.1
+	BGP.local_pref: 100
+	BGP.community: (65000,100) (3356,2)
+	BGP.ext_community: (rt, 65000, 100) (generic, 0x43000000, 0x1)
+	BGP.large_community: (65000, 1, 2) (4200000000, 3, 4)
+`
+	want := Communities{
+		Standard: []Community{{ASN: 65000, Value: 100}, {ASN: 3356, Value: 2}},
+		Large:    []LargeCommunity{{ASN: 65000, Data1: 1, Data2: 2}, {ASN: 4200000000, Data1: 3, Data2: 4}},
+		Extended: []ExtendedCommunity{{Type: "rt", Admin: "65000", Value: 100}, {Type: "generic", Admin: "0x43000000", Value: 1}},
+	}
+	if got := decodeCommunities(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A route without communities has none, and bad values are skipped.
+	in = `8.8.8.0/24           unicast [peer1_v4 2021-02-01 10:12:34] * (100) [AS15169i]
+	BGP.community: (65000,70000)
+`
+	if got := decodeCommunities(in); !reflect.DeepEqual(got, Communities{}) {
+		t.Errorf("got %+v, want no communities", got)
+	}
+}
+
+func TestDecodeNextHop(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		want   NextHop
+		wantOk bool
+	}{
+		{
+			name: "Single next hop",
+			// Captured from: birdc show route primary for 8.8.8.8
+			in: `BIRD 2.0.7 ready.
+Table master4:
+8.8.8.0/24           unicast [peer1_v4 2021-02-01 10:12:34] * (100) [AS15169i]
+	via 192.0.2.1 on eth0
+`,
+			want:   NextHop{IP: net.ParseIP("192.0.2.1"), Interface: "eth0"},
+			wantOk: true,
+		},
+		{
+			name: "Multipath takes the first",
+			in: `BIRD 2.0.7 ready.
+Table master6:
+2001:4860::/32       unicast [peer1_v6 2021-02-01] * (100) [AS15169i]
+	via 2001:db8::1 on eth0 weight 1
+	via 2001:db8::2 on eth1 weight 1
+`,
+			want:   NextHop{IP: net.ParseIP("2001:db8::1"), Interface: "eth0"},
+			wantOk: true,
+		},
+		{
+			name: "Directly connected",
+			in: `BIRD 2.0.7 ready.
+Table master4:
+192.0.2.0/24         unicast [direct1 2021-02-01] * (240)
+	dev eth0
+`,
+			want:   NextHop{Interface: "eth0"},
+			wantOk: true,
+		},
+		{
+			name: "Unreachable",
+			in: `BIRD 2.0.7 ready.
+Table master4:
+1.0.0.0/8            unreachable [static1 2021-02-01] * (200)
+`,
+		},
+		{
+			name: "No route",
+			in:   "BIRD 2.0.7 ready.\nNetwork not found\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := decodeNextHop(tc.in)
+			if ok != tc.wantOk || !got.IP.Equal(tc.want.IP) || got.Interface != tc.want.Interface {
+				t.Errorf("got %v, %t, want %v, %t", got, ok, tc.want, tc.wantOk)
+			}
+		})
+	}
+}
+
+func TestDecodeStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{
+		{
+			name: "Running",
+			// Captured from: birdc show status
+			in: `BIRD 2.0.7 ready.
+BIRD 2.0.7
+Router ID is 192.0.2.1
+Current server time is 2021-02-01 10:12:34.567
+Last reboot on 2021-01-01 09:00:00.123
+Last reconfiguration on 2021-01-01 09:00:00.123
+Daemon is up and running
+`,
+		},
+		{
+			name:    "Not running",
+			in:      "Unable to connect to server control socket (/run/bird/bird.ctl): Connection refused\n",
+			wantErr: true,
+		},
+		{
+			name:    "Shutting down",
+			in:      "BIRD 2.0.7 ready.\nDaemon is shutting down\n",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := decodeStatus(tc.in); (err != nil) != tc.wantErr {
+				t.Errorf("got %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -1,49 +1,101 @@
 package clidecode
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+)
 
-// Decoder is an interface that represents a router to interrogate
+// Decoder is an interface that represents a router to interrogate.
+// Each call should be aborted once the context is done.
 type Decoder interface {
+	// Capabilities returns the optional lookups the router supports.
+	Capabilities() DecoderCaps
+
+	// Ping returns an error if the router daemon isn't answering.
+	Ping(context.Context) error
+
 	// GetBGPTotal returns rib, fib ipv4. rib, fib ipv6
-	GetBGPTotal() (Totals, error)
+	GetBGPTotal(context.Context) (Totals, error)
 
 	// GetPeers returns ipv4 peer configured, established. ipv6 peers configured, established
-	GetPeers() (Peers, error)
+	GetPeers(context.Context) (Peers, error)
 
 	// GetTotalSourceASNs returns total amount of unique ASNs
-	GetTotalSourceASNs() (ASNs, error)
+	GetTotalSourceASNs(context.Context) (ASNs, error)
+
+	// GetOriginCounts returns the amount of prefixes each ASN originates.
+	GetOriginCounts(context.Context) (map[uint32]Origin, error)
 
 	// GetMasks returns the total count of each mask value
 	// First item is IPv4, second item is IPv6
-	GetMasks() ([]map[string]uint32, error)
+	GetMasks(context.Context) ([]map[string]uint32, error)
 
 	// GetROAs returns total amount of all ROA states
-	GetROAs() (Roas, error)
+	GetROAs(context.Context) (Roas, error)
 
 	// GetLargeCommunities returns the amount of prefixes that have large communities attached (RFC8092)
-	GetLargeCommunities() (Large, error)
+	GetLargeCommunities(context.Context) (Large, error)
 
 	// GetIPv4FromSource returns all the IPv4 networks sourced from a source ASN.
-	GetIPv4FromSource(uint32) ([]*net.IPNet, error)
+	GetIPv4FromSource(context.Context, uint32) ([]*net.IPNet, error)
 
 	// GetIPv6FromSource returns all the IPv6 networks sourced from a source ASN.
-	GetIPv6FromSource(uint32) ([]*net.IPNet, error)
+	GetIPv6FromSource(context.Context, uint32) ([]*net.IPNet, error)
 
 	// GetOriginFromIP will return the origin ASN from a source IP.
-	GetOriginFromIP(net.IP) (uint32, bool, error)
+	GetOriginFromIP(context.Context, net.IP) (uint32, bool, error)
 
 	// GetASPathFromIP will return the AS path, as well as as-set if any from a source IP.
-	GetASPathFromIP(net.IP) (ASPath, bool, error)
+	GetASPathFromIP(context.Context, net.IP) (ASPath, bool, error)
 
 	// GetRoute will return the current FIB entry, if any, from a source IP.
-	GetRoute(net.IP) (*net.IPNet, bool, error)
+	GetRoute(context.Context, net.IP) (*net.IPNet, bool, error)
+
+	// GetRoutesWhere returns the primary route for every prefix matching a filter expression.
+	GetRoutesWhere(context.Context, string) ([]Route, error)
+
+	// GetRouteSince will return the time the current FIB entry last changed, if known.
+	GetRouteSince(context.Context, net.IP) (time.Time, bool, error)
+
+	// GetFilteredRoute will return a route, if any, from a source IP that was received but rejected by import policy.
+	GetFilteredRoute(context.Context, net.IP) (*net.IPNet, bool, error)
 
 	// GetROA will return the ROA status, if any, from a source IP and ASN.
-	GetROA(*net.IPNet, uint32) (int, bool, error)
+	GetROA(context.Context, *net.IPNet, uint32) (int, bool, error)
+
+	// GetCommunities will return the BGP communities on the current route, if any, from a source IP.
+	GetCommunities(context.Context, net.IP) (Communities, bool, error)
+
+	// GetNextHop will return the next hop of the current route, if any, from a source IP.
+	GetNextHop(context.Context, net.IP) (NextHop, bool, error)
 
 	// GetInvalids returns a map of ASNs that are advertising RPKI invalid prefixes.
 	// It also includes all those prefixes being advertised.
-	GetInvalids() (map[string][]string, error)
+	GetInvalids(context.Context) (map[string][]string, error)
+}
+
+// DecoderCaps reports which of the optional lookups a router supports.
+// Callers should not use an unsupported lookup.
+type DecoderCaps struct {
+	// ASPath is GetASPathFromIP.
+	ASPath bool
+	// ROA is GetROA and GetROAs.
+	ROA bool
+	// Invalids is GetInvalids.
+	Invalids bool
+	// RouteSince is GetRouteSince.
+	RouteSince bool
+	// LargeCommunities is GetLargeCommunities.
+	LargeCommunities bool
+	// RoutesWhere is GetRoutesWhere.
+	RoutesWhere bool
+	// Filtered is GetFilteredRoute.
+	Filtered bool
+	// Communities is GetCommunities.
+	Communities bool
+	// NextHop is GetNextHop.
+	NextHop bool
 }
 
 // Totals holds the total BGP route count.
@@ -73,6 +125,11 @@ type ASNs struct {
 	AsBoth           uint32
 }
 
+// Origin holds the amount of prefixes originated by a single ASN.
+type Origin struct {
+	V4, V6 uint32
+}
+
 // Roas holds the ROA state.
 // v = valid
 // i = invalid
@@ -93,6 +150,44 @@ type ASPath struct {
 	Set  []uint32
 }
 
+// Communities holds the BGP communities attached to a route.
+type Communities struct {
+	Standard []Community
+	Large    []LargeCommunity
+	Extended []ExtendedCommunity
+}
+
+// Community is a standard community (RFC1997), e.g. 65000:100.
+type Community struct {
+	ASN, Value uint32
+}
+
+// LargeCommunity is a large community (RFC8092), e.g. 65000:1:2.
+type LargeCommunity struct {
+	ASN, Data1, Data2 uint32
+}
+
+// ExtendedCommunity is an extended community (RFC4360), e.g. rt 65000:100.
+// Admin is an AS number or an IPv4 address, depending on the type.
+type ExtendedCommunity struct {
+	Type, Admin string
+	Value       uint32
+}
+
+// NextHop is where traffic for a route is forwarded. IP is nil for a directly
+// connected route, and Interface is empty if the router doesn't show it.
+type NextHop struct {
+	IP        net.IP
+	Interface string
+}
+
+// Route is a single route returned by a filtered query.
+type Route struct {
+	Prefix *net.IPNet
+	// Origin is 0 if the route has no AS path, such as a static route.
+	Origin uint32
+}
+
 const (
 	// RUnknown = ROA Unknown
 	RUnknown = iota
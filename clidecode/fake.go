@@ -1,75 +1,129 @@
 package clidecode
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+)
 
 // FakeConn will be a connection to a fake instance.
 type FakeConn struct{}
 
+// Capabilities returns the optional lookups the router supports.
+func (f FakeConn) Capabilities() DecoderCaps {
+	return DecoderCaps{
+		ASPath:           true,
+		ROA:              true,
+		Invalids:         true,
+		RouteSince:       true,
+		LargeCommunities: true,
+		RoutesWhere:      true,
+		Filtered:         true,
+		Communities:      true,
+		NextHop:          true,
+	}
+}
+
+// Ping returns an error if the router daemon isn't answering.
+func (f FakeConn) Ping(context.Context) error {
+	return nil
+}
+
 // GetBGPTotal returns rib, fib ipv4. rib, fib ipv6
-func (f FakeConn) GetBGPTotal() (Totals, error) {
+func (f FakeConn) GetBGPTotal(context.Context) (Totals, error) {
 	return Totals{}, nil
 }
 
 // GetPeers returns ipv4 peer configured, established. ipv6 peers configured, established
-func (f FakeConn) GetPeers() (Peers, error) {
+func (f FakeConn) GetPeers(context.Context) (Peers, error) {
 	return Peers{}, nil
 }
 
 // GetTotalSourceASNs returns total amount of unique ASNs
-func (f FakeConn) GetTotalSourceASNs() (ASNs, error) {
+func (f FakeConn) GetTotalSourceASNs(context.Context) (ASNs, error) {
 	return ASNs{}, nil
 }
 
+// GetOriginCounts returns the amount of prefixes each ASN originates.
+func (f FakeConn) GetOriginCounts(context.Context) (map[uint32]Origin, error) {
+	return nil, nil
+}
+
 // GetMasks returns the total count of each mask value
 // First item is IPv4, second item is IPv6
-func (f FakeConn) GetMasks() ([]map[string]uint32, error) {
+func (f FakeConn) GetMasks(context.Context) ([]map[string]uint32, error) {
 	v4 := make(map[string]uint32)
 	v6 := make(map[string]uint32)
 	return []map[string]uint32{v4, v6}, nil
 }
 
 // GetROAs returns total amount of all ROA states
-func (f FakeConn) GetROAs() (Roas, error) {
+func (f FakeConn) GetROAs(context.Context) (Roas, error) {
 	return Roas{}, nil
 }
 
 // GetLargeCommunities returns the amount of prefixes that have large communities attached (RFC8092)
-func (f FakeConn) GetLargeCommunities() (Large, error) {
+func (f FakeConn) GetLargeCommunities(context.Context) (Large, error) {
 	return Large{}, nil
 }
 
 // GetIPv4FromSource returns all the IPv4 networks sourced from a source ASN.
-func (f FakeConn) GetIPv4FromSource(uint32) ([]*net.IPNet, error) {
+func (f FakeConn) GetIPv4FromSource(context.Context, uint32) ([]*net.IPNet, error) {
 	return nil, nil
 }
 
 // GetIPv6FromSource returns all the IPv6 networks sourced from a source ASN.
-func (f FakeConn) GetIPv6FromSource(uint32) ([]*net.IPNet, error) {
+func (f FakeConn) GetIPv6FromSource(context.Context, uint32) ([]*net.IPNet, error) {
 	return nil, nil
 }
 
 // GetOriginFromIP will return the origin ASN from a source IP.
-func (f FakeConn) GetOriginFromIP(net.IP) (uint32, bool, error) {
+func (f FakeConn) GetOriginFromIP(context.Context, net.IP) (uint32, bool, error) {
 	return 0, false, nil
 }
 
 // GetASPathFromIP will return the AS path, as well as as-set if any from a source IP.
-func (f FakeConn) GetASPathFromIP(net.IP) (ASPath, bool, error) {
+func (f FakeConn) GetASPathFromIP(context.Context, net.IP) (ASPath, bool, error) {
 	return ASPath{}, false, nil
 }
 
 // GetRoute will return the current FIB entry, if any, from a source IP.
-func (f FakeConn) GetRoute(net.IP) (*net.IPNet, bool, error) {
+func (f FakeConn) GetRoute(context.Context, net.IP) (*net.IPNet, bool, error) {
+	return nil, false, nil
+}
+
+// GetRoutesWhere returns the primary route for every prefix matching a filter expression.
+func (f FakeConn) GetRoutesWhere(context.Context, string) ([]Route, error) {
+	return nil, nil
+}
+
+// GetRouteSince will return the time the current FIB entry last changed, if known.
+func (f FakeConn) GetRouteSince(context.Context, net.IP) (time.Time, bool, error) {
+	return time.Time{}, false, nil
+}
+
+// GetFilteredRoute will return a route, if any, from a source IP that was received but rejected by import policy.
+func (f FakeConn) GetFilteredRoute(context.Context, net.IP) (*net.IPNet, bool, error) {
 	return nil, false, nil
 }
 
 // GetROA will return the ROA status, if any, from a source IP.
-func (f FakeConn) GetROA(*net.IPNet, uint32) (int, bool, error) {
+func (f FakeConn) GetROA(context.Context, *net.IPNet, uint32) (int, bool, error) {
 	return 0, false, nil
 }
 
+// GetCommunities will return the BGP communities on the current route, if any, from a source IP.
+func (f FakeConn) GetCommunities(context.Context, net.IP) (Communities, bool, error) {
+	return Communities{}, false, nil
+}
+
+// GetNextHop will return the next hop of the current route, if any, from a source IP.
+func (f FakeConn) GetNextHop(context.Context, net.IP) (NextHop, bool, error) {
+	return NextHop{}, false, nil
+}
+
 // GetInvalids returns a map of ASNs that are advertising RPKI invalid prefixes.
 // It also includes all those prefixes being advertised.
-func (f FakeConn) GetInvalids() (map[string][]string, error) {
+func (f FakeConn) GetInvalids(context.Context) (map[string][]string, error) {
 	return nil, nil
 }
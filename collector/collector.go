@@ -34,12 +34,8 @@ func main() {
 	daemon := cf.Section("local").Key("daemon").String()
 
 	// Set up log file
-	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("failed to open logfile: %v\n", err)
-	}
+	f := c.SetLogOutput(logfile, c.LogRotateConfig(cf.Section("grpc")))
 	defer f.Close()
-	log.SetOutput(f)
 
 	var router cli.Decoder
 	switch daemon {
@@ -49,14 +45,16 @@ func main() {
 		log.Fatalf("daemon type must be specified")
 	}
 
+	ctx := context.Background()
 	current := &pb.Values{
 		Time:           uint64(time.Now().Unix()),
-		PrefixCount:    getTableTotal(router),
-		Peers:          getPeers(router),
-		AsCount:        getAS(router),
-		Masks:          getMasks(router),
-		LargeCommunity: getLargeCommunities(router),
-		Roas:           getROAs(router),
+		PrefixCount:    getTableTotal(ctx, router),
+		Peers:          getPeers(ctx, router),
+		AsCount:        getAS(ctx, router),
+		Masks:          getMasks(ctx, router),
+		LargeCommunity: getLargeCommunities(ctx, router),
+		Roas:           getROAs(ctx, router),
+		Origins:        getOrigins(ctx, router),
 	}
 
 	log.Printf("%v\n", current)
@@ -80,10 +78,10 @@ func main() {
 }
 
 // getTableTotal returns the complete RIB and FIB counts.
-func getTableTotal(d cli.Decoder) *pb.PrefixCount {
+func getTableTotal(ctx context.Context, d cli.Decoder) *pb.PrefixCount {
 	defer c.TimeFunction(time.Now(), "getTableTotal")
 
-	tot, err := d.GetBGPTotal()
+	tot, err := d.GetBGPTotal(ctx)
 	if err != nil {
 		log.Println(err)
 	}
@@ -97,10 +95,10 @@ func getTableTotal(d cli.Decoder) *pb.PrefixCount {
 }
 
 // getPeers returns how many peers are configured, and how many are established.
-func getPeers(d cli.Decoder) *pb.PeerCount {
+func getPeers(ctx context.Context, d cli.Decoder) *pb.PeerCount {
 	defer c.TimeFunction(time.Now(), "getPeers")
 
-	peers, err := d.GetPeers()
+	peers, err := d.GetPeers(ctx)
 	if err != nil {
 		log.Println(err)
 	}
@@ -115,10 +113,10 @@ func getPeers(d cli.Decoder) *pb.PeerCount {
 }
 
 // getAS returns a unique slice of all source ASs seen.
-func getAS(d cli.Decoder) *pb.AsCount {
+func getAS(ctx context.Context, d cli.Decoder) *pb.AsCount {
 	defer c.TimeFunction(time.Now(), "getAS")
 
-	as, err := d.GetTotalSourceASNs()
+	as, err := d.GetTotalSourceASNs(ctx)
 	if err != nil {
 		log.Println(err)
 	}
@@ -135,10 +133,10 @@ func getAS(d cli.Decoder) *pb.AsCount {
 }
 
 // getMasks returns the total amount of each subnet mask.
-func getMasks(d cli.Decoder) *pb.Masks {
+func getMasks(ctx context.Context, d cli.Decoder) *pb.Masks {
 	defer c.TimeFunction(time.Now(), "getMasks")
 
-	m, err := d.GetMasks()
+	m, err := d.GetMasks(ctx)
 	if err != nil {
 		log.Println(err)
 	}
@@ -216,10 +214,10 @@ func getMasks(d cli.Decoder) *pb.Masks {
 }
 
 // getLargeCommunities finds the amount of prefixes that have large communities (RFC8092)
-func getLargeCommunities(d cli.Decoder) *pb.LargeCommunity {
+func getLargeCommunities(ctx context.Context, d cli.Decoder) *pb.LargeCommunity {
 	defer c.TimeFunction(time.Now(), "getLargeCommunities")
 
-	l, err := d.GetLargeCommunities()
+	l, err := d.GetLargeCommunities(ctx)
 	if err != nil {
 		log.Println(err)
 	}
@@ -231,10 +229,10 @@ func getLargeCommunities(d cli.Decoder) *pb.LargeCommunity {
 }
 
 // getROAs returns the amount of RPKI ROAs in VALID, INVALID, and UNKNOWN status.
-func getROAs(d cli.Decoder) *pb.Roas {
+func getROAs(ctx context.Context, d cli.Decoder) *pb.Roas {
 	defer c.TimeFunction(time.Now(), "getROAs")
 
-	r, err := d.GetROAs()
+	r, err := d.GetROAs(ctx)
 	if err != nil {
 		log.Println(err)
 	}
@@ -249,3 +247,25 @@ func getROAs(d cli.Decoder) *pb.Roas {
 	}
 
 }
+
+// getOrigins returns the amount of prefixes originated by each ASN.
+func getOrigins(ctx context.Context, d cli.Decoder) []*pb.OriginCount {
+	defer c.TimeFunction(time.Now(), "getOrigins")
+
+	origins, err := d.GetOriginCounts(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+
+	counts := make([]*pb.OriginCount, 0, len(origins))
+	for asn, o := range origins {
+		counts = append(counts, &pb.OriginCount{
+			AsNumber: asn,
+			V4Count:  o.V4,
+			V6Count:  o.V6,
+		})
+	}
+
+	return counts
+
+}
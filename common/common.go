@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -58,8 +59,13 @@ type BgpUpdate struct {
 
 // GetOutput is a helper function to run commands and return outputs to other functions.
 func GetOutput(cmd string) (string, error) {
+	return GetOutputContext(context.Background(), cmd)
+}
+
+// GetOutputContext is like GetOutput, but the command is killed once the context is done.
+func GetOutputContext(ctx context.Context, cmd string) (string, error) {
 	log.Printf("Running getOutput with cmd %s\n", cmd)
-	cmdOut, err := exec.Command("bash", "-c", cmd).Output()
+	cmdOut, err := exec.CommandContext(ctx, "bash", "-c", cmd).Output()
 	if err != nil {
 		return string(cmdOut), err
 	}
@@ -146,11 +152,29 @@ func TimeFunction(start time.Time, name string) {
 	log.Printf("%s took %s\n", name, time.Since(start))
 }
 
+// Family is the address family of an IP address.
+type Family int
+
+const (
+	// IPv4 includes IPv4-mapped IPv6 addresses.
+	IPv4 Family = iota + 1
+	// IPv6 is all other IPv6 addresses.
+	IPv6
+)
+
 // ValidateIP ensures the IP address is valid.
 // non Public IPs are not valid.
 func ValidateIP(ip string) (net.IP, error) {
 	log.Printf("Running validateIP")
 
+	parsed, _, err := ValidateIPFamily(ip)
+	return parsed, err
+
+}
+
+// ValidateIPFamily ensures the IP address is valid, and returns its family.
+// IPv4 and IPv4-mapped IPv6 addresses are both returned in the 4 byte form.
+func ValidateIPFamily(ip string) (net.IP, Family, error) {
 	var parsed net.IP
 
 	if strings.Contains(ip, "/") {
@@ -159,14 +183,17 @@ func ValidateIP(ip string) (net.IP, error) {
 		parsed = net.ParseIP(ip)
 	}
 	if parsed == nil {
-		return nil, fmt.Errorf("Unable to parse IP: %s", ip)
+		return nil, 0, fmt.Errorf("Unable to parse IP: %s", ip)
 	}
 
 	if !IsPublicIP(parsed) {
-		return nil, fmt.Errorf("%s is not a public IP", ip)
+		return nil, 0, fmt.Errorf("%s is not a public IP", ip)
 	}
 
-	return parsed, nil
+	if v4 := parsed.To4(); v4 != nil {
+		return v4, IPv4, nil
+	}
+	return parsed, IPv6, nil
 
 }
 
@@ -261,8 +288,10 @@ func ValidateASN(asn uint32) bool {
 }
 
 // ASPlainToASDot will convert an ASPLAIN AS number to a ASDOT representation.
+// As per RFC 5396, 16-bit AS numbers stay as they are and 32-bit AS numbers
+// are written as high.low.
 func ASPlainToASDot(asn uint32) string {
-	if asn < 1 || asn > 4294967295 {
+	if asn == 0 {
 		return ""
 	}
 	dot1 := asn / 65536
@@ -272,36 +301,36 @@ func ASPlainToASDot(asn uint32) string {
 		return fmt.Sprintf("%d", dot2)
 	}
 
-	return fmt.Sprintf("%d.%d", int(dot1), dot2)
+	return fmt.Sprintf("%d.%d", dot1, dot2)
 
 }
 
 // ASDotToASPlain will convert an ASDOT AS number to a ASPLAIN representation.
+// 0 is returned if the input is not a valid AS number. asdot+ input such as
+// 0.6453 is accepted, so it will be rendered back as 6453.
 func ASDotToASPlain(asn string) uint32 {
 	asStrings := strings.Split(asn, ".")
 	if len(asStrings) > 2 {
 		return 0
 	}
 
-	// Not using asdot+, so a single field is legitimate.
-	if len(asStrings) == 1 {
-		asPlain := StringToUint32(asStrings[0])
-		if asPlain < 1 || asPlain > 65535 {
+	// Each field must be a 16-bit number.
+	var fields []uint32
+	for _, f := range asStrings {
+		v, err := strconv.ParseUint(f, 10, 16)
+		if err != nil {
 			return 0
 		}
-		return asPlain
-
+		fields = append(fields, uint32(v))
 	}
 
-	// Else it's regular asdot notation
-	dot1 := StringToUint32(asStrings[0])
-	dot2 := StringToUint32(asStrings[1])
-
-	if dot1 < 0 || dot1 > 65535 || dot2 < 0 || dot2 > 65535 {
-		return 0
+	// Not using asdot+, so a single field is legitimate.
+	if len(fields) == 1 {
+		return fields[0]
 	}
 
-	return dot1*65536 + dot2
+	// Else it's regular asdot notation
+	return fields[0]*65536 + fields[1]
 
 }
 
@@ -1,9 +1,11 @@
 package common
 
 import (
+	"context"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestStringToUint32(t *testing.T) {
@@ -94,6 +96,68 @@ func TestValidateIP(t *testing.T) {
 	}
 }
 
+func TestValidateIPFamily(t *testing.T) {
+	var tests = []struct {
+		name    string
+		in      string
+		out     string
+		len     int
+		family  Family
+		wantErr bool
+	}{
+		{
+			name:   "IPv4",
+			in:     "1.1.1.1",
+			out:    "1.1.1.1",
+			len:    4,
+			family: IPv4,
+		},
+		{
+			name:   "IPv6",
+			in:     "2606:4700::1111/128",
+			out:    "2606:4700::1111",
+			len:    16,
+			family: IPv6,
+		},
+		{
+			name:   "IPv4-mapped IPv6",
+			in:     "::ffff:8.8.8.8",
+			out:    "8.8.8.8",
+			len:    4,
+			family: IPv4,
+		},
+		{
+			name:    "Invalid",
+			in:      "8.8.8",
+			wantErr: true,
+		},
+		{
+			name:    "Private",
+			in:      "::ffff:10.0.0.1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, family, err := ValidateIPFamily(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("wanted error, but got %s", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != tt.out || len(ip) != tt.len || family != tt.family {
+				t.Errorf("got %s (%d bytes) family %d, want %s (%d bytes) family %d",
+					ip, len(ip), family, tt.out, tt.len, tt.family)
+			}
+		})
+	}
+}
+
 func TestInFirstButNotSecond(t *testing.T) {
 	var tests = []struct {
 		name   string
@@ -317,3 +381,98 @@ func TestASDotToASPlain(t *testing.T) {
 	}
 
 }
+
+func TestASDotBoundaries(t *testing.T) {
+	var asns = []struct {
+		name  string
+		asn   uint32
+		asdot string
+	}{
+		{
+			name:  "Smallest",
+			asn:   1,
+			asdot: "1",
+		},
+		{
+			name:  "Largest 16-bit",
+			asn:   65535,
+			asdot: "65535",
+		},
+		{
+			name:  "Smallest 32-bit",
+			asn:   65536,
+			asdot: "1.0",
+		},
+		{
+			name:  "Largest 32-bit",
+			asn:   4294967295,
+			asdot: "65535.65535",
+		},
+	}
+
+	for _, tt := range asns {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ASPlainToASDot(tt.asn); got != tt.asdot {
+				t.Errorf("ASPlainToASDot(%d) = %q, want %q", tt.asn, got, tt.asdot)
+			}
+			// Each rendering should parse back to the same AS number.
+			if got := ASDotToASPlain(tt.asdot); got != tt.asn {
+				t.Errorf("ASDotToASPlain(%q) = %d, want %d", tt.asdot, got, tt.asn)
+			}
+		})
+	}
+
+	if got := ASPlainToASDot(0); got != "" {
+		t.Errorf("ASPlainToASDot(0) = %q, want empty", got)
+	}
+}
+
+func TestASDotToASPlainInput(t *testing.T) {
+	var asns = []struct {
+		asn  string
+		want uint32
+	}{
+		// asdot+ input is accepted and normalised.
+		{"0.6453", 6453},
+		{"65536", 0},
+		{"1.65536", 0},
+		{"65536.0", 0},
+		{"1.", 0},
+		{".1", 0},
+		{"1.2.3", 0},
+		{"AS1.2", 0},
+		{"-1", 0},
+		{"", 0},
+	}
+
+	for _, tt := range asns {
+		if got := ASDotToASPlain(tt.asn); got != tt.want {
+			t.Errorf("ASDotToASPlain(%q) = %d, want %d", tt.asn, got, tt.want)
+		}
+	}
+
+	// The normalised input renders without a dot.
+	if got := ASPlainToASDot(ASDotToASPlain("0.6453")); got != "6453" {
+		t.Errorf("0.6453 rendered as %q, want 6453", got)
+	}
+}
+
+func TestGetOutputContext(t *testing.T) {
+	out, err := GetOutputContext(context.Background(), "echo hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello" {
+		t.Errorf("got %q, want %q", out, "hello")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := GetOutputContext(ctx, "sleep 10"); err == nil {
+		t.Error("expected an error when the context is done")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("command was not killed when the context was done, took %v", time.Since(start))
+	}
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigCheck collects all the problems found in a config file, so they can be reported at once.
+type ConfigCheck struct {
+	problems []string
+}
+
+func (c *ConfigCheck) add(format string, a ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, a...))
+}
+
+// Required checks that the key is set.
+func (c *ConfigCheck) Required(section, key, value string) {
+	if value == "" {
+		c.add("missing required key %q in section [%s]", key, section)
+	}
+}
+
+// OneOf checks that the key, if set, is one of the allowed values.
+func (c *ConfigCheck) OneOf(section, key, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	c.add("[%s] %s: %q must be one of %s", section, key, value, strings.Join(allowed, ", "))
+}
+
+// Port checks that the key, if set, is a valid port number.
+func (c *ConfigCheck) Port(section, key, value string) {
+	if value == "" {
+		return
+	}
+	port, err := strconv.Atoi(strings.TrimPrefix(value, ":"))
+	if err != nil || port < 1 || port > 65535 {
+		c.add("[%s] %s: %q is not a valid port", section, key, value)
+	}
+}
+
+// Duration checks that the key, if set, can be parsed as a duration.
+func (c *ConfigCheck) Duration(section, key, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		c.add("[%s] %s: %q is not a valid duration", section, key, value)
+	}
+}
+
+// Uint checks that the key, if set, is a positive number.
+func (c *ConfigCheck) Uint(section, key, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		c.add("[%s] %s: %q is not a valid number", section, key, value)
+	}
+}
+
+// Fraction checks that the key, if set, is a number from 0 up to, but not including, 1.
+func (c *ConfigCheck) Fraction(section, key, value string) {
+	if value == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f >= 1 {
+		c.add("[%s] %s: %q is not a fraction between 0 and 1", section, key, value)
+	}
+}
+
+// Writable checks that the file, if set, can be opened for writing.
+func (c *ConfigCheck) Writable(section, key, path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		c.add("[%s] %s: %q is not writable: %v", section, key, path, err)
+		return
+	}
+	f.Close()
+}
+
+// Readable checks that the file, if set, can be opened for reading.
+func (c *ConfigCheck) Readable(section, key, path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		c.add("[%s] %s: %q is not readable: %v", section, key, path, err)
+		return
+	}
+	f.Close()
+}
+
+// Err returns all problems found as a single error, or nil if there are none.
+func (c *ConfigCheck) Err() error {
+	if len(c.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d config problem(s) found:\n\t%s", len(c.problems), strings.Join(c.problems, "\n\t"))
+}
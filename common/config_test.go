@@ -0,0 +1,85 @@
+package common
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigCheck(t *testing.T) {
+	var tests = []struct {
+		name    string
+		check   func(c *ConfigCheck)
+		wantErr string
+	}{
+		{
+			name: "All good",
+			check: func(c *ConfigCheck) {
+				c.Required("sql", "username", "bgp")
+				c.Port("grpc", "port", "7179")
+				c.Duration("asnames", "refresh", "24h")
+				c.Uint("roa", "valid", "200")
+				c.Fraction("cache", "jitter", "0.1")
+				c.Writable("log", "file", filepath.Join(t.TempDir(), "test.log"))
+			},
+		},
+		{
+			name: "Missing key",
+			check: func(c *ConfigCheck) {
+				c.Required("sql", "username", "")
+			},
+			wantErr: `missing required key "username" in section [sql]`,
+		},
+		{
+			name: "Bad port",
+			check: func(c *ConfigCheck) {
+				c.Port("grpc", "port", "71790")
+			},
+			wantErr: `[grpc] port: "71790" is not a valid port`,
+		},
+		{
+			name: "Unsupported value",
+			check: func(c *ConfigCheck) {
+				c.OneOf("local", "daemon", "quagga", "bird2")
+			},
+			wantErr: `[local] daemon: "quagga" must be one of bird2`,
+		},
+		{
+			name: "Bad duration",
+			check: func(c *ConfigCheck) {
+				c.Duration("asnames", "refresh", "daily")
+			},
+			wantErr: `[asnames] refresh: "daily" is not a valid duration`,
+		},
+		{
+			name: "Bad fraction",
+			check: func(c *ConfigCheck) {
+				c.Fraction("cache", "jitter", "1.5")
+			},
+			wantErr: `[cache] jitter: "1.5" is not a fraction between 0 and 1`,
+		},
+		{
+			name: "Unwritable file",
+			check: func(c *ConfigCheck) {
+				c.Writable("log", "file", filepath.Join(t.TempDir(), "missing", "test.log"))
+			},
+			wantErr: `[log] file:`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var c ConfigCheck
+			tc.check(&c)
+			err := c.Err()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
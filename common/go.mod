@@ -1,3 +1,5 @@
 module github.com/mellowdrifter/bgp_infrastructure/common
 
 go 1.16
+
+require gopkg.in/ini.v1 v1.62.0
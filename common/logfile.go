@@ -0,0 +1,209 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// RotateConfig holds the log rotation settings. Zero values disable that limit.
+type RotateConfig struct {
+	// MaxSize is the size in bytes the log file can grow to before being rotated.
+	MaxSize int64
+	// MaxBackups is the amount of rotated files to keep.
+	MaxBackups int
+	// MaxAge is how long to keep rotated files.
+	MaxAge time.Duration
+	// Compress will gzip rotated files.
+	Compress bool
+}
+
+// LogRotateConfig reads the optional log rotation settings from a config section.
+// maxsize is in megabytes and maxage is in days.
+func LogRotateConfig(sec *ini.Section) RotateConfig {
+	return RotateConfig{
+		MaxSize:    sec.Key("maxsize").MustInt64(0) * 1024 * 1024,
+		MaxBackups: sec.Key("maxbackups").MustInt(0),
+		MaxAge:     time.Duration(sec.Key("maxage").MustInt(0)) * 24 * time.Hour,
+		Compress:   sec.Key("compress").MustBool(false),
+	}
+}
+
+// SetLogOutput sends log output to the log file. If no file is set, or it can't be opened,
+// a warning is logged and output stays on stderr so the service can still start.
+// The returned Closer should be closed on exit.
+func SetLogOutput(name string, cfg RotateConfig) io.Closer {
+	if name == "" {
+		log.SetOutput(os.Stderr)
+		log.Printf("WARNING: no log file configured, logging to stderr")
+		return ioutil.NopCloser(nil)
+	}
+	f, err := OpenLogFile(name, cfg)
+	if err != nil {
+		log.SetOutput(os.Stderr)
+		log.Printf("WARNING: unable to open log file %q, logging to stderr: %v", name, err)
+		return ioutil.NopCloser(nil)
+	}
+	log.SetOutput(f)
+	return f
+}
+
+// LogFile is a log file that rotates itself once it reaches a maximum size.
+type LogFile struct {
+	name string
+	cfg  RotateConfig
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenLogFile opens, or creates, a log file for appending.
+func OpenLogFile(name string, cfg RotateConfig) (*LogFile, error) {
+	l := &LogFile{
+		name: name,
+		cfg:  cfg,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write will write to the log file, rotating first if the write takes it past the maximum size.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cfg.MaxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.cfg.MaxSize {
+		if err := l.rotate(); err != nil {
+			// The log package discards write errors, so the failure is noted in
+			// the file instead. Rotation is tried again once another MaxSize is written.
+			l.note("unable to rotate log file: %v", err)
+			l.size = 0
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the current log file.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// note writes a line about the log file itself, in the log package's format.
+func (l *LogFile) note(format string, v ...interface{}) {
+	n, _ := fmt.Fprintf(l.file, "%s %s\n", time.Now().Format("2006/01/02 15:04:05"), fmt.Sprintf(format, v...))
+	l.size += int64(n)
+}
+
+// rotate moves the current file to a timestamped backup and opens a new one.
+// If the file can't be moved it is reopened, so logging carries on in it.
+func (l *LogFile) rotate() error {
+	backup := fmt.Sprintf("%s.%s", l.name, time.Now().Format("20060102-150405.000000"))
+	moveErr := l.file.Close()
+	if moveErr == nil {
+		moveErr = os.Rename(l.name, backup)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	if moveErr != nil {
+		return moveErr
+	}
+
+	// The new file is open, so later failures only need noting in it.
+	if l.cfg.Compress {
+		if err := compressFile(backup); err != nil {
+			l.note("unable to compress %s: %v", backup, err)
+		}
+	}
+	if err := l.removeOldBackups(); err != nil {
+		l.note("unable to remove old log files: %v", err)
+	}
+
+	return nil
+}
+
+// removeOldBackups removes backups over the maximum count or age.
+func (l *LogFile) removeOldBackups() error {
+	backups, err := filepath.Glob(l.name + ".*")
+	if err != nil {
+		return err
+	}
+	// Timestamps sort oldest first, so reverse to get the newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		remove := l.cfg.MaxBackups > 0 && i >= l.cfg.MaxBackups
+		if l.cfg.MaxAge > 0 {
+			info, err := os.Stat(backup)
+			if err == nil && time.Since(info.ModTime()) > l.cfg.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			if err := os.Remove(backup); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// compressFile gzips the file and removes the original.
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
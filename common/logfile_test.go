@@ -0,0 +1,179 @@
+package common
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestLogFileRotate(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      RotateConfig
+		writes   int
+		backups  int
+		suffix   string
+		lastSize int
+	}{
+		{
+			name:     "Rotate once",
+			cfg:      RotateConfig{MaxSize: 20},
+			writes:   3,
+			backups:  1,
+			lastSize: 10,
+		},
+		{
+			name:     "Keep max backups",
+			cfg:      RotateConfig{MaxSize: 10, MaxBackups: 2},
+			writes:   5,
+			backups:  2,
+			lastSize: 10,
+		},
+		{
+			name:     "Compress backups",
+			cfg:      RotateConfig{MaxSize: 10, Compress: true},
+			writes:   2,
+			backups:  1,
+			suffix:   ".gz",
+			lastSize: 10,
+		},
+		{
+			name:     "No limit",
+			writes:   5,
+			lastSize: 50,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "test.log")
+			l, err := OpenLogFile(name, tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tc.writes; i++ {
+				if _, err := l.Write([]byte("123456789\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			backups, err := filepath.Glob(name + ".*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backups) != tc.backups {
+				t.Errorf("got %d backups, want %d: %v", len(backups), tc.backups, backups)
+			}
+			for _, b := range backups {
+				if !strings.HasSuffix(b, tc.suffix) {
+					t.Errorf("backup %s does not have suffix %q", b, tc.suffix)
+				}
+			}
+
+			current, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(current) != tc.lastSize {
+				t.Errorf("got current log size %d, want %d", len(current), tc.lastSize)
+			}
+		})
+	}
+}
+
+func TestLogFileRotateFails(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	l, err := OpenLogFile(name, RotateConfig{MaxSize: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := l.Write([]byte("123456789\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With the file gone from under it, the backup can't be made.
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatalf("write after a failed rotation: %v", err)
+		}
+	}
+
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "unable to rotate log file") {
+		t.Errorf("log does not note the failed rotation, got:\n%s", got)
+	}
+	if !strings.HasSuffix(string(got), "first\nsecond\n") {
+		t.Errorf("writes after a failed rotation are missing, got:\n%s", got)
+	}
+}
+
+func TestSetLogOutput(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	var tests = []struct {
+		name   string
+		file   string
+		stderr bool
+	}{
+		{
+			name:   "Empty path",
+			stderr: true,
+		},
+		{
+			name:   "Unopenable path",
+			file:   filepath.Join(t.TempDir(), "missing", "test.log"),
+			stderr: true,
+		},
+		{
+			name: "Good path",
+			file: filepath.Join(t.TempDir(), "test.log"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := SetLogOutput(tc.file, RotateConfig{})
+			defer c.Close()
+			if got := log.Writer() == os.Stderr; got != tc.stderr {
+				t.Errorf("logging to stderr is %t, want %t", got, tc.stderr)
+			}
+		})
+	}
+}
+
+func TestLogRotateConfig(t *testing.T) {
+	cf, err := ini.Load([]byte("[log]\nmaxsize = 100\nmaxbackups = 5\nmaxage = 30\ncompress = true\n[empty]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := RotateConfig{
+		MaxSize:    100 * 1024 * 1024,
+		MaxBackups: 5,
+		MaxAge:     30 * 24 * time.Hour,
+		Compress:   true,
+	}
+	if got := LogRotateConfig(cf.Section("log")); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := LogRotateConfig(cf.Section("empty")); !reflect.DeepEqual(got, RotateConfig{}) {
+		t.Errorf("got %+v, want rotation disabled when nothing is set", got)
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import "log"
+
+// SubnetBucket is the amount of prefixes in a labelled range of masks.
+type SubnetBucket struct {
+	Label string
+	Count uint32
+}
+
+// SubnetBuckets groups the prefix count of each mask into the buckets shown in the
+// subnet pie charts. v4 and v6 map a mask length to the amount of prefixes with that
+// mask. IPv6 has too many masks to show, so anything not in its own bucket is counted
+// in "The Rest" by taking the other buckets away from v6Total. If the counts are
+// inconsistent, "The Rest" is set to zero rather than going negative.
+func SubnetBuckets(v4, v6 map[int]uint32, v6Total uint32) ([]SubnetBucket, []SubnetBucket) {
+	v4Buckets := []SubnetBucket{
+		{Label: "/19-/21", Count: v4[19] + v4[20] + v4[21]},
+		{Label: "/16-/18", Count: v4[16] + v4[17] + v4[18]},
+		{Label: "/22", Count: v4[22]},
+		{Label: "/23", Count: v4[23]},
+		{Label: "/24", Count: v4[24]},
+	}
+
+	var counted uint32
+	for _, mask := range []int{32, 44, 40, 36, 29, 48} {
+		counted += v6[mask]
+	}
+	var rest uint32
+	if counted > v6Total {
+		log.Printf("IPv6 total of %d is less than the %d prefixes already bucketed, setting The Rest to 0", v6Total, counted)
+	} else {
+		rest = v6Total - counted
+	}
+
+	v6Buckets := []SubnetBucket{
+		{Label: "/32", Count: v6[32]},
+		{Label: "/44", Count: v6[44]},
+		{Label: "/40", Count: v6[40]},
+		{Label: "/36", Count: v6[36]},
+		{Label: "/29", Count: v6[29]},
+		{Label: "The Rest", Count: rest},
+		{Label: "/48", Count: v6[48]},
+	}
+
+	return v4Buckets, v6Buckets
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubnetBuckets(t *testing.T) {
+	var tests = []struct {
+		name    string
+		v4, v6  map[int]uint32
+		v6Total uint32
+		want4   []uint32
+		want6   []uint32
+	}{
+		{
+			name: "Consistent counts",
+			v4: map[int]uint32{
+				16: 1, 17: 2, 18: 3, 19: 4, 20: 5, 21: 6, 22: 7, 23: 8, 24: 9,
+			},
+			v6: map[int]uint32{
+				29: 10, 32: 20, 36: 30, 40: 40, 44: 50, 48: 60, 56: 70,
+			},
+			v6Total: 300,
+			want4:   []uint32{15, 6, 7, 8, 9},
+			want6:   []uint32{20, 50, 40, 30, 10, 90, 60},
+		},
+		{
+			name:    "Total less than the buckets",
+			v6:      map[int]uint32{32: 20, 48: 60},
+			v6Total: 50,
+			want4:   []uint32{0, 0, 0, 0, 0},
+			want6:   []uint32{20, 0, 0, 0, 0, 0, 60},
+		},
+		{
+			name:  "No data",
+			want4: []uint32{0, 0, 0, 0, 0},
+			want6: []uint32{0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v4, v6 := SubnetBuckets(tc.v4, tc.v6, tc.v6Total)
+			if got := bucketCounts(v4); !reflect.DeepEqual(got, tc.want4) {
+				t.Errorf("got IPv4 %v, want %v", got, tc.want4)
+			}
+			if got := bucketCounts(v6); !reflect.DeepEqual(got, tc.want6) {
+				t.Errorf("got IPv6 %v, want %v", got, tc.want6)
+			}
+			if v6[5].Label != "The Rest" {
+				t.Errorf("got label %q, want The Rest", v6[5].Label)
+			}
+		})
+	}
+}
+
+func bucketCounts(buckets []SubnetBucket) []uint32 {
+	counts := make([]uint32, 0, len(buckets))
+	for _, b := range buckets {
+		counts = append(counts, b.Count)
+	}
+	return counts
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+// countrySuffix is a country code the registry left on the end of a name, e.g. "GOOGLE, US".
+var countrySuffix = regexp.MustCompile(`\s*,\s*([A-Za-z]{2})$`)
+
+// normaliseASName tidies an AS name from whois or bgpsql into a consistent form.
+// Whitespace is collapsed, trailing separators removed, and a lone AS handle is upper case.
+// A country code on the end of the name is moved into the locale, unless the locale is
+// already set to another country.
+func normaliseASName(name, locale string) (string, string) {
+	name = strings.Join(strings.Fields(name), " ")
+	locale = strings.ToUpper(strings.TrimSpace(locale))
+
+	if m := countrySuffix.FindStringSubmatch(name); m != nil {
+		country := strings.ToUpper(m[1])
+		if locale == "" || locale == country {
+			name = name[:len(name)-len(m[0])]
+			locale = country
+		}
+	}
+	name = strings.TrimRight(name, ",; ")
+
+	// The handle comes before any description, e.g. "CLOUDFLARENET - Cloudflare, Inc."
+	handle, description := name, ""
+	if i := strings.Index(name, " - "); i >= 0 {
+		handle, description = name[:i], name[i:]
+	}
+	if !strings.Contains(handle, " ") {
+		handle = strings.ToUpper(handle)
+	}
+
+	return handle + description, locale
+}
+
+// normaliseName tidies the name in place if names are to be normalised.
+func (s *server) normaliseName(name *pb.AsnameResponse) {
+	if !s.normaliseNames {
+		return
+	}
+	name.AsName, name.Locale = normaliseASName(name.GetAsName(), name.GetLocale())
+}
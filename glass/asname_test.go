@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+func TestNormaliseASName(t *testing.T) {
+	var tests = []struct {
+		name, locale         string
+		wantName, wantLocale string
+	}{
+		{
+			name:       "GOOGLE, US",
+			wantName:   "GOOGLE",
+			wantLocale: "US",
+		},
+		{
+			name:       "CLOUDFLARENET - Cloudflare, Inc., US",
+			wantName:   "CLOUDFLARENET - Cloudflare, Inc.",
+			wantLocale: "US",
+		},
+		{
+			name:       "  level3   ",
+			locale:     "us",
+			wantName:   "LEVEL3",
+			wantLocale: "US",
+		},
+		{
+			name:       "HURRICANE\t-  Hurricane Electric LLC,US",
+			wantName:   "HURRICANE - Hurricane Electric LLC",
+			wantLocale: "US",
+		},
+		{
+			name:       "DTAG Internet service provider operations, de",
+			locale:     "DE",
+			wantName:   "DTAG Internet service provider operations",
+			wantLocale: "DE",
+		},
+		{
+			name:       "EXAMPLE-AS,",
+			locale:     "GB",
+			wantName:   "EXAMPLE-AS",
+			wantLocale: "GB",
+		},
+		{
+			// A country that disagrees with the locale is left in the name.
+			name:       "AKAMAI-AS, US",
+			locale:     "NL",
+			wantName:   "AKAMAI-AS, US",
+			wantLocale: "NL",
+		},
+		{
+			name:     "Hurricane Electric LLC",
+			wantName: "Hurricane Electric LLC",
+		},
+		{
+			name: "",
+		},
+	}
+	for _, tc := range tests {
+		name, locale := normaliseASName(tc.name, tc.locale)
+		if name != tc.wantName || locale != tc.wantLocale {
+			t.Errorf("normaliseASName(%q, %q) = %q, %q, want %q, %q",
+				tc.name, tc.locale, name, locale, tc.wantName, tc.wantLocale)
+		}
+	}
+}
+
+func TestAsnameNormalise(t *testing.T) {
+	srv := getServer()
+	srv.updateASNFile(map[uint32]pb.AsnameResponse{
+		15169: {AsName: "google, US", Exists: true},
+	})
+
+	// Names are returned as is unless normalising is turned on.
+	resp, err := srv.Asname(context.Background(), &pb.AsnameRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAsName() != "google, US" || resp.GetLocale() != "" {
+		t.Errorf("got %q, %q, want the name untouched", resp.GetAsName(), resp.GetLocale())
+	}
+
+	srv.normaliseNames = true
+	resp, err = srv.Asname(context.Background(), &pb.AsnameRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAsName() != "GOOGLE" || resp.GetLocale() != "US" {
+		t.Errorf("got %q, %q, want GOOGLE, US", resp.GetAsName(), resp.GetLocale())
+	}
+}
@@ -1,64 +1,144 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
-	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	iasn      = 1
-	isourced  = 2
-	iroute    = 3
-	iorigin   = 4
-	iaspath   = 5
-	iroa      = 6
-	ilocation = 7
-	imap      = 8
-	itotal    = 9
-	iinvalids = 10
+	iasn       = 1
+	isourced   = 2
+	iroute     = 3
+	iorigin    = 4
+	iaspath    = 5
+	iroa       = 6
+	ilocation  = 7
+	imap       = 8
+	itotal     = 9
+	iinvalids  = 10
+	icommunity = 11
+	inexthop   = 12
 )
 
 var (
-	maxAge = map[int]time.Duration{
-		iasn:      time.Hour * 6,
-		isourced:  time.Minute * 10,
-		iroute:    time.Minute * 1,
-		iorigin:   time.Minute * 5,
-		iaspath:   time.Minute * 5,
-		iroa:      time.Hour * 1,
-		ilocation: time.Hour * 24 * 14,
-		imap:      time.Hour * 24 * 14,
-		itotal:    time.Minute * 10,
-		iinvalids: time.Hour * 1,
-	}
-	maxCache = map[int]int{
-		iasn:      100,
-		isourced:  100,
-		iroute:    100,
-		iorigin:   100,
-		iaspath:   100,
-		iroa:      100,
-		ilocation: 100,
-		imap:      30,
+	// defaultMaxAge and defaultMaxCache are the max age and max entries of each
+	// cache type, unless set in the [cache] section of the config.
+	defaultMaxAge = map[int]time.Duration{
+		iasn:       time.Hour * 6,
+		isourced:   time.Minute * 10,
+		iroute:     time.Minute * 1,
+		iorigin:    time.Minute * 5,
+		iaspath:    time.Minute * 5,
+		iroa:       time.Hour * 1,
+		ilocation:  time.Hour * 24 * 14,
+		imap:       time.Hour * 24 * 14,
+		itotal:     time.Minute * 10,
+		iinvalids:  time.Hour * 1,
+		icommunity: time.Minute * 5,
+		inexthop:   time.Minute * 1,
+	}
+	// ttlJitter spreads out when entries expire, so entries added together don't
+	// all expire together. 0.1 means each entry can expire up to 10% early or late.
+	ttlJitter = 0.1
+
+	// swrAge is how long past its max age an entry can still be served while it
+	// is refreshed in the background. Off unless configured.
+	swrAge = map[int]time.Duration{}
+
+	defaultMaxCache = map[int]int{
+		iasn:       100,
+		isourced:   100,
+		iroute:     100,
+		iorigin:    100,
+		iaspath:    100,
+		iroa:       100,
+		ilocation:  100,
+		imap:       30,
+		icommunity: 100,
+		inexthop:   100,
 	}
 )
 
+// defaultNegativeAge is how long a lookup that found nothing is cached, unless configured.
+const defaultNegativeAge = 30 * time.Second
+
+// cacheResult is whether a cache check found an entry, and if so whether the
+// entry is a cached miss.
+type cacheResult int
+
+const (
+	notCached cacheResult = iota
+	cachedPositive
+	cachedNegative
+)
+
+// revalidateTimeout limits how long a background refresh can take.
+const revalidateTimeout = 30 * time.Second
+
+// entryTime returns the time to store with a new cache entry. Expiry is checked
+// against this time, so it is moved by a random amount within the jitter.
+func (s *server) entryTime(ttype int) time.Time {
+	if ttlJitter <= 0 {
+		return time.Now()
+	}
+	spread := float64(s.maxAge[ttype]) * ttlJitter
+	jitter := time.Duration((rand.Float64()*2 - 1) * spread)
+	return time.Now().Add(jitter)
+}
+
 type cache struct {
 	totalCache   totalsAge
 	asNameCache  map[uint32]asnAge
 	sourcedCache map[uint32]sourcedAge
-	routeCache   map[string]routeAge
-	originCache  map[string]originAge
-	aspathCache  map[string]aspathAge
-	roaCache     map[string]roaAge
-	locCache     map[string]locAge
-	mapCache     map[string]mapAge
-	invCache     invAge
+	routeCache   *routeTrie
+	// negRouteCache holds when each address with no covering route was
+	// looked up. It's kept apart from the route trie, so a cached miss for
+	// an address can't hide a route covering it that's cached later.
+	negRouteCache map[string]time.Time
+	originCache   map[string]originAge
+	aspathCache   map[string]aspathAge
+	roaCache      map[string]roaAge
+	locCache      map[string]locAge
+	mapCache      map[string]mapAge
+	commCache     map[string]commAge
+	nhCache       map[string]nhAge
+	invCache      invAge
+
+	// fileASNames is loaded from a local file and is never purged.
+	fileASNames map[uint32]pb.AsnameResponse
+	fileMu      *sync.RWMutex
+
+	// revalidating holds the keys of stale entries being refreshed.
+	revalidating map[string]bool
+	revalidateMu *sync.Mutex
+
+	// locks has a lock for each cache type, so one cache being swept or
+	// updated doesn't block reads of the others.
+	locks map[int]*sync.RWMutex
+
+	// maxAge and maxCache are the max age and max entries of each cache type.
+	maxAge   map[int]time.Duration
+	maxCache map[int]int
+	// negativeAge is the max age of a cached miss.
+	negativeAge time.Duration
+
+	// flights collapse concurrent router lookups for each cache type.
+	flights map[int]*flight
+
+	// routeChanged is closed, then replaced, whenever a route is cached.
+	routeChanged chan struct{}
 }
 
 type asnAge struct {
@@ -66,14 +146,18 @@ type asnAge struct {
 	age time.Time
 }
 
+// totalsAge and invAge hold a single entry. set is true once it's been cached,
+// as a genuinely empty response is still worth caching.
 type totalsAge struct {
 	tot pb.TotalResponse
 	age time.Time
+	set bool
 }
 
 type invAge struct {
 	inv pb.InvalidResponse
 	age time.Time
+	set bool
 }
 
 type roaAge struct {
@@ -84,6 +168,7 @@ type roaAge struct {
 type aspathAge struct {
 	path pb.AspathResponse
 	age  time.Time
+	used *int64
 }
 
 type routeAge struct {
@@ -94,6 +179,9 @@ type routeAge struct {
 type originAge struct {
 	origin pb.OriginResponse
 	age    time.Time
+	used   *int64
+	// negative is set when the address has no origin.
+	negative bool
 }
 
 type sourcedAge struct {
@@ -106,107 +194,277 @@ type locAge struct {
 	age time.Time
 }
 
+type commAge struct {
+	comm pb.CommunitiesResponse
+	age  time.Time
+}
+
+type nhAge struct {
+	nh  pb.NextHopResponse
+	age time.Time
+}
+
 type mapAge struct {
 	imap string
 	age  time.Time
 }
 
 func getNewCache() cache {
+	locks := make(map[int]*sync.RWMutex)
+	flights := make(map[int]*flight)
+	ages := make(map[int]time.Duration)
+	for ttype, age := range defaultMaxAge {
+		locks[ttype] = &sync.RWMutex{}
+		flights[ttype] = newFlight()
+		ages[ttype] = age
+	}
+	sizes := make(map[int]int)
+	for ttype, size := range defaultMaxCache {
+		sizes[ttype] = size
+	}
 	return cache{
-		totalCache:   totalsAge{},
-		asNameCache:  make(map[uint32]asnAge),
-		sourcedCache: make(map[uint32]sourcedAge),
-		routeCache:   make(map[string]routeAge),
-		originCache:  make(map[string]originAge),
-		aspathCache:  make(map[string]aspathAge),
-		roaCache:     make(map[string]roaAge),
-		locCache:     make(map[string]locAge),
-		mapCache:     make(map[string]mapAge),
-		invCache:     invAge{},
+		totalCache:    totalsAge{},
+		asNameCache:   make(map[uint32]asnAge),
+		sourcedCache:  make(map[uint32]sourcedAge),
+		routeCache:    newRouteTrie(),
+		negRouteCache: make(map[string]time.Time),
+		originCache:   make(map[string]originAge),
+		aspathCache:   make(map[string]aspathAge),
+		roaCache:      make(map[string]roaAge),
+		locCache:      make(map[string]locAge),
+		mapCache:      make(map[string]mapAge),
+		commCache:     make(map[string]commAge),
+		nhCache:       make(map[string]nhAge),
+		invCache:      invAge{},
+		fileASNames:   make(map[uint32]pb.AsnameResponse),
+		fileMu:        &sync.RWMutex{},
+		revalidating:  make(map[string]bool),
+		revalidateMu:  &sync.Mutex{},
+		locks:         locks,
+		maxAge:        ages,
+		maxCache:      sizes,
+		negativeAge:   defaultNegativeAge,
+		flights:       flights,
+		routeChanged:  make(chan struct{}),
+	}
+}
+
+// remaining returns how long an entry of the cache type has until it reaches its
+// max age, or 0 if it already has.
+func (s *server) remaining(age time.Time, ttype int) time.Duration {
+	if left := s.maxAge[ttype] - time.Since(age); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// negativeRemaining returns how long a cached miss has until it reaches the
+// negative max age, or 0 if it already has.
+func (s *server) negativeRemaining(age time.Time) time.Duration {
+	if left := s.negativeAge - time.Since(age); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// isStale returns true if an entry is past its max age, but still within
+// the stale-while-revalidate window.
+func (s *server) isStale(ttype int, age time.Time) bool {
+	return s.remaining(age, ttype) == 0 && s.remaining(age.Add(swrAge[ttype]), ttype) > 0
+}
+
+// revalidate runs refresh in the background, unless a refresh for the same
+// key is already running.
+func (s *server) revalidate(key string, refresh func(context.Context) error) {
+	s.revalidateMu.Lock()
+	if s.revalidating[key] {
+		s.revalidateMu.Unlock()
+		return
+	}
+	s.revalidating[key] = true
+	s.revalidateMu.Unlock()
+
+	log.Printf("Refreshing stale cache entry for %s", key)
+	go func() {
+		defer func() {
+			s.revalidateMu.Lock()
+			delete(s.revalidating, key)
+			s.revalidateMu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+		defer cancel()
+		if err := refresh(ctx); err != nil {
+			log.Printf("Unable to refresh stale cache entry for %s: %v", key, err)
+		}
+	}()
+}
+
+// newUsed returns the last use of an entry added now. The origin and as-path
+// caches see the most unique keys, so are kept within their max size as entries
+// are added, evicting the least recently used. The last use is held as unix
+// nanoseconds, so a cache hit can update it while only holding the read lock.
+func newUsed() *int64 {
+	used := time.Now().UnixNano()
+	return &used
+}
+
+// touch records that an entry was used now.
+func touch(used *int64) {
+	if used != nil {
+		atomic.StoreInt64(used, time.Now().UnixNano())
 	}
 }
 
+// lastUsed returns when an entry was last used, or its age if never recorded.
+func lastUsed(age time.Time, used *int64) time.Time {
+	if used == nil {
+		return age
+	}
+	return time.Unix(0, atomic.LoadInt64(used))
+}
+
 // checkTotalCache will check the local cache.
 func (s *server) checkTotalCache() (pb.TotalResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[itotal].RLock()
+	defer s.locks[itotal].RUnlock()
 	log.Printf("Check cache for Totals")
 
 	// If cache entry exists, return true only if the cache entry is still valid.
-	if !reflect.DeepEqual(s.totalCache, totalsAge{}) {
+	if s.totalCache.set {
 		log.Printf("Returning cache total if timers is still valid")
-		if time.Since(s.totalCache.age) < maxAge[itotal] {
+		if s.remaining(s.totalCache.age, itotal) > 0 {
+			countCache(itotal, true)
 			return s.totalCache.tot, true
 		}
 	}
 
+	countCache(itotal, false)
 	return pb.TotalResponse{}, false
 }
 
 // updateTotalCache will update the local cache.
 func (s *server) updateTotalCache(t pb.TotalResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[itotal].Lock()
+	defer s.locks[itotal].Unlock()
 
 	log.Printf("Updating cache for Totals")
 
 	s.totalCache = totalsAge{
 		tot: t,
-		age: time.Now(),
+		age: s.entryTime(itotal),
+		set: true,
 	}
 }
 
-// checkOriginCache will return an origin uint32 that matches a previous origin check
-// if it's still within age.
-func (s *server) checkOriginCache(ip string) (pb.OriginResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	log.Printf("Check origin cache for %s", ip)
+// checkOriginCache will return the origin of a route that matches a previous origin check
+// if it's still within age. A cached miss is returned as cachedNegative.
+func (s *server) checkOriginCache(ipnet *net.IPNet) (pb.OriginResponse, cacheResult) {
+	s.locks[iorigin].RLock()
+	defer s.locks[iorigin].RUnlock()
+	log.Printf("Check origin cache for %s", ipnet.String())
 
-	val, ok := s.originCache[ip]
+	val, ok := s.originCache[ipnet.String()]
 
 	// only return cache entry if it's within the max age
 	if ok {
-		log.Printf("cache entry exists for %s", ip)
-		if time.Since(val.age) < maxAge[iorigin] {
-			log.Printf("cache hit for origin entry for %s", ip)
-			return val.origin, ok
+		log.Printf("cache entry exists for %s", ipnet.String())
+		if val.negative && s.negativeRemaining(val.age) > 0 {
+			log.Printf("negative cache hit for origin entry for %s", ipnet.String())
+			countCache(iorigin, true)
+			return pb.OriginResponse{}, cachedNegative
 		}
-		log.Printf("cache miss for origin %s", ip)
+		if !val.negative && s.remaining(val.age, iorigin) > 0 {
+			log.Printf("cache hit for origin entry for %s", ipnet.String())
+			countCache(iorigin, true)
+			touch(val.used)
+			return val.origin, cachedPositive
+		}
+		log.Printf("cache miss for origin %s", ipnet.String())
+	}
+
+	countCache(iorigin, false)
+	return pb.OriginResponse{}, notCached
+}
+
+// checkStaleOriginCache will return an origin entry that is past its max age,
+// but can still be served while it's refreshed.
+func (s *server) checkStaleOriginCache(ipnet *net.IPNet) (pb.OriginResponse, bool) {
+	s.locks[iorigin].RLock()
+	defer s.locks[iorigin].RUnlock()
+
+	val, ok := s.originCache[ipnet.String()]
+	if ok && !val.negative && s.isStale(iorigin, val.age) {
+		log.Printf("stale cache hit for origin entry for %s", ipnet.String())
+		return val.origin, true
 	}
 
 	return pb.OriginResponse{}, false
 }
 
-// TODO: ideally origin cache should contain the entire subnet, not just IP.
-// Will need to re-do how I have this data
-func (s *server) updateOriginCache(ip string, res pb.OriginResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// updateOriginCache caches the origin of a route. Entries are keyed by the route,
+// so every address it covers shares the one entry.
+func (s *server) updateOriginCache(ipnet *net.IPNet, res pb.OriginResponse) {
+	s.locks[iorigin].Lock()
+	defer s.locks[iorigin].Unlock()
 
-	log.Printf("Adding %s to the origin cache", ip)
+	log.Printf("Adding %s to the origin cache", ipnet.String())
 
-	s.originCache[ip] = originAge{
+	s.originCache[ipnet.String()] = originAge{
 		origin: res,
-		age:    time.Now(),
+		age:    s.entryTime(iorigin),
+		used:   newUsed(),
+	}
+
+	s.capOriginCache()
+}
+
+// updateNegativeOriginCache caches that the route has no origin.
+func (s *server) updateNegativeOriginCache(ipnet *net.IPNet) {
+	s.locks[iorigin].Lock()
+	defer s.locks[iorigin].Unlock()
+
+	log.Printf("Adding %s to the origin cache as having no origin", ipnet.String())
+
+	s.originCache[ipnet.String()] = originAge{
+		age:      time.Now(),
+		used:     newUsed(),
+		negative: true,
+	}
+	s.capOriginCache()
+}
+
+// capOriginCache evicts the least recently used origin entries over the max.
+// The caller must hold the origin lock.
+func (s *server) capOriginCache() {
+	if len(s.originCache) <= s.maxCache[iorigin] {
+		return
+	}
+	var entries []cacheEntry
+	for key, val := range s.originCache {
+		entries = append(entries, cacheEntry{key, lastUsed(val.age, val.used)})
+	}
+	for _, key := range oldestEntries(entries, s.maxCache[iorigin]) {
+		delete(s.originCache, key.(string))
 	}
 }
 
 // checkInvalidsCache will check the local cache.
 func (s *server) checkInvalidsCache(asn string) (pb.InvalidResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[iinvalids].RLock()
+	defer s.locks[iinvalids].RUnlock()
 	log.Printf("Check cache for Invalids using ASN #%s", asn)
 
 	// If cache entry exists, return true only if the cache entry is still valid.
-	if time.Since(s.invCache.age) < maxAge[iinvalids] {
+	if s.invCache.set && s.remaining(s.invCache.age, iinvalids) > 0 {
 		// Empty query means all invalids
 		if asn == "0" {
+			countCache(iinvalids, true)
 			return s.invCache.inv, true
 		}
 		// Otherwise only return the specific ASN invalids
 		for _, v := range s.invCache.inv.GetAsn() {
 			if v.GetAsn() == asn {
+				countCache(iinvalids, true)
 				return pb.InvalidResponse{
 					Asn: []*pb.InvalidOriginator{
 						{
@@ -219,22 +477,25 @@ func (s *server) checkInvalidsCache(asn string) (pb.InvalidResponse, bool) {
 		}
 		// If cache is fresh, but missing ASN, then we return an empty response, but the cache
 		// does exist.
+		countCache(iinvalids, true)
 		return pb.InvalidResponse{}, true
 	}
 
+	countCache(iinvalids, false)
 	return pb.InvalidResponse{}, false
 }
 
 // updateInvalidsCache will update the local cache.
 func (s *server) updateInvalidsCache(t pb.InvalidResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[iinvalids].Lock()
+	defer s.locks[iinvalids].Unlock()
 
 	log.Printf("Updating cache for Invalids")
 
 	s.invCache = invAge{
 		inv: t,
-		age: time.Now(),
+		age: s.entryTime(iinvalids),
+		set: true,
 	}
 }
 
@@ -242,8 +503,8 @@ func (s *server) updateInvalidsCache(t pb.InvalidResponse) {
 // both a list of ASNs plus an AS-SET.
 // TODO: ideally origin cache should contain the entire subnet, not just IP.
 func (s *server) checkASPathCache(ip string) (pb.AspathResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[iaspath].RLock()
+	defer s.locks[iaspath].RUnlock()
 	log.Printf("Check as-path cache for %s", ip)
 
 	val, ok := s.aspathCache[ip]
@@ -251,8 +512,10 @@ func (s *server) checkASPathCache(ip string) (pb.AspathResponse, bool) {
 	// only return cache entry if it's within the max age
 	if ok {
 		log.Printf("as-path cache entry exists for %s", ip)
-		if time.Since(val.age) < maxAge[iaspath] {
+		if s.remaining(val.age, iaspath) > 0 {
 			log.Printf("as-path cache hit for %s", ip)
+			countCache(iaspath, true)
+			touch(val.used)
 			return val.path, ok
 		}
 		log.Printf("as-path cache entry too old for %s", ip)
@@ -260,34 +523,122 @@ func (s *server) checkASPathCache(ip string) (pb.AspathResponse, bool) {
 	if !ok {
 		log.Printf("as-path cache entry does not exist for %s", ip)
 	}
+	countCache(iaspath, false)
+	return pb.AspathResponse{}, false
+}
+
+// checkStaleASPathCache will return an as-path entry that is past its max age,
+// but can still be served while it's refreshed.
+func (s *server) checkStaleASPathCache(ip string) (pb.AspathResponse, bool) {
+	s.locks[iaspath].RLock()
+	defer s.locks[iaspath].RUnlock()
+
+	val, ok := s.aspathCache[ip]
+	if ok && s.isStale(iaspath, val.age) {
+		log.Printf("stale as-path cache hit for %s", ip)
+		return val.path, true
+	}
+
 	return pb.AspathResponse{}, false
 }
 
 func (s *server) updateASPathCache(ip net.IP, path pb.AspathResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[iaspath].Lock()
+	defer s.locks[iaspath].Unlock()
 
 	log.Printf("adding %s to the as-path cache", ip.String())
 
 	s.aspathCache[ip.String()] = aspathAge{
 		path: path,
-		age:  time.Now(),
+		age:  s.entryTime(iaspath),
+		used: newUsed(),
+	}
+
+	if len(s.aspathCache) > s.maxCache[iaspath] {
+		var entries []cacheEntry
+		for key, val := range s.aspathCache {
+			entries = append(entries, cacheEntry{key, lastUsed(val.age, val.used)})
+		}
+		for _, key := range oldestEntries(entries, s.maxCache[iaspath]) {
+			delete(s.aspathCache, key.(string))
+		}
+	}
+}
+
+// checkCommunityCache will return the cached communities for a route, if it's
+// still within age.
+func (s *server) checkCommunityCache(ipnet *net.IPNet) (pb.CommunitiesResponse, bool) {
+	s.locks[icommunity].RLock()
+	defer s.locks[icommunity].RUnlock()
+	log.Printf("Check community cache for %s", ipnet.String())
+
+	val, ok := s.commCache[ipnet.String()]
+	if ok && s.remaining(val.age, icommunity) > 0 {
+		log.Printf("community cache hit for %s", ipnet.String())
+		countCache(icommunity, true)
+		return val.comm, true
+	}
+
+	countCache(icommunity, false)
+	return pb.CommunitiesResponse{}, false
+}
+
+func (s *server) updateCommunityCache(ipnet *net.IPNet, comm pb.CommunitiesResponse) {
+	s.locks[icommunity].Lock()
+	defer s.locks[icommunity].Unlock()
+
+	log.Printf("adding %s to the community cache", ipnet.String())
+
+	s.commCache[ipnet.String()] = commAge{
+		comm: comm,
+		age:  s.entryTime(icommunity),
+	}
+}
+
+// checkNextHopCache will return the cached next hop for a route, if it's still
+// within age.
+func (s *server) checkNextHopCache(ipnet *net.IPNet) (pb.NextHopResponse, bool) {
+	s.locks[inexthop].RLock()
+	defer s.locks[inexthop].RUnlock()
+	log.Printf("Check next hop cache for %s", ipnet.String())
+
+	val, ok := s.nhCache[ipnet.String()]
+	if ok && s.remaining(val.age, inexthop) > 0 {
+		log.Printf("next hop cache hit for %s", ipnet.String())
+		countCache(inexthop, true)
+		return val.nh, true
+	}
+
+	countCache(inexthop, false)
+	return pb.NextHopResponse{}, false
+}
+
+func (s *server) updateNextHopCache(ipnet *net.IPNet, nh pb.NextHopResponse) {
+	s.locks[inexthop].Lock()
+	defer s.locks[inexthop].Unlock()
+
+	log.Printf("adding %s to the next hop cache", ipnet.String())
+
+	s.nhCache[ipnet.String()] = nhAge{
+		nh:  nh,
+		age: s.entryTime(inexthop),
 	}
 }
 
 // checkROACache will return any cached ROA entry.
 // TODO: Again, this should be based on subnet...
 func (s *server) checkROACache(ipnet *net.IPNet) (pb.RoaResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[iroa].RLock()
+	defer s.locks[iroa].RUnlock()
 	log.Printf("Check ROA cache for %s", ipnet.String())
 
 	// only return cache if it's within the max age
 	val, ok := s.roaCache[ipnet.String()]
 	if ok {
 		log.Printf("roa cache entry exists for %s", ipnet.String())
-		if time.Since(val.age) < maxAge[iroa] {
+		if s.remaining(val.age, iroa) > 0 {
 			log.Printf("roa cache hit for %s", ipnet.String())
+			countCache(iroa, true)
 			return val.roa, ok
 		}
 		log.Printf("roa cache entry too old for %s", ipnet.String())
@@ -295,61 +646,104 @@ func (s *server) checkROACache(ipnet *net.IPNet) (pb.RoaResponse, bool) {
 	if !ok {
 		log.Printf("roa cache entry does not exist for %s", ipnet.String())
 	}
+	countCache(iroa, false)
 	return pb.RoaResponse{}, false
 }
 
 func (s *server) updateROACache(ipnet *net.IPNet, roa pb.RoaResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[iroa].Lock()
+	defer s.locks[iroa].Unlock()
 
 	log.Printf("adding %v to the as-path cache", ipnet.String())
 
 	s.roaCache[ipnet.String()] = roaAge{
 		roa: roa,
-		age: time.Now(),
+		age: s.entryTime(iroa),
 	}
 }
 
-// checkRouteCache will return an ipnet that matches a previous route check
+// checkRouteCache will return the longest cached route covering the IP
 // if it's still within age.
-func (s *server) checkRouteCache(ip string) (pb.RouteResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// A more specific route not yet cached will be hidden by a cached covering route
+// until the covering route ages out.
+func (s *server) checkRouteCache(ip net.IP) (pb.RouteResponse, cacheResult) {
+	s.locks[iroute].RLock()
+	defer s.locks[iroute].RUnlock()
 	log.Printf("Check route cache for %s", ip)
 
-	val, ok := s.routeCache[ip]
+	val, ok := s.routeCache.lookup(ip)
 
 	// only return cache entry if it's within the max age
 	if ok {
 		log.Printf("cache entry exists for %s", ip)
-		if time.Since(val.age) < maxAge[iroute] {
+		if s.remaining(val.age, iroute) > 0 {
 			log.Printf("cache hit for route entry for %s", ip)
-			return val.rr, ok
+			countCache(iroute, true)
+			return val.rr, cachedPositive
 		}
-		log.Printf("cache miss for route %s", ip)
 	}
-	if !ok {
-		log.Printf("cache miss for route %s", ip)
+
+	// A cached route covering the IP wins over a cached miss.
+	if age, ok := s.negRouteCache[ip.String()]; ok && s.negativeRemaining(age) > 0 {
+		log.Printf("negative cache hit for route entry for %s", ip)
+		countCache(iroute, true)
+		return pb.RouteResponse{}, cachedNegative
+	}
+
+	log.Printf("cache miss for route %s", ip)
+	countCache(iroute, false)
+	return pb.RouteResponse{}, notCached
+}
+
+// checkStaleRouteCache will return the longest cached route covering the IP
+// if it's past its max age, but can still be served while it's refreshed.
+func (s *server) checkStaleRouteCache(ip net.IP) (pb.RouteResponse, bool) {
+	s.locks[iroute].RLock()
+	defer s.locks[iroute].RUnlock()
+
+	val, ok := s.routeCache.lookup(ip)
+	if ok && s.isStale(iroute, val.age) {
+		log.Printf("stale cache hit for route entry for %s", ip)
+		return val.rr, true
 	}
 
 	return pb.RouteResponse{}, false
 }
 
-func (s *server) updateRouteCache(ip string, rr pb.RouteResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *server) updateRouteCache(ipnet *net.IPNet, rr pb.RouteResponse) {
+	s.locks[iroute].Lock()
+	defer s.locks[iroute].Unlock()
 
-	log.Printf("Adding %s to the route cache", ip)
+	log.Printf("Adding %s to the route cache", ipnet)
 
-	s.routeCache[ip] = routeAge{
+	s.routeCache.insert(ipnet, routeAge{
 		rr:  rr,
-		age: time.Now(),
-	}
+		age: s.entryTime(iroute),
+	})
+	close(s.routeChanged)
+	s.routeChanged = make(chan struct{})
+}
+
+// updateNegativeRouteCache caches that no route covers the IP.
+func (s *server) updateNegativeRouteCache(ip net.IP) {
+	s.locks[iroute].Lock()
+	defer s.locks[iroute].Unlock()
+
+	log.Printf("Adding %s to the route cache as having no route", ip)
+
+	s.negRouteCache[ip.String()] = time.Now()
+}
+
+// routeUpdates returns a channel that is closed the next time a route is cached.
+func (s *server) routeUpdates() <-chan struct{} {
+	s.locks[iroute].RLock()
+	defer s.locks[iroute].RUnlock()
+	return s.routeChanged
 }
 
 func (s *server) checkLocationCache(airport string) (pb.LocationResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[ilocation].RLock()
+	defer s.locks[ilocation].RUnlock()
 	log.Printf("Check location cache for %s", airport)
 
 	val, ok := s.locCache[airport]
@@ -357,8 +751,9 @@ func (s *server) checkLocationCache(airport string) (pb.LocationResponse, bool)
 	// only return cache entry if it's within the max age
 	if ok {
 		log.Printf("cache entry exists for %s", airport)
-		if time.Since(val.age) < maxAge[ilocation] {
+		if s.remaining(val.age, ilocation) > 0 {
 			log.Printf("cache hit for route entry for %s", airport)
+			countCache(ilocation, true)
 			return val.loc, ok
 		}
 		log.Printf("cache miss for location %s", airport)
@@ -367,34 +762,42 @@ func (s *server) checkLocationCache(airport string) (pb.LocationResponse, bool)
 		log.Printf("cache miss for location %s", airport)
 	}
 
+	countCache(ilocation, false)
 	return pb.LocationResponse{}, false
 }
 
 func (s *server) updateLocationCache(airport string, loc pb.LocationResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[ilocation].Lock()
+	defer s.locks[ilocation].Unlock()
 
 	log.Printf("adding %s to the location cache", airport)
 
 	// TODO: Check if cache is full!
 	s.locCache[airport] = locAge{
 		loc: loc,
-		age: time.Now(),
+		age: s.entryTime(ilocation),
 	}
 }
 
+// mapKey returns the map cache key for a latitude and longitude. The comma
+// keeps pairs like 1.2,34.5 and 1.23,4.5 apart.
+func mapKey(lat, long string) string {
+	return lat + "," + long
+}
+
 func (s *server) checkMapCache(coordinates string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[imap].RLock()
+	defer s.locks[imap].RUnlock()
 	log.Printf("Check map cache for %s", coordinates)
 
-	val, ok := s.mapCache[fmt.Sprintf("%s", coordinates)]
+	val, ok := s.mapCache[coordinates]
 
 	// only return cache entry if it's within the max age
 	if ok {
 		log.Printf("cache entry exists for %s", coordinates)
-		if time.Since(val.age) < maxAge[imap] {
+		if s.remaining(val.age, imap) > 0 {
 			log.Printf("cache hit for route entry for %s", coordinates)
+			countCache(imap, true)
 			return val.imap, ok
 		}
 		log.Printf("cache miss for location %s", coordinates)
@@ -403,26 +806,27 @@ func (s *server) checkMapCache(coordinates string) (string, bool) {
 		log.Printf("cache miss for location %s", coordinates)
 	}
 
+	countCache(imap, false)
 	return "", false
 }
 
-func (s *server) updateMapCache(coordinates string, imap string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *server) updateMapCache(coordinates string, image string) {
+	s.locks[imap].Lock()
+	defer s.locks[imap].Unlock()
 
 	log.Printf("adding %s to the map cache", coordinates)
 
 	s.mapCache[coordinates] = mapAge{
-		imap: imap,
-		age:  time.Now(),
+		imap: image,
+		age:  s.entryTime(imap),
 	}
 }
 
 // checkASNCache will check the local cache.
 // Only returns the cache entry if it's within the age timer.
 func (s *server) checkASNCache(asnum uint32) (pb.AsnameResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[iasn].RLock()
+	defer s.locks[iasn].RUnlock()
 	log.Printf("check ASN cache for AS%d", asnum)
 
 	val, ok := s.asNameCache[asnum]
@@ -430,8 +834,9 @@ func (s *server) checkASNCache(asnum uint32) (pb.AsnameResponse, bool) {
 	// Only return cache value if it's within the max age
 	if ok {
 		log.Printf("cache entry exists for AS%d", asnum)
-		if time.Since(val.age) < maxAge[iasn] {
+		if s.remaining(val.age, iasn) > 0 {
 			log.Printf("cache hit for AS%d", asnum)
+			countCache(iasn, true)
 			return val.asn, ok
 		}
 		log.Printf("cache miss for AS%d", asnum)
@@ -440,23 +845,44 @@ func (s *server) checkASNCache(asnum uint32) (pb.AsnameResponse, bool) {
 		log.Printf("cache miss for AS%d", asnum)
 	}
 
+	countCache(iasn, false)
 	return pb.AsnameResponse{}, false
 }
 
 func (s *server) updateASNCache(asnum uint32, asr pb.AsnameResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[iasn].Lock()
+	defer s.locks[iasn].Unlock()
 
 	log.Printf("Adding AS%d: %q to the cache", asnum, asr.GetAsName())
 	s.asNameCache[asnum] = asnAge{
 		asn: asr,
-		age: time.Now(),
+		age: s.entryTime(iasn),
 	}
 }
 
+// checkASNFile will check the names loaded from a local file.
+func (s *server) checkASNFile(asnum uint32) (pb.AsnameResponse, bool) {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+
+	val, ok := s.fileASNames[asnum]
+	if ok {
+		log.Printf("Returning AS%d name from local file", asnum)
+	}
+	return val, ok
+}
+
+// updateASNFile replaces all names loaded from a local file.
+func (s *server) updateASNFile(names map[uint32]pb.AsnameResponse) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	log.Printf("Loaded %d AS names from local file", len(names))
+	s.fileASNames = names
+}
+
 func (s *server) checkSourcedCache(asn uint32) (pb.SourceResponse, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.locks[isourced].RLock()
+	defer s.locks[isourced].RUnlock()
 
 	log.Printf("Check cache for IPs sourced from %d", asn)
 
@@ -464,8 +890,9 @@ func (s *server) checkSourcedCache(asn uint32) (pb.SourceResponse, bool) {
 
 	if ok {
 		log.Printf("Cache entry exists for AS%d", asn)
-		if time.Since(val.age) < maxAge[isourced] {
+		if s.remaining(val.age, isourced) > 0 {
 			log.Printf("Cache hit for AS%d", asn)
+			countCache(isourced, true)
 			return val.sr, ok
 		}
 		log.Printf("Cache miss for AS%d", asn)
@@ -475,139 +902,650 @@ func (s *server) checkSourcedCache(asn uint32) (pb.SourceResponse, bool) {
 		log.Printf("Cache miss for AS%d", asn)
 	}
 
+	countCache(isourced, false)
 	return pb.SourceResponse{}, false
 }
 
 func (s *server) updateSourcedCache(asn uint32, sr pb.SourceResponse) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.locks[isourced].Lock()
+	defer s.locks[isourced].Unlock()
 
 	log.Printf("Updating cache for IPs sourced from %d", asn)
 
 	s.sourcedCache[asn] = sourcedAge{
 		sr:  sr,
-		age: time.Now(),
+		age: s.entryTime(isourced),
 	}
 }
 
-func (s *server) clearCache(sleep time.Duration, age map[int]time.Duration, count map[int]int) {
+func (s *server) clearCache(ctx context.Context, sleep time.Duration, age map[int]time.Duration, count map[int]int) {
+	t := time.NewTicker(sleep)
+	defer t.Stop()
 	for {
-		time.Sleep(sleep)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
 		log.Println("***")
 		log.Printf("Clearing old cache entries")
-		s.mu.Lock()
 
-		// ASN cache
+		// Each cache is swept under its own lock, so the others can be used meanwhile.
+		for _, ttype := range []int{iasn, isourced, iroute, iorigin, iaspath, iroa, ilocation, imap, itotal, iinvalids, icommunity, inexthop} {
+			s.sweepCache(ttype, age[ttype]+swrAge[ttype], count[ttype])
+		}
+
+		log.Printf("cache cleared")
+		log.Println("***")
+	}
+}
+
+// sweepCache removes entries older than age from a cache. If the cache is still
+// over count, the oldest entries are removed until it's back within count. For
+// the origin and as-path caches, the oldest are those least recently used.
+func (s *server) sweepCache(ttype int, age time.Duration, count int) {
+	s.locks[ttype].Lock()
+	defer s.locks[ttype].Unlock()
+
+	cutoff := time.Now().Add(-age)
+	var entries []cacheEntry
+	switch ttype {
+	case iasn:
 		log.Printf("asn cache is currently length %d", len(s.asNameCache))
 		for key, val := range s.asNameCache {
-			if time.Since(val.age) > age[iasn] {
+			if val.age.Before(cutoff) {
 				delete(s.asNameCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, val.age})
 		}
-		if len(s.asNameCache) > count[iasn] {
-			log.Printf("AS name cache full, purging...")
-			s.asNameCache = make(map[uint32]asnAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.asNameCache, key.(uint32))
 		}
 		log.Printf("asn cache is now length %d", len(s.asNameCache))
 
-		// sourced cache
+	case isourced:
 		log.Printf("sourced cache is currently length %d", len(s.sourcedCache))
 		for key, val := range s.sourcedCache {
-			if time.Since(val.age) > age[isourced] {
+			if val.age.Before(cutoff) {
 				delete(s.sourcedCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, val.age})
 		}
-		if len(s.sourcedCache) > count[isourced] {
-			log.Printf("sourced cache full, purging...")
-			s.sourcedCache = make(map[uint32]sourcedAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.sourcedCache, key.(uint32))
 		}
 		log.Printf("sourced cache is now length %d", len(s.sourcedCache))
 
-		// route cache
-		log.Printf("route cache is currently length %d", len(s.routeCache))
-		for key, val := range s.routeCache {
-			if time.Since(val.age) > age[iroute] {
-				delete(s.routeCache, key)
+	case iroute:
+		log.Printf("route cache is currently length %d", s.routeCache.len())
+		s.routeCache.purgeBefore(cutoff)
+		s.routeCache.evict(count)
+		log.Printf("route cache is now length %d", s.routeCache.len())
+
+		negCutoff := time.Now().Add(-s.negativeAge)
+		for key, age := range s.negRouteCache {
+			if age.Before(negCutoff) {
+				delete(s.negRouteCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, age})
 		}
-		if len(s.routeCache) > count[iroute] {
-			log.Printf("route cache full, purging...")
-			s.routeCache = make(map[string]routeAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.negRouteCache, key.(string))
 		}
-		log.Printf("route cache is now length %d", len(s.routeCache))
 
-		// origin cache
+	case iorigin:
 		log.Printf("origin cache is currently length %d", len(s.originCache))
+		negCutoff := time.Now().Add(-s.negativeAge)
 		for key, val := range s.originCache {
-			if time.Since(val.age) > age[iorigin] {
+			if val.age.Before(cutoff) || (val.negative && val.age.Before(negCutoff)) {
 				delete(s.originCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, lastUsed(val.age, val.used)})
 		}
-		if len(s.originCache) > count[iorigin] {
-			log.Printf("origin cache full, purging...")
-			s.originCache = make(map[string]originAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.originCache, key.(string))
 		}
 		log.Printf("origin cache is now length %d", len(s.originCache))
 
-		// as-path cache
+	case iaspath:
 		log.Printf("as-path cache is currently length %d", len(s.aspathCache))
 		for key, val := range s.aspathCache {
-			if time.Since(val.age) > age[iaspath] {
+			if val.age.Before(cutoff) {
 				delete(s.aspathCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, lastUsed(val.age, val.used)})
 		}
-		if len(s.aspathCache) > count[iaspath] {
-			log.Printf("as-path cache full, purging...")
-			s.aspathCache = make(map[string]aspathAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.aspathCache, key.(string))
 		}
 		log.Printf("as-path cache is now length %d", len(s.aspathCache))
 
-		// roa cache
+	case iroa:
 		log.Printf("roa cache is currently length %d", len(s.roaCache))
 		for key, val := range s.roaCache {
-			if time.Since(val.age) > age[iroa] {
+			if val.age.Before(cutoff) {
 				delete(s.roaCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, val.age})
 		}
-		if len(s.roaCache) > count[iroa] {
-			log.Printf("roa cache full, purging...")
-			s.roaCache = make(map[string]roaAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.roaCache, key.(string))
 		}
 		log.Printf("roa cache is now length %d", len(s.roaCache))
 
-		// location cache
+	case ilocation:
 		log.Printf("location cache is currently length %d", len(s.locCache))
 		for key, val := range s.locCache {
-			if time.Since(val.age) > age[ilocation] {
+			if val.age.Before(cutoff) {
 				delete(s.locCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, val.age})
 		}
-		if len(s.locCache) > count[ilocation] {
-			log.Printf("location cache full, puring...")
-			s.locCache = make(map[string]locAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.locCache, key.(string))
 		}
 		log.Printf("location cache is now length %d", len(s.locCache))
 
-		// map cache
+	case imap:
 		log.Printf("map cache is currently length %d", len(s.mapCache))
 		for key, val := range s.mapCache {
-			if time.Since(val.age) > age[imap] {
+			if val.age.Before(cutoff) {
 				delete(s.mapCache, key)
+				continue
 			}
+			entries = append(entries, cacheEntry{key, val.age})
 		}
-		if len(s.mapCache) > count[imap] {
-			log.Printf("map cache full, puring...")
-			s.mapCache = make(map[string]mapAge)
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.mapCache, key.(string))
 		}
 		log.Printf("map cache is now length %d", len(s.mapCache))
 
-		// invalids cache
-		if time.Since(s.invCache.age) > age[iinvalids] {
+	case icommunity:
+		log.Printf("community cache is currently length %d", len(s.commCache))
+		for key, val := range s.commCache {
+			if val.age.Before(cutoff) {
+				delete(s.commCache, key)
+				continue
+			}
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.commCache, key.(string))
+		}
+		log.Printf("community cache is now length %d", len(s.commCache))
+
+	case inexthop:
+		log.Printf("next hop cache is currently length %d", len(s.nhCache))
+		for key, val := range s.nhCache {
+			if val.age.Before(cutoff) {
+				delete(s.nhCache, key)
+				continue
+			}
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+		for _, key := range oldestEntries(entries, count) {
+			delete(s.nhCache, key.(string))
+		}
+		log.Printf("next hop cache is now length %d", len(s.nhCache))
+
+	case itotal:
+		if s.totalCache.set && s.totalCache.age.Before(cutoff) {
+			log.Printf("total cache has expired")
+			s.totalCache = totalsAge{}
+		}
+
+	case iinvalids:
+		if s.invCache.set && s.invCache.age.Before(cutoff) {
+			log.Printf("invalids cache has expired")
 			s.invCache = invAge{}
 		}
+	}
+}
 
-		s.mu.Unlock()
-		log.Printf("cache cleared")
-		log.Println("***")
+// Limits on the entries returned by each CacheInspect page.
+const (
+	defaultInspectPage = 100
+	maxInspectPage     = 1000
+)
+
+// CacheInspect lists the keys and ages of the entries in a cache, sorted by key
+// and a page at a time. It's for debugging, so is only enabled by config.
+func (s *server) CacheInspect(ctx context.Context, r *pb.CacheInspectRequest) (*pb.CacheInspectResponse, error) {
+	log.Printf("Running CacheInspect")
+
+	if !s.inspectCache {
+		return &pb.CacheInspectResponse{}, status.Error(codes.PermissionDenied, "cache inspection is not enabled")
+	}
+
+	ttype := -1
+	for t, name := range cacheNames {
+		if name == r.GetCacheType() {
+			ttype = t
+		}
+	}
+	if ttype < 0 {
+		return &pb.CacheInspectResponse{}, status.Errorf(codes.InvalidArgument, "unknown cache type: %q", r.GetCacheType())
+	}
+
+	size := int(r.GetPageSize())
+	if size == 0 {
+		size = defaultInspectPage
+	}
+	if size > maxInspectPage {
+		size = maxInspectPage
+	}
+
+	entries := s.cacheKeys(ttype)
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key.(string) > r.GetPageToken()
+	})
+	end := start + size
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	resp := &pb.CacheInspectResponse{Total: uint32(len(entries))}
+	for _, e := range entries[start:end] {
+		var age uint64
+		if since := time.Since(e.age); since > 0 {
+			age = uint64(since.Seconds())
+		}
+		resp.Entries = append(resp.Entries, &pb.CacheInspectEntry{
+			Key:       e.key.(string),
+			Age:       age,
+			Remaining: uint64(s.remaining(e.age, ttype).Seconds()),
+		})
+	}
+	if end < len(entries) {
+		resp.NextPageToken = entries[end-1].key.(string)
 	}
+
+	return resp, nil
+}
+
+// FlushCache removes an entry, or every entry, from a cache or from all caches.
+// It lets operators drop stale data, e.g. after ROAs change, without a restart.
+func (s *server) FlushCache(ctx context.Context, r *pb.FlushCacheRequest) (*pb.FlushCacheResponse, error) {
+	log.Printf("Running FlushCache")
+
+	if !s.flushCache {
+		return &pb.FlushCacheResponse{}, status.Error(codes.PermissionDenied, "cache flushing is not enabled")
+	}
+
+	ttype := int(r.GetCache())
+	if ttype == 0 {
+		if r.GetKey() != "" {
+			return &pb.FlushCacheResponse{}, status.Error(codes.InvalidArgument, "a key can only be flushed from a single cache")
+		}
+		var flushed int
+		for t := range cacheNames {
+			flushed += s.flushEntries(t, "")
+		}
+		return &pb.FlushCacheResponse{Flushed: uint32(flushed)}, nil
+	}
+	if _, ok := cacheNames[ttype]; !ok {
+		return &pb.FlushCacheResponse{}, status.Errorf(codes.InvalidArgument, "unknown cache: %d", ttype)
+	}
+
+	return &pb.FlushCacheResponse{Flushed: uint32(s.flushEntries(ttype, r.GetKey()))}, nil
+}
+
+// flushEntries removes the entry with the key from a cache, or every entry if
+// the key is empty. Keys are as listed by cacheKeys. It returns the number of
+// entries removed.
+func (s *server) flushEntries(ttype int, key string) int {
+	s.locks[ttype].Lock()
+	defer s.locks[ttype].Unlock()
+
+	// IP addresses are cached by their canonical form.
+	if ip := net.ParseIP(key); ip != nil {
+		key = ip.String()
+	}
+	// The AS name and sourced caches are keyed by AS number.
+	asn, err := strconv.ParseUint(key, 10, 32)
+	if err != nil && (ttype == iasn || ttype == isourced) && key != "" {
+		return 0
+	}
+
+	var flushed int
+	switch ttype {
+	case iasn:
+		if key == "" {
+			flushed = len(s.asNameCache)
+			s.asNameCache = make(map[uint32]asnAge)
+		} else if _, ok := s.asNameCache[uint32(asn)]; ok {
+			delete(s.asNameCache, uint32(asn))
+			flushed = 1
+		}
+	case isourced:
+		if key == "" {
+			flushed = len(s.sourcedCache)
+			s.sourcedCache = make(map[uint32]sourcedAge)
+		} else if _, ok := s.sourcedCache[uint32(asn)]; ok {
+			delete(s.sourcedCache, uint32(asn))
+			flushed = 1
+		}
+	case iroute:
+		if key == "" {
+			flushed = s.routeCache.len() + len(s.negRouteCache)
+			s.routeCache = newRouteTrie()
+			s.negRouteCache = make(map[string]time.Time)
+			break
+		}
+		if _, ok := s.negRouteCache[key]; ok {
+			delete(s.negRouteCache, key)
+			flushed++
+		}
+		if _, ipnet, err := net.ParseCIDR(key); err == nil && s.routeCache.remove(ipnet) {
+			flushed++
+		}
+	case iorigin:
+		if key == "" {
+			flushed = len(s.originCache)
+			s.originCache = make(map[string]originAge)
+		} else if _, ok := s.originCache[key]; ok {
+			delete(s.originCache, key)
+			flushed = 1
+		}
+	case iaspath:
+		if key == "" {
+			flushed = len(s.aspathCache)
+			s.aspathCache = make(map[string]aspathAge)
+		} else if _, ok := s.aspathCache[key]; ok {
+			delete(s.aspathCache, key)
+			flushed = 1
+		}
+	case iroa:
+		if key == "" {
+			flushed = len(s.roaCache)
+			s.roaCache = make(map[string]roaAge)
+		} else if _, ok := s.roaCache[key]; ok {
+			delete(s.roaCache, key)
+			flushed = 1
+		}
+	case ilocation:
+		if key == "" {
+			flushed = len(s.locCache)
+			s.locCache = make(map[string]locAge)
+		} else if _, ok := s.locCache[key]; ok {
+			delete(s.locCache, key)
+			flushed = 1
+		}
+	case imap:
+		if key == "" {
+			flushed = len(s.mapCache)
+			s.mapCache = make(map[string]mapAge)
+		} else if _, ok := s.mapCache[key]; ok {
+			delete(s.mapCache, key)
+			flushed = 1
+		}
+	case icommunity:
+		if key == "" {
+			flushed = len(s.commCache)
+			s.commCache = make(map[string]commAge)
+		} else if _, ok := s.commCache[key]; ok {
+			delete(s.commCache, key)
+			flushed = 1
+		}
+	case inexthop:
+		if key == "" {
+			flushed = len(s.nhCache)
+			s.nhCache = make(map[string]nhAge)
+		} else if _, ok := s.nhCache[key]; ok {
+			delete(s.nhCache, key)
+			flushed = 1
+		}
+	case itotal:
+		if s.totalCache.set && (key == "" || key == cacheNames[itotal]) {
+			s.totalCache = totalsAge{}
+			flushed = 1
+		}
+	case iinvalids:
+		if s.invCache.set && (key == "" || key == cacheNames[iinvalids]) {
+			s.invCache = invAge{}
+			flushed = 1
+		}
+	}
+
+	log.Printf("Flushed %d entries from the %s cache", flushed, cacheNames[ttype])
+	return flushed
+}
+
+// cacheKeys returns every entry in a cache, keyed by a string and sorted by key.
+func (s *server) cacheKeys(ttype int) []cacheEntry {
+	s.locks[ttype].RLock()
+	defer s.locks[ttype].RUnlock()
+
+	var entries []cacheEntry
+	switch ttype {
+	case iasn:
+		for key, val := range s.asNameCache {
+			entries = append(entries, cacheEntry{fmt.Sprint(key), val.age})
+		}
+	case isourced:
+		for key, val := range s.sourcedCache {
+			entries = append(entries, cacheEntry{fmt.Sprint(key), val.age})
+		}
+	case iroute:
+		walk := func(r *routeAge) {
+			prefix := r.rr.GetIpAddress()
+			entries = append(entries, cacheEntry{fmt.Sprintf("%s/%d", prefix.GetAddress(), prefix.GetMask()), r.age})
+		}
+		s.routeCache.v4.walk(walk)
+		s.routeCache.v6.walk(walk)
+	case iorigin:
+		for key, val := range s.originCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case iaspath:
+		for key, val := range s.aspathCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case iroa:
+		for key, val := range s.roaCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case ilocation:
+		for key, val := range s.locCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case imap:
+		for key, val := range s.mapCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case icommunity:
+		for key, val := range s.commCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case inexthop:
+		for key, val := range s.nhCache {
+			entries = append(entries, cacheEntry{key, val.age})
+		}
+	case itotal:
+		if s.totalCache.set {
+			entries = append(entries, cacheEntry{cacheNames[itotal], s.totalCache.age})
+		}
+	case iinvalids:
+		if s.invCache.set {
+			entries = append(entries, cacheEntry{cacheNames[iinvalids], s.invCache.age})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key.(string) < entries[j].key.(string)
+	})
+	return entries
+}
+
+// cacheEntry is the key and age of an entry in any of the map caches.
+type cacheEntry struct {
+	key interface{}
+	age time.Time
+}
+
+// oldestEntries returns the keys of the oldest entries over count.
+func oldestEntries(entries []cacheEntry, count int) []interface{} {
+	if count < 0 {
+		count = 0
+	}
+	if len(entries) <= count {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].age.Before(entries[j].age)
+	})
+	keys := make([]interface{}, 0, len(entries)-count)
+	for _, e := range entries[:len(entries)-count] {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// routeTrie is a binary trie of cached routes, allowing a longest prefix match
+// so any IP inside an already cached route is a cache hit.
+type routeTrie struct {
+	v4, v6 *trieNode
+	count  int
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	entry *routeAge
+}
+
+func newRouteTrie() *routeTrie {
+	return &routeTrie{
+		v4: &trieNode{},
+		v6: &trieNode{},
+	}
+}
+
+// root returns the trie root and the address bytes for the IP's family.
+func (t *routeTrie) root(ip net.IP) (*trieNode, net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		return t.v4, v4
+	}
+	return t.v6, ip.To16()
+}
+
+// bit returns the value of the nth most significant bit of the address.
+func bit(ip net.IP, n int) int {
+	return int(ip[n/8]>>(7-uint(n%8))) & 1
+}
+
+func (t *routeTrie) insert(ipnet *net.IPNet, r routeAge) {
+	node, ip := t.root(ipnet.IP)
+	mask, _ := ipnet.Mask.Size()
+	for i := 0; i < mask; i++ {
+		b := bit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+	if node.entry == nil {
+		t.count++
+	}
+	node.entry = &r
+}
+
+// lookup returns the most specific cached route covering the IP.
+func (t *routeTrie) lookup(ip net.IP) (routeAge, bool) {
+	node, ip := t.root(ip)
+	var found *routeAge
+	for i := 0; node != nil; i++ {
+		if node.entry != nil {
+			found = node.entry
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.child[bit(ip, i)]
+	}
+	if found == nil {
+		return routeAge{}, false
+	}
+	return *found, true
+}
+
+// purgeBefore removes all entries with an age before the cutoff.
+func (t *routeTrie) purgeBefore(cutoff time.Time) {
+	t.count = 0
+	t.purgeNode(t.v4, cutoff)
+	t.purgeNode(t.v6, cutoff)
+}
+
+// purgeNode removes old entries below the node, returning true if the node is now empty.
+func (t *routeTrie) purgeNode(node *trieNode, cutoff time.Time) bool {
+	if node == nil {
+		return true
+	}
+	for i, child := range node.child {
+		if t.purgeNode(child, cutoff) {
+			node.child[i] = nil
+		}
+	}
+	if node.entry != nil && node.entry.age.Before(cutoff) {
+		node.entry = nil
+	}
+	if node.entry != nil {
+		t.count++
+	}
+	return node.entry == nil && node.child[0] == nil && node.child[1] == nil
+}
+
+// remove removes the entry for exactly the prefix, returning true if there was one.
+func (t *routeTrie) remove(ipnet *net.IPNet) bool {
+	node, ip := t.root(ipnet.IP)
+	mask, _ := ipnet.Mask.Size()
+	for i := 0; i < mask && node != nil; i++ {
+		node = node.child[bit(ip, i)]
+	}
+	if node == nil || node.entry == nil {
+		return false
+	}
+	node.entry = nil
+	t.count--
+	return true
+}
+
+// evict removes the oldest entries until there are no more than count left.
+// Entries with the same age as the last one removed are also removed.
+func (t *routeTrie) evict(count int) {
+	if count < 0 {
+		count = 0
+	}
+	if t.count <= count {
+		return
+	}
+	var ages []time.Time
+	t.v4.walk(func(r *routeAge) { ages = append(ages, r.age) })
+	t.v6.walk(func(r *routeAge) { ages = append(ages, r.age) })
+	sort.Slice(ages, func(i, j int) bool {
+		return ages[i].Before(ages[j])
+	})
+	t.purgeBefore(ages[len(ages)-count-1].Add(time.Nanosecond))
+}
+
+// walk calls f for every entry below the node.
+func (n *trieNode) walk(f func(*routeAge)) {
+	if n == nil {
+		return
+	}
+	if n.entry != nil {
+		f(n.entry)
+	}
+	n.child[0].walk(f)
+	n.child[1].walk(f)
+}
+
+func (t *routeTrie) len() int {
+	return t.count
 }
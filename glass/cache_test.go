@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/ini.v1"
 )
 
 func getServer() server {
@@ -167,6 +176,50 @@ func BenchmarkUpdateInvalidsCache(b *testing.B) {
 	}
 }
 
+// BenchmarkConcurrentLookups checks and updates the origin and route caches
+// from many goroutines, with a lock per cache and with every cache sharing one.
+func BenchmarkConcurrentLookups(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	run := func(b *testing.B, srv server) {
+		_, ipnet, _ := net.ParseCIDR("8.8.8.0/24")
+		route := pb.RouteResponse{IpAddress: &pb.IpAddress{Address: "8.8.8.0", Mask: 24}, Exists: true}
+		origin := pb.OriginResponse{OriginAsn: 15169, Exists: true}
+		ip := net.ParseIP("8.8.8.8")
+		var n int64
+		b.RunParallel(func(p *testing.PB) {
+			// Half the goroutines use the origin cache and half the route cache,
+			// with one in every ten lookups being an update.
+			useOrigin := atomic.AddInt64(&n, 1)%2 == 0
+			for i := 0; p.Next(); i++ {
+				switch {
+				case useOrigin && i%10 == 0:
+					srv.updateOriginCache(ipnet, origin)
+				case useOrigin:
+					srv.checkOriginCache(ipnet)
+				case i%10 == 0:
+					srv.updateRouteCache(ipnet, route)
+				default:
+					srv.checkRouteCache(ip)
+				}
+			}
+		})
+	}
+
+	b.Run("per-cache", func(b *testing.B) {
+		run(b, getServer())
+	})
+	b.Run("single-lock", func(b *testing.B) {
+		srv := getServer()
+		shared := &sync.RWMutex{}
+		for ttype := range srv.locks {
+			srv.locks[ttype] = shared
+		}
+		run(b, srv)
+	})
+}
+
 func TestInvalidsCache(t *testing.T) {
 	srv := getServer()
 
@@ -254,12 +307,28 @@ func TestTotalCache(t *testing.T) {
 	}
 }
 
+func TestZeroTotalCache(t *testing.T) {
+	srv := getServer()
+
+	// A freshly started server may genuinely have no prefixes.
+	srv.updateTotalCache(pb.TotalResponse{})
+	if _, ok := srv.checkTotalCache(); !ok {
+		t.Error("expected an all-zero total to be cached")
+	}
+
+	srv.updateInvalidsCache(pb.InvalidResponse{})
+	if _, ok := srv.checkInvalidsCache("0"); !ok {
+		t.Error("expected an empty invalids response to be cached")
+	}
+}
+
 func TestOriginCache(t *testing.T) {
 	srv := getServer()
 
 	// check an empty cache
-	cache, ok := srv.checkOriginCache("192.168.0.0")
-	if ok {
+	_, empty, _ := net.ParseCIDR("192.168.0.0/24")
+	cache, res := srv.checkOriginCache(empty)
+	if res != notCached {
 		t.Errorf("expected an empty cache, but got a non empty cache: %#v", cache)
 	}
 
@@ -274,10 +343,10 @@ func TestOriginCache(t *testing.T) {
 				Exists:    true,
 				CacheTime: now,
 			}
-			ip := fmt.Sprintf("192.168.%d.0", i)
-			srv.updateOriginCache(ip, resp)
-			cache, ok := srv.checkOriginCache(ip)
-			if !ok {
+			_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("192.168.%d.0/24", i))
+			srv.updateOriginCache(ipnet, resp)
+			cache, res := srv.checkOriginCache(ipnet)
+			if res != cachedPositive {
 				t.Error("cache entry expected, but none found")
 			}
 			if !reflect.DeepEqual(cache, resp) {
@@ -382,8 +451,8 @@ func TestROACache(t *testing.T) {
 func TestRouteCache(t *testing.T) {
 	srv := getServer()
 	// check an empty cache
-	cache, ok := srv.checkRouteCache("192.168.0.0")
-	if ok {
+	cache, res := srv.checkRouteCache(net.ParseIP("192.168.0.0"))
+	if res != notCached {
 		t.Errorf("expected an empty cache, but got a non empty cache: %#v", cache)
 	}
 
@@ -392,14 +461,15 @@ func TestRouteCache(t *testing.T) {
 		t.Run(fmt.Sprintf("AS%d", i), func(t *testing.T) {
 			now := uint64(time.Now().Unix())
 			ip := fmt.Sprintf("192.168.%d.0", i)
+			_, ipnet, _ := net.ParseCIDR(ip + "/24")
 			resp := pb.RouteResponse{
 				IpAddress: &pb.IpAddress{Address: ip, Mask: 24},
 				Exists:    true,
 				CacheTime: now,
 			}
-			srv.updateRouteCache(ip, resp)
-			cache, ok := srv.checkRouteCache(ip)
-			if !ok {
+			srv.updateRouteCache(ipnet, resp)
+			cache, res := srv.checkRouteCache(net.ParseIP(fmt.Sprintf("192.168.%d.%d", i, i)))
+			if res != cachedPositive {
 				t.Error("cache entry expected, but none found")
 			}
 			if !reflect.DeepEqual(cache, resp) {
@@ -409,6 +479,154 @@ func TestRouteCache(t *testing.T) {
 	}
 }
 
+func TestCacheInspect(t *testing.T) {
+	srv := getServer()
+	for i, prefix := range []string{"8.8.8.0/24", "1.1.1.0/24", "2001:4860::/32"} {
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		mask, _ := ipnet.Mask.Size()
+		srv.routeCache.insert(ipnet, routeAge{
+			rr:  pb.RouteResponse{IpAddress: &pb.IpAddress{Address: ipnet.IP.String(), Mask: uint32(mask)}, Exists: true},
+			age: time.Now().Add(-time.Duration(i+10) * time.Second),
+		})
+	}
+	req := &pb.CacheInspectRequest{CacheType: "route", PageSize: 2}
+
+	if _, err := srv.CacheInspect(context.Background(), req); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, want PermissionDenied unless enabled", err)
+	}
+	srv.inspectCache = true
+
+	var keys []string
+	for page := 0; page < 3; page++ {
+		resp, err := srv.CacheInspect(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetTotal() != 3 {
+			t.Errorf("got a total of %d entries, want 3", resp.GetTotal())
+		}
+		for _, e := range resp.GetEntries() {
+			if e.GetAge() == 0 || e.GetRemaining() == 0 {
+				t.Errorf("%s: got age %d and %d remaining, want both non-zero", e.GetKey(), e.GetAge(), e.GetRemaining())
+			}
+			keys = append(keys, e.GetKey())
+		}
+		if resp.GetNextPageToken() == "" {
+			break
+		}
+		req.PageToken = resp.GetNextPageToken()
+	}
+
+	want := []string{"1.1.1.0/24", "2001:4860::/32", "8.8.8.0/24"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+
+	if _, err := srv.CacheInspect(context.Background(), &pb.CacheInspectRequest{CacheType: "routes"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument for an unknown cache type", err)
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	srv := getServer()
+	ctx := context.Background()
+	_, ipnet, _ := net.ParseCIDR("8.8.8.0/24")
+	_, other, _ := net.ParseCIDR("1.1.1.0/24")
+	srv.updateOriginCache(ipnet, pb.OriginResponse{OriginAsn: 15169, Exists: true})
+	srv.updateOriginCache(other, pb.OriginResponse{OriginAsn: 13335, Exists: true})
+	srv.updateRouteCache(ipnet, pb.RouteResponse{IpAddress: &pb.IpAddress{Address: "8.8.8.0", Mask: 24}, Exists: true})
+
+	req := &pb.FlushCacheRequest{Cache: pb.FlushCacheRequest_ORIGIN, Key: "8.8.8.0/24"}
+	if _, err := srv.FlushCache(ctx, req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied when flushing isn't enabled", err)
+	}
+	srv.flushCache = true
+
+	resp, err := srv.FlushCache(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetFlushed() != 1 {
+		t.Errorf("flushed %d entries, want 1", resp.GetFlushed())
+	}
+	if _, res := srv.checkOriginCache(ipnet); res != notCached {
+		t.Error("expected 8.8.8.0/24 to be flushed from the origin cache")
+	}
+	if _, res := srv.checkOriginCache(other); res != cachedPositive {
+		t.Error("expected 1.1.1.0/24 to still be in the origin cache")
+	}
+
+	// Routes are flushed by the prefix cached.
+	resp, err = srv.FlushCache(ctx, &pb.FlushCacheRequest{Cache: pb.FlushCacheRequest_ROUTE, Key: "8.8.8.0/24"})
+	if err != nil || resp.GetFlushed() != 1 {
+		t.Errorf("got %v, %v, want 1 route flushed", resp, err)
+	}
+	if _, res := srv.checkRouteCache(net.ParseIP("8.8.8.8")); res != notCached {
+		t.Error("expected 8.8.8.0/24 to be flushed from the route cache")
+	}
+
+	// No cache flushes everything.
+	srv.updateTotalCache(pb.TotalResponse{Active_4: 950000})
+	resp, err = srv.FlushCache(ctx, &pb.FlushCacheRequest{})
+	if err != nil || resp.GetFlushed() != 2 {
+		t.Errorf("got %v, %v, want 2 entries flushed from all caches", resp, err)
+	}
+	if _, ok := srv.checkTotalCache(); ok {
+		t.Error("expected the totals to be flushed")
+	}
+
+	if _, err := srv.FlushCache(ctx, &pb.FlushCacheRequest{Key: "8.8.8.8"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument for a key without a cache", err)
+	}
+}
+
+func TestRouteCacheLongestMatch(t *testing.T) {
+	srv := getServer()
+	for _, prefix := range []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"} {
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		mask, _ := ipnet.Mask.Size()
+		srv.updateRouteCache(ipnet, pb.RouteResponse{
+			IpAddress: &pb.IpAddress{Address: ipnet.IP.String(), Mask: uint32(mask)},
+			Exists:    true,
+		})
+	}
+
+	var tests = []struct {
+		ip     string
+		want   string
+		exists bool
+	}{
+		{ip: "10.1.2.3", want: "10.1.0.0", exists: true},
+		{ip: "10.2.2.3", want: "10.0.0.0", exists: true},
+		{ip: "2001:db8:1::1", want: "2001:db8::", exists: true},
+		{ip: "11.0.0.1"},
+		{ip: "2001:db9::1"},
+	}
+	for _, tc := range tests {
+		got, res := srv.checkRouteCache(net.ParseIP(tc.ip))
+		if ok := res == cachedPositive; ok != tc.exists || got.GetIpAddress().GetAddress() != tc.want {
+			t.Errorf("checkRouteCache(%s) = %s, %t. Want %s, %t", tc.ip, got.GetIpAddress().GetAddress(), ok, tc.want, tc.exists)
+		}
+	}
+	if srv.routeCache.len() != 3 {
+		t.Errorf("expected a cache length of 3, but actual length is %d", srv.routeCache.len())
+	}
+
+	// Expired entries are removed and the rest kept.
+	old, _ := srv.routeCache.lookup(net.ParseIP("10.1.2.3"))
+	old.age = time.Now().Add(-time.Hour)
+	_, ipnet, _ := net.ParseCIDR("10.1.0.0/16")
+	srv.routeCache.insert(ipnet, old)
+	srv.routeCache.purgeBefore(time.Now().Add(-time.Minute))
+	if srv.routeCache.len() != 2 {
+		t.Errorf("expected a cache length of 2, but actual length is %d", srv.routeCache.len())
+	}
+	got, _ := srv.checkRouteCache(net.ParseIP("10.1.2.3"))
+	if got.GetIpAddress().GetAddress() != "10.0.0.0" {
+		t.Errorf("expected 10.0.0.0 after purge, got %s", got.GetIpAddress().GetAddress())
+	}
+}
+
 func TestLocationCache(t *testing.T) {
 	srv := getServer()
 	// check an empty cache
@@ -471,6 +689,23 @@ func TestMapCache(t *testing.T) {
 	}
 }
 
+func TestMapKey(t *testing.T) {
+	srv := getServer()
+	first, second := mapKey("1.2", "34.5"), mapKey("1.23", "4.5")
+	if first == second {
+		t.Fatalf("got the same key %q for 1.2,34.5 and 1.23,4.5", first)
+	}
+
+	srv.updateMapCache(first, "first")
+	srv.updateMapCache(second, "second")
+	if got, ok := srv.checkMapCache(first); !ok || got != "first" {
+		t.Errorf("got %q, %t for 1.2,34.5, want its own map", got, ok)
+	}
+	if got, ok := srv.checkMapCache(second); !ok || got != "second" {
+		t.Errorf("got %q, %t for 1.23,4.5, want its own map", got, ok)
+	}
+}
+
 func TestASNCache(t *testing.T) {
 	srv := getServer()
 	// check an empty cache
@@ -553,6 +788,10 @@ func TestSourcedCache(t *testing.T) {
 func TestClearCache(t *testing.T) {
 	srv := getServer()
 
+	// Jitter is relative to maxAge, not the shortened ages below, so turn it off.
+	defer func(j float64) { ttlJitter = j }(ttlJitter)
+	ttlJitter = 0
+
 	// Much shortened for testing
 	tAge := map[int]time.Duration{
 		iasn:      time.Millisecond * 500,
@@ -582,7 +821,9 @@ func TestClearCache(t *testing.T) {
 
 	// clearCache will run every 100 milliseconds
 	sleepTimer := 100 * time.Millisecond
-	go srv.clearCache(sleepTimer, tAge, tCache)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.clearCache(ctx, sleepTimer, tAge, tCache)
 
 	// Cache entry should still be live
 	time.Sleep(time.Millisecond * 200)
@@ -598,3 +839,284 @@ func TestClearCache(t *testing.T) {
 		t.Errorf("expected cache entry to be gone, but was still there")
 	}
 }
+
+func TestClearCacheStops(t *testing.T) {
+	srv := getServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.clearCache(ctx, time.Hour, srv.maxAge, srv.maxCache)
+		close(done)
+	}()
+
+	// The sweep is an hour away, so only the cancel can return it in time.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("clearCache did not return once the context was cancelled")
+	}
+}
+
+func TestCacheJitter(t *testing.T) {
+	defer func(j float64) { ttlJitter = j }(ttlJitter)
+	ttlJitter = 0.1
+
+	srv := getServer()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("10.0.%d.0/24", i))
+		srv.updateOriginCache(ipnet, pb.OriginResponse{OriginAsn: 15169})
+	}
+
+	// Every entry should expire within 10% of the max age, but not all at once.
+	spread := time.Duration(float64(srv.maxAge[iorigin]) * ttlJitter)
+	earliest, latest := now.Add(spread), now.Add(-spread)
+	for ip, val := range srv.originCache {
+		if val.age.Before(now.Add(-spread)) || val.age.After(time.Now().Add(spread)) {
+			t.Errorf("%s has expiry moved by %v, more than the jitter of %v", ip, val.age.Sub(now), spread)
+		}
+		if val.age.Before(earliest) {
+			earliest = val.age
+		}
+		if val.age.After(latest) {
+			latest = val.age
+		}
+	}
+	if latest.Sub(earliest) < spread/2 {
+		t.Errorf("expiry times are only spread over %v, want them staggered across the jitter of %v", latest.Sub(earliest), spread)
+	}
+
+	// No jitter keeps the time the entry was added.
+	ttlJitter = 0
+	before := time.Now()
+	_, ipnet, _ := net.ParseCIDR("192.0.2.0/24")
+	srv.updateOriginCache(ipnet, pb.OriginResponse{OriginAsn: 15169})
+	if age := srv.originCache["192.0.2.0/24"].age; age.Before(before) || age.After(time.Now()) {
+		t.Errorf("without jitter, got entry time %v, want it between %v and now", age, before)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	srv := getServer()
+	var tests = []struct {
+		name  string
+		added time.Duration
+		min   time.Duration
+		max   time.Duration
+	}{
+		{
+			name:  "fresh",
+			added: 0,
+			min:   srv.maxAge[iroute] - time.Second,
+			max:   srv.maxAge[iroute],
+		},
+		{
+			name:  "near expiry",
+			added: srv.maxAge[iroute] - 5*time.Second,
+			min:   4 * time.Second,
+			max:   5 * time.Second,
+		},
+		{
+			name:  "expired",
+			added: srv.maxAge[iroute] + time.Hour,
+			min:   0,
+			max:   0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := srv.remaining(time.Now().Add(-tc.added), iroute)
+			if got < tc.min || got > tc.max {
+				t.Errorf("got %v remaining, want between %v and %v", got, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+func TestCacheConfig(t *testing.T) {
+	cf, err := ini.Load([]byte("[cache]\nroute_age = 30s\norigin_max = 500\nroute_max = -1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := getServer()
+	srv.maxAge, srv.maxCache = cacheConfig(cf.Section("cache"))
+
+	if srv.maxCache[iorigin] != 500 {
+		t.Errorf("got max origin entries %d, want 500", srv.maxCache[iorigin])
+	}
+	if srv.maxAge[iasn] != defaultMaxAge[iasn] || srv.maxCache[iasn] != defaultMaxCache[iasn] {
+		t.Errorf("got asn max age %v and entries %d, want the defaults", srv.maxAge[iasn], srv.maxCache[iasn])
+	}
+	if srv.maxCache[iroute] != defaultMaxCache[iroute] {
+		t.Errorf("got max route entries %d from a negative size, want the default %d", srv.maxCache[iroute], defaultMaxCache[iroute])
+	}
+
+	// A route added 45 seconds ago would be fresh by default, but has now expired.
+	_, ipnet, _ := net.ParseCIDR("8.8.8.0/24")
+	insert := func(added time.Duration) {
+		srv.routeCache.insert(ipnet, routeAge{
+			rr:  pb.RouteResponse{IpAddress: &pb.IpAddress{Address: "8.8.8.0", Mask: 24}, Exists: true},
+			age: time.Now().Add(-added),
+		})
+	}
+	insert(45 * time.Second)
+	if _, res := srv.checkRouteCache(net.ParseIP("8.8.8.8")); res != notCached {
+		t.Error("got a cache hit for a route older than the configured 30s")
+	}
+	insert(15 * time.Second)
+	if _, res := srv.checkRouteCache(net.ParseIP("8.8.8.8")); res != cachedPositive {
+		t.Error("got a cache miss for a route within the configured 30s")
+	}
+}
+
+func TestCacheEvictsLeastUsed(t *testing.T) {
+	srv := getServer()
+	srv.maxCache[iorigin], srv.maxCache[iaspath] = 5, 5
+	past := time.Now().Add(-time.Minute).UnixNano()
+	for i := 0; i < 5; i++ {
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("8.8.%d.0/24", i))
+		srv.updateOriginCache(ipnet, pb.OriginResponse{OriginAsn: 15169})
+		// 8.8.0.0/24 was added first.
+		atomic.StoreInt64(srv.originCache[ipnet.String()].used, past+int64(i))
+	}
+
+	// Using the first entry keeps it, so the next oldest are evicted instead.
+	_, first, _ := net.ParseCIDR("8.8.0.0/24")
+	if _, res := srv.checkOriginCache(first); res != cachedPositive {
+		t.Fatal("expected 8.8.0.0/24 to be cached")
+	}
+	for i := 5; i < 8; i++ {
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("8.8.%d.0/24", i))
+		srv.updateOriginCache(ipnet, pb.OriginResponse{OriginAsn: 15169})
+	}
+
+	var got []string
+	for ip := range srv.originCache {
+		got = append(got, ip)
+	}
+	sort.Strings(got)
+	want := []string{"8.8.0.0/24", "8.8.4.0/24", "8.8.5.0/24", "8.8.6.0/24", "8.8.7.0/24"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got origin entries %v, want %v", got, want)
+	}
+
+	for i := 0; i < 8; i++ {
+		srv.updateASPathCache(net.ParseIP(fmt.Sprintf("8.8.8.%d", i)), pb.AspathResponse{})
+	}
+	if len(srv.aspathCache) != 5 {
+		t.Errorf("got %d as-path entries, want 5", len(srv.aspathCache))
+	}
+}
+
+func TestSweepCacheEvictsOldest(t *testing.T) {
+	srv := getServer()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		// 192.0.2.9 is the newest entry.
+		age := now.Add(-time.Duration(10-i) * time.Second)
+		srv.originCache[fmt.Sprintf("192.0.2.%d", i)] = originAge{age: age}
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("10.%d.0.0/16", i))
+		srv.routeCache.insert(ipnet, routeAge{age: age})
+	}
+	// One entry is also past its max age.
+	srv.originCache["192.0.2.100"] = originAge{age: now.Add(-time.Hour)}
+
+	srv.sweepCache(iorigin, time.Minute, 4)
+	srv.sweepCache(iroute, time.Minute, 4)
+
+	if len(srv.originCache) != 4 {
+		t.Errorf("got %d origin entries, want 4", len(srv.originCache))
+	}
+	if srv.routeCache.len() != 4 {
+		t.Errorf("got %d route entries, want 4", srv.routeCache.len())
+	}
+	for i := 6; i < 10; i++ {
+		if _, ok := srv.originCache[fmt.Sprintf("192.0.2.%d", i)]; !ok {
+			t.Errorf("expected newer entry 192.0.2.%d to be kept", i)
+		}
+		if _, ok := srv.routeCache.lookup(net.IPv4(10, byte(i), 0, 1)); !ok {
+			t.Errorf("expected newer route 10.%d.0.0/16 to be kept", i)
+		}
+	}
+}
+
+func TestSweepCacheNegativeCount(t *testing.T) {
+	srv := getServer()
+	for i := 0; i < 3; i++ {
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("10.%d.0.0/16", i))
+		srv.routeCache.insert(ipnet, routeAge{age: time.Now()})
+		srv.negRouteCache[fmt.Sprintf("192.0.2.%d", i)] = time.Now()
+	}
+
+	// A negative count is treated as no entries, rather than panicking.
+	srv.sweepCache(iroute, time.Minute, -1)
+
+	if srv.routeCache.len() != 0 || len(srv.negRouteCache) != 0 {
+		t.Errorf("got %d route and %d negative entries, want none", srv.routeCache.len(), len(srv.negRouteCache))
+	}
+}
+
+func TestSweepMapCache(t *testing.T) {
+	srv := getServer()
+	max := srv.maxCache[imap]
+	now := time.Now()
+	for i := 0; i < max+10; i++ {
+		key := mapKey(fmt.Sprint(i), "0")
+		srv.updateMapCache(key, "image")
+		// The last added is the newest.
+		srv.mapCache[key] = mapAge{imap: "image", age: now.Add(-time.Duration(max+10-i) * time.Second)}
+	}
+
+	srv.sweepCache(imap, srv.maxAge[imap], max)
+	if len(srv.mapCache) != max {
+		t.Errorf("got %d map entries, want the max of %d", len(srv.mapCache), max)
+	}
+	if _, ok := srv.mapCache[mapKey(fmt.Sprint(max+9), "0")]; !ok {
+		t.Error("expected the newest map entry to be kept")
+	}
+
+	// The single entry caches are dropped once expired.
+	srv.updateTotalCache(pb.TotalResponse{Active_4: 950000})
+	srv.totalCache.age = now.Add(-time.Hour)
+	srv.sweepCache(itotal, time.Minute, 0)
+	if srv.totalCache.set {
+		t.Error("expected the expired totals to be swept")
+	}
+}
+
+func TestSweepCacheLocking(t *testing.T) {
+	srv := getServer()
+	srv.updateASNCache(13335, pb.AsnameResponse{AsName: "CLOUDFLARENET"})
+
+	// Hold the origin lock as if that cache was being swept.
+	srv.locks[iorigin].Lock()
+	swept := make(chan struct{})
+	go func() {
+		srv.sweepCache(iorigin, time.Minute, 100)
+		close(swept)
+	}()
+
+	read := make(chan bool)
+	go func() {
+		_, ok := srv.checkASNCache(13335)
+		read <- ok
+	}()
+	select {
+	case ok := <-read:
+		if !ok {
+			t.Error("expected the AS name to be cached")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reading the asn cache was blocked by the origin cache sweep")
+	}
+
+	select {
+	case <-swept:
+		t.Error("origin cache was swept while its lock was held")
+	default:
+	}
+	srv.locks[iorigin].Unlock()
+	<-swept
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// communityDict maps BGP communities to what they mean. Standard communities are
+// ASN:value and large communities ASN:value:value. Any field can be * to match
+// every value, e.g. 3356:* or 65000:1:*. An exact entry wins over a pattern, and
+// patterns are tried in the order they were loaded.
+type communityDict struct {
+	exact    map[string]string
+	patterns []communityPattern
+}
+
+// communityPattern is a community with at least one * field.
+type communityPattern struct {
+	fields  []string
+	meaning string
+}
+
+// loadCommunities reads a community dictionary file.
+func loadCommunities(file string) (communityDict, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return communityDict{}, fmt.Errorf("unable to open community dictionary: %v", err)
+	}
+	defer f.Close()
+
+	return parseCommunities(f)
+}
+
+// parseCommunities reads a community dictionary, one community and its meaning
+// per line. Blank lines and lines starting with # are ignored.
+// example line - 3356:123 no-export to peers
+func parseCommunities(r io.Reader) (communityDict, error) {
+	dict := communityDict{exact: make(map[string]string)}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, " ", 2)
+		if len(parts) != 2 {
+			return communityDict{}, fmt.Errorf("line %d: no meaning for %q", line, text)
+		}
+		community, meaning := parts[0], strings.TrimSpace(parts[1])
+
+		fields := strings.Split(community, ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return communityDict{}, fmt.Errorf("line %d: %q is not a standard or large community", line, community)
+		}
+		// Standard communities are two 16 bit values, large are three 32 bit values.
+		bits := 16
+		if len(fields) == 3 {
+			bits = 32
+		}
+		wild := false
+		for _, field := range fields {
+			if field == "*" {
+				wild = true
+				continue
+			}
+			if _, err := strconv.ParseUint(field, 10, bits); err != nil {
+				return communityDict{}, fmt.Errorf("line %d: invalid community %q", line, community)
+			}
+		}
+
+		if wild {
+			dict.patterns = append(dict.patterns, communityPattern{fields: fields, meaning: meaning})
+			continue
+		}
+		dict.exact[community] = meaning
+	}
+	if err := scanner.Err(); err != nil {
+		return communityDict{}, fmt.Errorf("unable to read community dictionary: %v", err)
+	}
+
+	return dict, nil
+}
+
+// meaning returns what a community means, if it's in the dictionary.
+func (d communityDict) meaning(community string) (string, bool) {
+	if m, ok := d.exact[community]; ok {
+		return m, true
+	}
+
+	fields := strings.Split(community, ":")
+	for _, p := range d.patterns {
+		if p.matches(fields) {
+			return p.meaning, true
+		}
+	}
+	return "", false
+}
+
+func (p communityPattern) matches(fields []string) bool {
+	if len(fields) != len(p.fields) {
+		return false
+	}
+	for i, field := range p.fields {
+		if field != "*" && field != fields[i] {
+			return false
+		}
+	}
+	return true
+}
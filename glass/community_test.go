@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	cli "github.com/mellowdrifter/bgp_infrastructure/clidecode"
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+func TestCommunityDict(t *testing.T) {
+	dict, err := parseCommunities(strings.NewReader(`
+# Lumen
+3356:123 no-export to peers
+3356:* set by Lumen
+
+65000:1:* learned in Amsterdam
+65000:1:2 learned from a peer in Amsterdam
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := getTestServer(fakeRouter{
+		route: parseCIDRs(t, "8.8.8.0/24")[0],
+		communities: cli.Communities{
+			Standard: []cli.Community{{ASN: 3356, Value: 123}, {ASN: 3356, Value: 666}, {ASN: 2914, Value: 420}},
+			Large: []cli.LargeCommunity{
+				{ASN: 65000, Data1: 1, Data2: 2},
+				{ASN: 65000, Data1: 1, Data2: 3},
+				{ASN: 65000, Data1: 2, Data2: 1},
+				{ASN: 3356, Data1: 1, Data2: 1},
+			},
+		},
+	})
+	srv.communities = dict
+
+	resp, err := srv.Communities(context.Background(), &pb.CommunitiesRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, c := range resp.GetStandard() {
+		got[fmt.Sprintf("%d:%d", c.GetAsn(), c.GetValue())] = c.GetMeaning()
+	}
+	for _, c := range resp.GetLarge() {
+		got[fmt.Sprintf("%d:%d:%d", c.GetAsn(), c.GetData1(), c.GetData2())] = c.GetMeaning()
+	}
+
+	// An exact match is used over a pattern. Unknown communities have no meaning.
+	want := map[string]string{
+		"3356:123":  "no-export to peers",
+		"3356:666":  "set by Lumen",
+		"2914:420":  "",
+		"65000:1:2": "learned from a peer in Amsterdam",
+		"65000:1:3": "learned in Amsterdam",
+		"65000:2:1": "",
+		"3356:1:1":  "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCommunityDictInvalid(t *testing.T) {
+	for _, line := range []string{
+		"3356:123",
+		"3356 no meaning",
+		"3356:65536 too big for a standard community",
+		"65000:1:2:3 too many fields",
+		"3356:abc not a number",
+	} {
+		if _, err := parseCommunities(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+// Limits on how often a failed bgpsql connection is dialled again.
+const (
+	minRedial = time.Second
+	maxRedial = time.Minute
+)
+
+// bgpsqlConn holds the connection to bgpsql. A failed connection is dialled
+// again, backing off between attempts, so a moved or restarted bgpsql doesn't
+// leave every request failing until glass is restarted.
+type bgpsqlConn struct {
+	mu      sync.Mutex
+	target  string
+	creds   credentials.TransportCredentials
+	conn    *grpc.ClientConn
+	backoff time.Duration
+	redial  time.Time
+}
+
+func newBgpsqlConn(target string, creds credentials.TransportCredentials) (*bgpsqlConn, error) {
+	conn, err := dialGRPC(target, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &bgpsqlConn{
+		target:  target,
+		creds:   creds,
+		conn:    conn,
+		backoff: minRedial,
+	}, nil
+}
+
+// get returns the connection, first dialling again if the current one has failed.
+func (b *bgpsqlConn) get() *grpc.ClientConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.conn.GetState() {
+	case connectivity.Ready:
+		b.backoff = minRedial
+		return b.conn
+	case connectivity.TransientFailure, connectivity.Shutdown:
+	default:
+		return b.conn
+	}
+	if time.Now().Before(b.redial) {
+		return b.conn
+	}
+
+	conn, err := dialGRPC(b.target, b.creds)
+	if err != nil {
+		log.Printf("Still unable to reconnect to gRPC server: %v", err)
+	} else {
+		b.conn.Close()
+		b.conn = conn
+	}
+	b.redial = time.Now().Add(b.backoff)
+	if b.backoff *= 2; b.backoff > maxRedial {
+		b.backoff = maxRedial
+	}
+
+	return b.conn
+}
+
+// close closes the current connection.
+func (b *bgpsqlConn) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn.Close()
+}
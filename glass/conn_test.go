@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestBgpsqlRedial(t *testing.T) {
+	// Nothing is listening on the first target.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	bsql, err := newBgpsqlConn(dead.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bsql.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	old := bsql.get()
+	for state := old.GetState(); state != connectivity.TransientFailure; state = old.GetState() {
+		if !old.WaitForStateChange(ctx, state) {
+			t.Fatalf("connection to a dead target is still %v", state)
+		}
+	}
+
+	// bgpsql is now somewhere else.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	defer srv.Stop()
+	bsql.mu.Lock()
+	bsql.target = lis.Addr().String()
+	bsql.mu.Unlock()
+
+	conn := bsql.get()
+	if conn == old {
+		t.Fatal("failed connection was not replaced")
+	}
+	if state := old.GetState(); state != connectivity.Shutdown {
+		t.Errorf("old connection is %v, want it closed", state)
+	}
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("unable to reach the new target: %v", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got status %v, want SERVING", resp.GetStatus())
+	}
+
+	// A healthy connection is kept.
+	if bsql.get() != conn {
+		t.Error("healthy connection was replaced")
+	}
+}
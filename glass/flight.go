@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// lookupTimeout limits how long a shared lookup can take. The lookup doesn't
+// end with the caller that started it, so needs its own limit.
+const lookupTimeout = 30 * time.Second
+
+// flight collapses concurrent calls for the same key into one, so identical
+// requests that miss the cache together only ask the router once. The key must
+// be the same normalised value the cache uses, or equal requests won't collapse.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is a call in progress, or just completed.
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	dups int
+}
+
+func newFlight() *flight {
+	return &flight{calls: make(map[string]*flightCall)}
+}
+
+// do runs fn unless a call for the key is already running, in which case it
+// waits for that call and returns its result. The result is shared by all
+// callers, so must not be modified.
+//
+// fn is given its own context, so a caller going away doesn't fail the lookup
+// for everyone else waiting on it. Each caller stops waiting when its own
+// context is done.
+func (f *flight) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	f.mu.Lock()
+	c, ok := f.calls[key]
+	if ok {
+		c.dups++
+		f.mu.Unlock()
+		log.Printf("Waiting on running lookup for %s", key)
+	} else {
+		c = &flightCall{done: make(chan struct{})}
+		f.calls[key] = c
+		f.mu.Unlock()
+		go f.run(ctx, key, c, fn)
+	}
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run calls fn for the key and hands the result to everyone waiting on it.
+func (f *flight) run(ctx context.Context, key string, c *flightCall, fn func(context.Context) (interface{}, error)) {
+	lctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	// Keep the request id of the caller that started the lookup for logging.
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		lctx = metadata.NewIncomingContext(lctx, md)
+	}
+
+	c.val, c.err = fn(lctx)
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(c.done)
+}
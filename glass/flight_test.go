@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cli "github.com/mellowdrifter/bgp_infrastructure/clidecode"
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+// blockingRouter counts the origin, ROA and sourced lookups, blocking each until released.
+type blockingRouter struct {
+	fakeRouter
+	origins, roas, sourced *int32
+	release                chan struct{}
+}
+
+func (f blockingRouter) GetOriginFromIP(ctx context.Context, ip net.IP) (uint32, bool, error) {
+	atomic.AddInt32(f.origins, 1)
+	<-f.release
+	return f.fakeRouter.GetOriginFromIP(ctx, ip)
+}
+
+func (f blockingRouter) GetROA(ctx context.Context, prefix *net.IPNet, asn uint32) (int, bool, error) {
+	atomic.AddInt32(f.roas, 1)
+	<-f.release
+	return cli.RValid, true, nil
+}
+
+func (f blockingRouter) GetIPv4FromSource(ctx context.Context, asn uint32) ([]*net.IPNet, error) {
+	atomic.AddInt32(f.sourced, 1)
+	<-f.release
+	return f.fakeRouter.GetIPv4FromSource(ctx, asn)
+}
+
+func newBlockingRouter(t *testing.T) blockingRouter {
+	return blockingRouter{
+		fakeRouter: fakeRouter{
+			route:  parseCIDRs(t, "8.8.8.0/24")[0],
+			origin: 15169,
+			v4:     parseCIDRs(t, "8.8.8.0/24"),
+		},
+		origins: new(int32),
+		roas:    new(int32),
+		sourced: new(int32),
+		release: make(chan struct{}),
+	}
+}
+
+// collapse runs each request at once. Once the first has reached the router and
+// the rest are waiting on it, the router is released.
+func collapse(t *testing.T, srv *server, ttype int, key string, router blockingRouter, requests []func() error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(requests))
+	for _, req := range requests {
+		wg.Add(1)
+		go func(req func() error) {
+			defer wg.Done()
+			errs <- req()
+		}(req)
+	}
+
+	waitForDups(t, srv.flights[ttype], key, len(requests)-1)
+	close(router.release)
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// waitForDups waits until a lookup for the key is running, with dups callers waiting on it.
+func waitForDups(t *testing.T, f *flight, key string, dups int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		c, ok := f.calls[key]
+		waiting := ok && c.dups == dups
+		f.mu.Unlock()
+		if waiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("requests did not all wait on one lookup for %s", key)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlightOrigin(t *testing.T) {
+	router := newBlockingRouter(t)
+	srv := getTestServer(router)
+
+	// Addresses within the same route, however they're written, share one lookup.
+	var requests []func() error
+	for _, addr := range []string{"8.8.8.8", "::ffff:8.8.8.8", "8.8.8.9", "::ffff:808:808"} {
+		addr := addr
+		requests = append(requests, func() error {
+			resp, err := srv.Origin(context.Background(), &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: addr}})
+			if err == nil && resp.GetOriginAsn() != 15169 {
+				t.Errorf("%s: got origin %d, want 15169", addr, resp.GetOriginAsn())
+			}
+			return err
+		})
+	}
+	collapse(t, srv, iorigin, "8.8.8.0/24", router, requests)
+
+	if n := atomic.LoadInt32(router.origins); n != 1 {
+		t.Errorf("got %d origin lookups, want 1", n)
+	}
+}
+
+func TestFlightRoa(t *testing.T) {
+	router := newBlockingRouter(t)
+	close(router.release)
+	srv := getTestServer(router)
+	// Cache the origin first, so only the ROA lookups block.
+	if _, err := srv.Origin(context.Background(), &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Origin(context.Background(), &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	router.release = make(chan struct{})
+	srv.router = router
+
+	// Addresses within the same route share one lookup.
+	var requests []func() error
+	for i, addr := range []string{"8.8.8.8", "8.8.8.9", "8.8.8.8"} {
+		addr, explain := addr, i == 0
+		requests = append(requests, func() error {
+			resp, err := srv.Roa(context.Background(), &pb.RoaRequest{IpAddress: &pb.IpAddress{Address: addr}, Explain: explain})
+			if err == nil && resp.GetStatus() != pb.RoaResponse_VALID {
+				t.Errorf("%s: got status %v, want VALID", addr, resp.GetStatus())
+			}
+			return err
+		})
+	}
+	collapse(t, srv, iroa, "8.8.8.0/24", router, requests)
+
+	if n := atomic.LoadInt32(router.roas); n != 1 {
+		t.Errorf("got %d ROA lookups, want 1", n)
+	}
+}
+
+func TestFlightSourced(t *testing.T) {
+	router := newBlockingRouter(t)
+	srv := getTestServer(router)
+
+	var requests []func() error
+	for i := 0; i < 3; i++ {
+		requests = append(requests, func() error {
+			resp, err := srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169})
+			if err == nil && resp.GetV4Count() != 1 {
+				t.Errorf("got %d IPv4 prefixes, want 1", resp.GetV4Count())
+			}
+			return err
+		})
+	}
+	collapse(t, srv, isourced, "15169", router, requests)
+
+	if n := atomic.LoadInt32(router.sourced); n != 1 {
+		t.Errorf("got %d sourced lookups, want 1", n)
+	}
+}
+
+func TestFlightCancel(t *testing.T) {
+	router := newBlockingRouter(t)
+	srv := getTestServer(router)
+
+	// The first caller starts the lookup, then goes away before it finishes.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := srv.Sourced(ctx, &pb.SourceRequest{AsNumber: 15169})
+		first <- err
+	}()
+	waitForDups(t, srv.flights[isourced], "15169", 0)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("first caller got error %v, want %v", err, context.Canceled)
+	}
+
+	// Later callers still share the lookup, and get its result.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169})
+			if err != nil || resp.GetV4Count() != 1 {
+				t.Errorf("got %d IPv4 prefixes and error %v, want 1 and no error", resp.GetV4Count(), err)
+			}
+		}()
+	}
+	waitForDups(t, srv.flights[isourced], "15169", 2)
+	close(router.release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(router.sourced); n != 1 {
+		t.Errorf("got %d sourced lookups, want 1", n)
+	}
+}
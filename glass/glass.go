@@ -5,19 +5,32 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"image/png"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"googlemaps.github.io/maps"
 
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 
@@ -30,12 +43,33 @@ import (
 )
 
 type server struct {
-	router   cli.Decoder
+	router cli.Decoder
+	// mu guards roas, which are reloaded in the background.
 	mu       *sync.RWMutex
-	bsql     *grpc.ClientConn
-	bgprpc   string
+	bsql     *bgpsqlConn
 	mapi     string
 	airports map[string]location
+	irr      irr
+	roas     *roaStore
+	// maxPrefixes limits the prefixes returned by Sourced. 0 is no limit.
+	maxPrefixes int
+	// normaliseNames tidies AS names before they are returned.
+	normaliseNames bool
+	// maxPathLength is the longest AS path before it's flagged as anomalous. 0 is no limit.
+	maxPathLength int
+	// subscribeRefresh is how often subscribers' lookups are checked for changes
+	// other than to the route. 0 checks only when a route is cached.
+	subscribeRefresh time.Duration
+	// inspectCache enables CacheInspect, for debugging.
+	inspectCache bool
+	// flushCache enables FlushCache.
+	flushCache bool
+	// communities annotates communities with their meaning. Empty unless configured.
+	communities communityDict
+	// health reports whether bird and bgpsql are reachable, for load balancers.
+	health *health.Server
+	// started is when glass started, for its uptime.
+	started time.Time
 	cache
 }
 
@@ -59,6 +93,9 @@ var commonPops = []string{
 }
 
 func main() {
+	checkconfig := flag.Bool("checkconfig", false, "validate config.ini and exit")
+	flag.Parse()
+
 	// load in config
 	exe, err := os.Executable()
 	if err != nil {
@@ -71,17 +108,22 @@ func main() {
 		log.Fatalf("failed to read config file: %v\n", err)
 	}
 
+	if *checkconfig {
+		if err := checkConfig(cf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config OK")
+		return
+	}
+
 	logfile := cf.Section("log").Key("logfile").String()
 	mapi := cf.Section("local").Key("mapsAPI").String()
 
 	// Set up log file
-	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("failed to open logfile: %v\n", err)
-	}
-	defer f.Close()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(f)
+	f := com.SetLogOutput(logfile, com.LogRotateConfig(cf.Section("log")))
+	defer f.Close()
 
 	daemon := cf.Section("local").Key("daemon").String()
 
@@ -93,26 +135,80 @@ func main() {
 	var router cli.Decoder
 	switch daemon {
 	case "bird2":
-		router = cli.Bird2Conn{}
+		router = cli.Bird2Conn{
+			LocalPrefROA: localPrefROA(cf.Section("roa")),
+		}
 	default:
 		log.Fatalf("daemon type must be specified")
 	}
 
-	bgprpc := cf.Section("bgpsql").Key("server").String()
-	conn, err := dialGRPC(bgprpc)
-	if err != nil {
-		log.Fatalf("Unable to dial gRPC server: %v", err)
+	// bgpsql is optional if AS names are loaded from a local file.
+	var bsql *bgpsqlConn
+	if bgprpc := cf.Section("bgpsql").Key("server").String(); bgprpc != "" {
+		// bgpsql is dialled with TLS if there's a CA to check it against.
+		var creds credentials.TransportCredentials
+		if ca := cf.Section("bgpsql").Key("ca").String(); ca != "" {
+			creds, err = clientCreds(ca)
+			if err != nil {
+				log.Fatalf("Unable to load bgpsql CA: %v", err)
+			}
+		}
+		bsql, err = newBgpsqlConn(bgprpc, creds)
+		if err != nil {
+			log.Fatalf("Unable to dial gRPC server: %v", err)
+		}
+		defer bsql.close()
 	}
-	defer conn.Close()
+
+	// Cache settings are read before anything can use the cache.
+	ttlJitter = cf.Section("cache").Key("jitter").MustFloat64(ttlJitter)
+	swrAge = swrConfig(cf.Section("swr"))
 
 	glassServer := &server{
 		router:   router,
 		mu:       &sync.RWMutex{},
-		bsql:     conn,
-		bgprpc:   bgprpc,
+		bsql:     bsql,
 		mapi:     mapi,
 		airports: airports,
 		cache:    getNewCache(),
+		// Keeps a Sourced response well under the default 4MB gRPC message limit.
+		maxPrefixes:    cf.Section("sourced").Key("maxprefixes").MustInt(100000),
+		normaliseNames: cf.Section("asnames").Key("normalise").MustBool(false),
+		maxPathLength:  cf.Section("aspath").Key("maxlength").MustInt(100),
+		// ROA and AS path changes don't touch the route cache, so are found on refresh.
+		subscribeRefresh: cf.Section("subscribe").Key("refresh").MustDuration(time.Minute),
+		inspectCache:     cf.Section("cache").Key("inspect").MustBool(false),
+		flushCache:       cf.Section("cache").Key("flush").MustBool(false),
+		health:           health.NewServer(),
+		started:          time.Now(),
+	}
+	glassServer.maxAge, glassServer.maxCache = cacheConfig(cf.Section("cache"))
+	glassServer.negativeAge = cf.Section("cache").Key("negative_age").MustDuration(defaultNegativeAge)
+	// Locations and maps are slow to look up, so are optionally kept over restarts.
+	cacheFile := cf.Section("cache").Key("file").String()
+	if cacheFile != "" {
+		if err := glassServer.loadCache(cacheFile); err != nil {
+			log.Printf("Unable to load saved cache: %v", err)
+		}
+	}
+	if commFile := cf.Section("communities").Key("file").String(); commFile != "" {
+		glassServer.communities, err = loadCommunities(commFile)
+		if err != nil {
+			log.Fatalf("Unable to load community dictionary: %v", err)
+		}
+	}
+	if irrServer := cf.Section("irr").Key("server").String(); irrServer != "" {
+		glassServer.irr = whoisIRR{server: irrServer}
+	}
+
+	// Cache and request counters are optionally served by expvar on /debug/vars,
+	// and for Prometheus on /metrics.
+	if port := cf.Section("metrics").Key("port").String(); port != "" {
+		log.Printf("Metrics listening on port %s\n", port)
+		http.Handle("/metrics", glassServer.metricsHandler())
+		go func() {
+			log.Printf("Metrics server stopped: %v", http.ListenAndServe(":"+port, nil))
+		}()
 	}
 
 	// set up gRPC server
@@ -121,32 +217,207 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to bind: %v", err)
 	}
-	grpcServer := grpc.NewServer()
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(countRequests)}
+	// Plaintext unless a certificate is configured.
+	if cert := cf.Section("tls").Key("cert").String(); cert != "" {
+		clientCA := cf.Section("tls").Key("client_ca").String()
+		creds, err := serverCreds(cert, cf.Section("tls").Key("key").String(), clientCA)
+		if err != nil {
+			log.Fatalf("Unable to set up TLS: %v", err)
+		}
+		log.Printf("Serving TLS, client certificates required: %t", clientCA != "")
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterLookingGlassServer(grpcServer, glassServer)
+	healthpb.RegisterHealthServer(grpcServer, glassServer.health)
+
+	// Stop cleanly on shutdown, so the cache can be saved.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		glassServer.health.Shutdown()
+		grpcServer.Stop()
+	}()
+
+	go glassServer.watchHealth(ctx, cf.Section("health").Key("interval").MustDuration(10*time.Second))
+
+	sweep := cf.Section("cache").Key("sweep").MustDuration(5 * time.Minute)
+	go glassServer.clearCache(ctx, sweep, glassServer.maxAge, glassServer.maxCache)
+
+	if cacheFile != "" {
+		save := cf.Section("cache").Key("save").MustDuration(10 * time.Minute)
+		go glassServer.persistCache(ctx, cacheFile, save)
+	}
+
+	if roaFile := cf.Section("roa").Key("file").String(); roaFile != "" {
+		refresh := cf.Section("roa").Key("refresh").MustDuration(time.Hour)
+		go glassServer.refreshROAs(roaFile, refresh)
+	}
 
-	go glassServer.clearCache(5*time.Minute, maxAge, maxCache)
+	if asnFile := cf.Section("asnames").Key("file").String(); asnFile != "" {
+		refresh := cf.Section("asnames").Key("refresh").MustDuration(24 * time.Hour)
+		go glassServer.refreshASNames(asnFile, refresh)
+	}
 
 	glassServer.warmCache()
 
-	grpcServer.Serve(lis)
+	if err := grpcServer.Serve(lis); err != nil {
+		log.Printf("Server stopped: %v", err)
+	}
+	if cacheFile != "" {
+		if err := glassServer.saveCache(cacheFile); err != nil {
+			log.Printf("Error saving cache: %v", err)
+		}
+	}
 }
 
+// dialGRPC dials the server with TLS if creds are set, else in plaintext.
 // TODO: Do these options even work? Check bgpstuff.net settings
-func dialGRPC(srv string) (*grpc.ClientConn, error) {
+func dialGRPC(srv string, creds credentials.TransportCredentials) (*grpc.ClientConn, error) {
 	// Set keepalive on the client
 	kacp := keepalive.ClientParameters{
 		Time:    10 * time.Second, // send pings every 10 seconds if there is no activity
 		Timeout: 3 * time.Second,  // wait 3 seconds for ping ack before considering the connection dead
 	}
 
+	security := grpc.WithInsecure()
+	if creds != nil {
+		security = grpc.WithTransportCredentials(creds)
+	}
+
 	log.Printf("Dialling %s\n", srv)
 	return grpc.Dial(
 		srv,
-		grpc.WithInsecure(),
+		security,
 		grpc.WithKeepaliveParams(kacp),
 	)
 }
 
+// checkConfig validates the config file without starting the server.
+func checkConfig(cf *ini.File) error {
+	var c com.ConfigCheck
+
+	c.Writable("log", "logfile", cf.Section("log").Key("logfile").String())
+	for _, key := range []string{"maxsize", "maxbackups", "maxage"} {
+		c.Uint("log", key, cf.Section("log").Key(key).String())
+	}
+
+	daemon := cf.Section("local").Key("daemon").String()
+	c.Required("local", "daemon", daemon)
+	c.OneOf("local", "daemon", daemon, "bird2")
+
+	for _, key := range []string{"valid", "unknown", "invalid"} {
+		c.Uint("roa", key, cf.Section("roa").Key(key).String())
+	}
+
+	c.Readable("roa", "file", cf.Section("roa").Key("file").String())
+	c.Duration("roa", "refresh", cf.Section("roa").Key("refresh").String())
+
+	c.Uint("sourced", "maxprefixes", cf.Section("sourced").Key("maxprefixes").String())
+	c.Uint("aspath", "maxlength", cf.Section("aspath").Key("maxlength").String())
+	c.Duration("subscribe", "refresh", cf.Section("subscribe").Key("refresh").String())
+
+	c.Port("metrics", "port", cf.Section("metrics").Key("port").String())
+
+	// A key and client CA are only used alongside a certificate.
+	cert := cf.Section("tls").Key("cert").String()
+	c.Readable("tls", "cert", cert)
+	c.Readable("tls", "key", cf.Section("tls").Key("key").String())
+	c.Readable("tls", "client_ca", cf.Section("tls").Key("client_ca").String())
+	if cert != "" {
+		c.Required("tls", "key", cf.Section("tls").Key("key").String())
+	}
+	if cf.Section("tls").Key("client_ca").String() != "" {
+		c.Required("tls", "cert", cert)
+	}
+	c.Readable("bgpsql", "ca", cf.Section("bgpsql").Key("ca").String())
+
+	c.Duration("health", "interval", cf.Section("health").Key("interval").String())
+
+	c.Fraction("cache", "jitter", cf.Section("cache").Key("jitter").String())
+	c.Duration("cache", "sweep", cf.Section("cache").Key("sweep").String())
+	c.Duration("cache", "negative_age", cf.Section("cache").Key("negative_age").String())
+	c.Writable("cache", "file", cf.Section("cache").Key("file").String())
+	c.Duration("cache", "save", cf.Section("cache").Key("save").String())
+	for ttype, name := range cacheNames {
+		c.Duration("cache", name+"_age", cf.Section("cache").Key(name+"_age").String())
+		if _, ok := defaultMaxCache[ttype]; ok {
+			c.Uint("cache", name+"_max", cf.Section("cache").Key(name+"_max").String())
+		}
+	}
+
+	for key := range swrTypes {
+		c.Duration("swr", key, cf.Section("swr").Key(key).String())
+	}
+
+	c.Readable("asnames", "file", cf.Section("asnames").Key("file").String())
+	c.Readable("communities", "file", cf.Section("communities").Key("file").String())
+	c.Duration("asnames", "refresh", cf.Section("asnames").Key("refresh").String())
+
+	return c.Err()
+}
+
+// swrTypes are the caches that can serve stale entries, keyed by their config name.
+var swrTypes = map[string]int{
+	"origin": iorigin,
+	"aspath": iaspath,
+	"route":  iroute,
+}
+
+// swrConfig reads the optional stale-while-revalidate window for each cache type.
+func swrConfig(sec *ini.Section) map[int]time.Duration {
+	swr := make(map[int]time.Duration)
+	for key, ttype := range swrTypes {
+		if d := sec.Key(key).MustDuration(0); d > 0 {
+			swr[ttype] = d
+		}
+	}
+	return swr
+}
+
+// cacheConfig reads the optional max age and max entries of each cache type,
+// e.g. route_age = 30s and route_max = 500. Unset types keep their defaults.
+func cacheConfig(sec *ini.Section) (map[int]time.Duration, map[int]int) {
+	ages := make(map[int]time.Duration)
+	for ttype, age := range defaultMaxAge {
+		ages[ttype] = sec.Key(cacheNames[ttype] + "_age").MustDuration(age)
+	}
+	sizes := make(map[int]int)
+	for ttype, size := range defaultMaxCache {
+		sizes[ttype] = sec.Key(cacheNames[ttype] + "_max").MustInt(size)
+		if sizes[ttype] < 0 {
+			log.Printf("Ignoring negative %s_max of %d, using the default of %d", cacheNames[ttype], sizes[ttype], size)
+			sizes[ttype] = size
+		}
+	}
+	return ages, sizes
+}
+
+// localPrefROA reads an optional mapping of local-pref values to ROA status.
+// If nothing is configured, the router is asked for the ROA status directly.
+func localPrefROA(sec *ini.Section) map[uint32]int {
+	statuses := map[string]int{
+		"valid":   cli.RValid,
+		"unknown": cli.RUnknown,
+		"invalid": cli.RInvalid,
+	}
+
+	prefs := make(map[uint32]int)
+	for key, status := range statuses {
+		if sec.HasKey(key) {
+			prefs[uint32(sec.Key(key).MustUint(0))] = status
+		}
+	}
+	if len(prefs) == 0 {
+		return nil
+	}
+
+	return prefs
+}
+
 // loadAirports will read the airports.dat file and load into a map of location structs
 func loadAirports(airFile string) (map[string]location, error) {
 	f, err := os.Open(airFile)
@@ -172,11 +443,54 @@ func loadAirports(airFile string) (map[string]location, error) {
 	return locations, nil
 }
 
+// asNameRegex matches the autnums.html format, e.g. AS49   </a> NIST, US
+var asNameRegex = regexp.MustCompile(`AS(\d+)\s*</a> (.*),\s*([A-Z]{2})`)
+
+// loadASNames will read an autnums.html style file into a map of AS names.
+func loadASNames(asnFile string) (map[uint32]pb.AsnameResponse, error) {
+	contents, err := ioutil.ReadFile(asnFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open AS names file: %v", err)
+	}
+
+	names := make(map[uint32]pb.AsnameResponse)
+	for _, as := range asNameRegex.FindAllStringSubmatch(string(contents), -1) {
+		asn, err := strconv.ParseUint(as[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		names[uint32(asn)] = pb.AsnameResponse{
+			AsName: as[2],
+			Locale: as[3],
+			Exists: true,
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no AS names found in %s", asnFile)
+	}
+
+	return names, nil
+}
+
+// refreshASNames will load AS names from a local file, then reload every sleep interval.
+// If a reload fails, the previously loaded names are kept.
+func (s *server) refreshASNames(asnFile string, sleep time.Duration) {
+	for {
+		names, err := loadASNames(asnFile)
+		if err != nil {
+			log.Printf("Unable to load AS names: %v", err)
+		} else {
+			s.updateASNFile(names)
+		}
+		time.Sleep(sleep)
+	}
+}
+
 // TotalAsns will return the total number of course ASNs.
 func (s *server) TotalAsns(ctx context.Context, e *pb.Empty) (*pb.TotalAsnsResponse, error) {
 	log.Printf("Running TotalAsns")
 
-	as, err := s.router.GetTotalSourceASNs()
+	as, err := s.router.GetTotalSourceASNs(ctx)
 	if err != nil {
 		log.Printf("Error: %v", err)
 		return &pb.TotalAsnsResponse{}, err
@@ -204,25 +518,55 @@ func getTracerFromContext(ctx context.Context) string {
 func (s *server) Origin(ctx context.Context, r *pb.OriginRequest) (*pb.OriginResponse, error) {
 	log.Printf("Running Origin")
 
-	ip, err := com.ValidateIP(r.GetIpAddress().GetAddress())
-	if err != nil {
+	if _, err := com.ValidateIP(r.GetIpAddress().GetAddress()); err != nil {
+		return &pb.OriginResponse{}, err
+	}
+
+	// Origins are cached by route, so the route is found first. Every address
+	// in the route then shares the one cache entry.
+	ipnet, _, err := s.activeRoute(ctx, r.GetIpAddress())
+	if err != nil || ipnet == nil {
 		return &pb.OriginResponse{}, err
 	}
 
 	// check local cache
-	cache, ok := s.checkOriginCache(r.GetIpAddress().GetAddress())
-	if ok {
+	switch cache, res := s.checkOriginCache(ipnet); res {
+	case cachedPositive:
 		return &cache, nil
+	case cachedNegative:
+		return &pb.OriginResponse{}, nil
 	}
 
-	origin, exists, err := s.router.GetOriginFromIP(ip)
+	// A stale entry is returned while it's refreshed in the background.
+	if stale, ok := s.checkStaleOriginCache(ipnet); ok {
+		s.revalidate("origin "+ipnet.String(), func(ctx context.Context) error {
+			_, err := s.originFromRouter(ctx, ipnet)
+			return err
+		})
+		return &stale, nil
+	}
+
+	origin, err := s.flights[iorigin].do(ctx, ipnet.String(), func(ctx context.Context) (interface{}, error) {
+		return s.originFromRouter(ctx, ipnet)
+	})
+	if err != nil {
+		return &pb.OriginResponse{}, err
+	}
+	return origin.(*pb.OriginResponse), nil
+}
+
+// originFromRouter will get the origin ASN of a route from the router and cache it.
+func (s *server) originFromRouter(ctx context.Context, ipnet *net.IPNet) (*pb.OriginResponse, error) {
+	origin, exists, err := s.router.GetOriginFromIP(ctx, ipnet.IP)
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
 		return &pb.OriginResponse{}, err
 	}
 
-	// IP route may not exist. Return no error, but not existing either.
+	// The route may have gone since it was looked up, or have no origin.
+	// Return no error, but not existing either.
 	if !exists {
+		s.updateNegativeOriginCache(ipnet)
 		return &pb.OriginResponse{}, nil
 	}
 
@@ -233,7 +577,7 @@ func (s *server) Origin(ctx context.Context, r *pb.OriginRequest) (*pb.OriginRes
 	}
 
 	// update the local cache
-	s.updateOriginCache(r.GetIpAddress().GetAddress(), resp)
+	s.updateOriginCache(ipnet, resp)
 
 	return &resp, nil
 }
@@ -243,13 +587,17 @@ func (s *server) Origin(ctx context.Context, r *pb.OriginRequest) (*pb.OriginRes
 func (s *server) Invalids(ctx context.Context, r *pb.InvalidsRequest) (*pb.InvalidResponse, error) {
 	log.Printf("Running Invalids for ASN %s", r.GetAsn())
 
+	if !s.router.Capabilities().Invalids {
+		return &pb.InvalidResponse{}, unsupported("ROA invalids")
+	}
+
 	// check local cache
 	cache, ok := s.checkInvalidsCache(r.GetAsn())
 	if ok {
 		return &cache, nil
 	}
 
-	inv, err := s.router.GetInvalids()
+	inv, err := s.router.GetInvalids(ctx)
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
 		return &pb.InvalidResponse{}, err
@@ -317,10 +665,13 @@ func (s *server) Totals(ctx context.Context, e *pb.Empty) (*pb.TotalResponse, er
 		return nil, nil
 	}
 
-	stub := bpb.NewBgpInfoClient(s.bsql)
+	if s.bsql == nil {
+		return &pb.TotalResponse{}, status.Error(codes.Unavailable, "bgpsql server not configured")
+	}
+
+	stub := bpb.NewBgpInfoClient(s.bsql.get())
 	totals, err := stub.GetPrefixCount(ctx, &bpb.Empty{})
 	if err != nil {
-		s.handleUnavailableRPC(err)
 		return &pb.TotalResponse{}, err
 	}
 
@@ -340,7 +691,11 @@ func (s *server) Totals(ctx context.Context, e *pb.Empty) (*pb.TotalResponse, er
 func (s *server) Aspath(ctx context.Context, r *pb.AspathRequest) (*pb.AspathResponse, error) {
 	log.Printf("Running Aspath")
 
-	ip, err := com.ValidateIP(r.GetIpAddress().GetAddress())
+	if !s.router.Capabilities().ASPath {
+		return &pb.AspathResponse{}, unsupported("AS path")
+	}
+
+	ip, err := requestIP(r.GetIpAddress())
 	if err != nil {
 		return &pb.AspathResponse{}, err
 	}
@@ -351,7 +706,21 @@ func (s *server) Aspath(ctx context.Context, r *pb.AspathRequest) (*pb.AspathRes
 		return &path, nil
 	}
 
-	paths, exists, err := s.router.GetASPathFromIP(ip)
+	// A stale entry is returned while it's refreshed in the background.
+	if stale, ok := s.checkStaleASPathCache(ip.String()); ok {
+		s.revalidate("as-path "+ip.String(), func(ctx context.Context) error {
+			_, err := s.aspathFromRouter(ctx, ip)
+			return err
+		})
+		return &stale, nil
+	}
+
+	return s.aspathFromRouter(ctx, ip)
+}
+
+// aspathFromRouter will get the AS path from the router and cache it.
+func (s *server) aspathFromRouter(ctx context.Context, ip net.IP) (*pb.AspathResponse, error) {
+	paths, exists, err := s.router.GetASPathFromIP(ctx, ip)
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
 		return &pb.AspathResponse{}, err
@@ -384,6 +753,7 @@ func (s *server) Aspath(ctx context.Context, r *pb.AspathRequest) (*pb.AspathRes
 		Set:       set,
 		Exists:    exists,
 		CacheTime: uint64(time.Now().Unix()),
+		Anomalous: s.anomalousPath(len(p)),
 	}
 
 	// update the cache
@@ -392,67 +762,374 @@ func (s *server) Aspath(ctx context.Context, r *pb.AspathRequest) (*pb.AspathRes
 	return &resp, nil
 }
 
-// Route returns the primary active RIB entry for the requested IP.
+// Communities will return the BGP communities on the active route for an IP address.
+// Each standard and large community is annotated from the community dictionary.
+func (s *server) Communities(ctx context.Context, r *pb.CommunitiesRequest) (*pb.CommunitiesResponse, error) {
+	log.Printf("Running Communities")
+
+	if !s.router.Capabilities().Communities {
+		return &pb.CommunitiesResponse{}, unsupported("community")
+	}
+
+	// Communities are cached by route, so the route is found first.
+	ipnet, prefix, err := s.activeRoute(ctx, r.GetIpAddress())
+	if err != nil || ipnet == nil {
+		return &pb.CommunitiesResponse{}, err
+	}
+
+	if cache, ok := s.checkCommunityCache(ipnet); ok {
+		return &cache, nil
+	}
+
+	return s.communitiesFromRouter(ctx, ipnet, prefix)
+}
+
+// communitiesFromRouter will get the communities on a route from the router and cache them.
+func (s *server) communitiesFromRouter(ctx context.Context, ipnet *net.IPNet, prefix *pb.IpAddress) (*pb.CommunitiesResponse, error) {
+	comms, exists, err := s.router.GetCommunities(ctx, ipnet.IP)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.CommunitiesResponse{}, err
+	}
+
+	// The route may have gone since it was looked up.
+	if !exists {
+		return &pb.CommunitiesResponse{}, nil
+	}
+
+	resp := pb.CommunitiesResponse{
+		IpAddress: prefix,
+		Exists:    exists,
+		CacheTime: uint64(time.Now().Unix()),
+	}
+	for _, c := range comms.Standard {
+		meaning, _ := s.communities.meaning(fmt.Sprintf("%d:%d", c.ASN, c.Value))
+		resp.Standard = append(resp.Standard, &pb.Community{
+			Asn:     c.ASN,
+			Value:   c.Value,
+			Meaning: meaning,
+		})
+	}
+	for _, c := range comms.Large {
+		meaning, _ := s.communities.meaning(fmt.Sprintf("%d:%d:%d", c.ASN, c.Data1, c.Data2))
+		resp.Large = append(resp.Large, &pb.LargeCommunity{
+			Asn:     c.ASN,
+			Data1:   c.Data1,
+			Data2:   c.Data2,
+			Meaning: meaning,
+		})
+	}
+	for _, c := range comms.Extended {
+		resp.Extended = append(resp.Extended, &pb.ExtendedCommunity{
+			Type:  c.Type,
+			Admin: c.Admin,
+			Value: c.Value,
+		})
+	}
+
+	// update the cache
+	s.updateCommunityCache(ipnet, resp)
+
+	return &resp, nil
+}
+
+// NextHop will return where traffic for the active route for an IP address is forwarded.
+func (s *server) NextHop(ctx context.Context, r *pb.NextHopRequest) (*pb.NextHopResponse, error) {
+	log.Printf("Running NextHop")
+
+	if !s.router.Capabilities().NextHop {
+		return &pb.NextHopResponse{}, unsupported("next hop")
+	}
+
+	// Next hops are cached by route, so the route is found first.
+	ipnet, prefix, err := s.activeRoute(ctx, r.GetIpAddress())
+	if err != nil || ipnet == nil {
+		return &pb.NextHopResponse{}, err
+	}
+
+	if cache, ok := s.checkNextHopCache(ipnet); ok {
+		return &cache, nil
+	}
+
+	nh, exists, err := s.router.GetNextHop(ctx, ipnet.IP)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.NextHopResponse{}, err
+	}
+
+	// The route may have gone since it was looked up, or have no next hop.
+	if !exists {
+		return &pb.NextHopResponse{}, nil
+	}
+
+	resp := pb.NextHopResponse{
+		IpAddress: prefix,
+		Interface: nh.Interface,
+		Exists:    exists,
+		CacheTime: uint64(time.Now().Unix()),
+	}
+	if nh.IP != nil {
+		resp.NextHop = nh.IP.String()
+	}
+
+	// update the cache
+	s.updateNextHopCache(ipnet, resp)
+
+	return &resp, nil
+}
+
+// activeRoute returns the active route covering an address, using the route
+// cache. The route is nil if there isn't one.
+func (s *server) activeRoute(ctx context.Context, a *pb.IpAddress) (*net.IPNet, *pb.IpAddress, error) {
+	route, err := s.Route(ctx, &pb.RouteRequest{IpAddress: a})
+	if err != nil || !route.GetExists() {
+		return nil, nil, err
+	}
+	prefix := route.GetIpAddress()
+	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix.GetAddress(), prefix.GetMask()))
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return nil, nil, status.Errorf(codes.Internal, "bad route %v: %v", prefix, err)
+	}
+	return ipnet, prefix, nil
+}
+
+// AspathLength will return the number of hops in the AS path. It uses the
+// as-path cache, so needs no extra router lookup once the path is cached.
+func (s *server) AspathLength(ctx context.Context, r *pb.AspathRequest) (*pb.AspathLengthResponse, error) {
+	log.Printf("Running AspathLength")
+
+	path, err := s.Aspath(ctx, r)
+	if err != nil {
+		return &pb.AspathLengthResponse{}, err
+	}
+
+	return &pb.AspathLengthResponse{
+		Length: pathLength(path),
+		Exists: path.GetExists(),
+	}, nil
+}
+
+// pathLength returns the number of hops in an AS path. An AS set counts as one
+// hop however many AS numbers are in it, as when BGP compares path lengths.
+func pathLength(path *pb.AspathResponse) uint32 {
+	length := uint32(len(path.GetAsn()))
+	if len(path.GetSet()) > 0 {
+		length++
+	}
+	return length
+}
+
+// anomalousPath returns true if an AS path of this length is longer than the maximum.
+func (s *server) anomalousPath(length int) bool {
+	return s.maxPathLength > 0 && length > s.maxPathLength
+}
+
+// requestIP validates the address to look up. The request can hold a bare IP address,
+// or a prefix either as CIDR or with the mask set. A prefix is looked up by its first
+// address, so gets the same result as any address within it.
+func requestIP(a *pb.IpAddress) (net.IP, error) {
+	addr, mask := a.GetAddress(), a.GetMask()
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		m, err := strconv.ParseUint(addr[i+1:], 10, 32)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid prefix: %s", addr)
+		}
+		addr, mask = addr[:i], uint32(m)
+	}
+
+	ip, family, err := com.ValidateIPFamily(addr)
+	if err != nil {
+		return nil, err
+	}
+	if mask == 0 {
+		return ip, nil
+	}
+
+	bits := 32
+	if family == com.IPv6 {
+		bits = 128
+	}
+	if mask > uint32(bits) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mask /%d for %s", mask, addr)
+	}
+	first := ip.Mask(net.CIDRMask(int(mask), bits))
+	if !com.IsPublicIP(first) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s/%d is not a public prefix", first, mask)
+	}
+	return first, nil
+}
+
+// Route returns the primary active RIB entry for the requested IP or prefix.
 func (s *server) Route(ctx context.Context, r *pb.RouteRequest) (*pb.RouteResponse, error) {
 	log.Printf("Running Route")
 
-	ip, err := com.ValidateIP(r.GetIpAddress().GetAddress())
+	ip, err := requestIP(r.GetIpAddress())
 	if err != nil {
 		return &pb.RouteResponse{}, err
 	}
 
 	// check local cache first
-	cache, ok := s.checkRouteCache(ip.String())
-	if ok {
+	switch cache, res := s.checkRouteCache(ip); res {
+	case cachedPositive:
+		setRouteAge(&cache)
 		return &cache, nil
+	case cachedNegative:
+		resp := &pb.RouteResponse{}
+		if r.GetDiagnose() {
+			s.diagnoseRoute(ctx, ip, resp)
+		}
+		return resp, nil
+	}
+
+	// A stale entry is returned while it's refreshed in the background.
+	if stale, ok := s.checkStaleRouteCache(ip); ok {
+		s.revalidate("route "+ip.String(), func(ctx context.Context) error {
+			_, err := s.routeFromRouter(ctx, ip)
+			return err
+		})
+		setRouteAge(&stale)
+		return &stale, nil
 	}
 
-	ipnet, exists, err := s.router.GetRoute(ip)
+	resp, err := s.routeFromRouter(ctx, ip)
+	if err != nil || resp.GetExists() || !r.GetDiagnose() {
+		return resp, err
+	}
+	s.diagnoseRoute(ctx, ip, resp)
+	return resp, nil
+}
+
+// diagnoseRoute sets whether a missing route was filtered by import policy,
+// rather than never received. A failed check leaves the response as it was.
+func (s *server) diagnoseRoute(ctx context.Context, ip net.IP, resp *pb.RouteResponse) {
+	if !s.router.Capabilities().Filtered {
+		return
+	}
+	ipnet, filtered, err := s.router.GetFilteredRoute(ctx, ip)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return
+	}
+	if !filtered {
+		return
+	}
+	mask, err := prefixMask(ipnet)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return
+	}
+	resp.IpAddress = &pb.IpAddress{
+		Address: ipnet.IP.String(),
+		Mask:    mask,
+	}
+	resp.Filtered = true
+}
+
+// routeFromRouter will get the active route from the router and cache it.
+func (s *server) routeFromRouter(ctx context.Context, ip net.IP) (*pb.RouteResponse, error) {
+	ipnet, exists, err := s.router.GetRoute(ctx, ip)
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
 		return &pb.RouteResponse{}, err
 	}
 	if !exists {
+		s.updateNegativeRouteCache(ip)
 		return &pb.RouteResponse{}, nil
 	}
 
-	var resp pb.RouteResponse
+	mask, err := prefixMask(ipnet)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.RouteResponse{}, err
+	}
 
-	mask, _ := ipnet.Mask.Size()
+	var resp pb.RouteResponse
 	ipaddr := pb.IpAddress{
 		Address: ipnet.IP.String(),
-		Mask:    uint32(mask),
+		Mask:    mask,
 	}
 
 	resp.IpAddress = &ipaddr
 	resp.Exists = exists
 	resp.CacheTime = uint64(time.Now().Unix())
 
+	// Not all routers expose when the route last changed.
+	if s.router.Capabilities().RouteSince {
+		since, ok, err := s.router.GetRouteSince(ctx, ip)
+		if err != nil {
+			log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		}
+		if ok {
+			resp.LastChange = uint64(since.Unix())
+			setRouteAge(&resp)
+		}
+	}
+
 	// cache the result
-	s.updateRouteCache(ip.String(), resp)
+	s.updateRouteCache(ipnet, resp)
 
 	return &resp, nil
 }
 
+// prefixMask returns the mask length of a prefix from the router. A non-canonical
+// mask has no length, so is an error rather than being returned as a /0.
+func prefixMask(ipnet *net.IPNet) (uint32, error) {
+	ones, bits := ipnet.Mask.Size()
+	if bits == 0 {
+		return 0, status.Errorf(codes.Internal, "router returned %s with a non-canonical mask %s", ipnet.IP, ipnet.Mask)
+	}
+	return uint32(ones), nil
+}
+
+// unsupported returns the error for a lookup the router doesn't support.
+func unsupported(lookup string) error {
+	return status.Errorf(codes.Unimplemented, "%s lookups are not supported by this router", lookup)
+}
+
+// setRouteAge updates the age of the route from the time it last changed.
+func setRouteAge(r *pb.RouteResponse) {
+	if r.GetLastChange() == 0 {
+		return
+	}
+	r.Age = uint64(time.Since(time.Unix(int64(r.GetLastChange()), 0)).Seconds())
+}
+
 // Asname will return the registered name of the ASN. As this isn't in bird directly, will need
 // to speak to bgpsql to get information from the database.
 func (s *server) Asname(ctx context.Context, r *pb.AsnameRequest) (*pb.AsnameResponse, error) {
 	// return nil, grpc.Errorf(codes.Unimplemented, "RPC not yet implemented")
 	log.Printf("Running Asname")
 
+	if !com.ValidateASN(r.GetAsNumber()) {
+		return &pb.AsnameResponse{}, status.Errorf(codes.InvalidArgument, "invalid AS number: %d", r.GetAsNumber())
+	}
+
 	// check local cache first
 	cache, ok := s.checkASNCache(r.GetAsNumber())
 	if ok {
 		return &cache, nil
 	}
 
+	// Without bgpsql, the local file is the only source of names.
+	if s.bsql == nil {
+		name, _ := s.checkASNFile(r.GetAsNumber())
+		name.CacheTime = uint64(time.Now().Unix())
+		s.normaliseName(&name)
+		return &name, nil
+	}
+
 	number := bpb.GetAsnameRequest{AsNumber: r.GetAsNumber()}
 
-	stub := bpb.NewBgpInfoClient(s.bsql)
+	stub := bpb.NewBgpInfoClient(s.bsql.get())
 	name, err := stub.GetAsname(ctx, &number)
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
-		s.handleUnavailableRPC(err)
+		if local, ok := s.checkASNFile(r.GetAsNumber()); ok {
+			local.CacheTime = uint64(time.Now().Unix())
+			s.normaliseName(&local)
+			return &local, nil
+		}
 		return &pb.AsnameResponse{}, err
 	}
 
@@ -462,6 +1139,7 @@ func (s *server) Asname(ctx context.Context, r *pb.AsnameRequest) (*pb.AsnameRes
 		Locale:    name.GetAsLocale(),
 		CacheTime: uint64(time.Now().Unix()),
 	}
+	s.normaliseName(&resp)
 
 	// Cache the result for next time
 	s.updateASNCache(r.GetAsNumber(), resp)
@@ -469,27 +1147,26 @@ func (s *server) Asname(ctx context.Context, r *pb.AsnameRequest) (*pb.AsnameRes
 	return &resp, nil
 }
 
-// Roa will check the ROA status of a prefix.
+// Roa will check the ROA status of the route for an IP or prefix.
 func (s *server) Roa(ctx context.Context, r *pb.RoaRequest) (*pb.RoaResponse, error) {
 	log.Printf("Running Roa")
 
-	ip, err := com.ValidateIP(r.GetIpAddress().GetAddress())
-	if err != nil {
-		return &pb.RoaResponse{}, err
+	if !s.router.Capabilities().ROA {
+		return &pb.RoaResponse{}, unsupported("ROA")
 	}
 
-	// In oder to check ROA, I first need the FIB entry as well as the current source ASN.
-	ipnet, exists, err := s.router.GetRoute(ip)
+	ip, err := requestIP(r.GetIpAddress())
 	if err != nil {
-		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
 		return &pb.RoaResponse{}, err
 	}
 
-	// TODO: Not sure if I should check cache before?
-	// or getroute should be cached itself
-	if !exists {
-		return &pb.RoaResponse{}, nil
+	// In oder to check ROA, I first need the FIB entry as well as the current source ASN.
+	// The route comes from the route cache, as Origin's does.
+	ipnet, prefix, err := s.activeRoute(ctx, r.GetIpAddress())
+	if err != nil || ipnet == nil {
+		return &pb.RoaResponse{}, err
 	}
+	mask := prefix.GetMask()
 
 	// If context cancelled, exit early here
 	if ctx.Err() == context.Canceled {
@@ -498,44 +1175,66 @@ func (s *server) Roa(ctx context.Context, r *pb.RoaRequest) (*pb.RoaResponse, er
 	}
 
 	// Only check the origin now.
-	origin, err := s.Origin(ctx, &pb.OriginRequest{IpAddress: r.IpAddress})
+	origin, err := s.Origin(ctx, &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: ip.String()}})
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
 		return &pb.RoaResponse{}, err
 	}
 
+	resp, err := s.routeROA(ctx, ipnet, mask, origin.GetOriginAsn())
+	if err != nil || resp == nil {
+		return resp, err
+	}
+
+	// Explanations are only added on request, so are not cached.
+	if r.GetExplain() {
+		resp.Explanation = s.explainROA(ipnet, origin.GetOriginAsn())
+	}
+
+	return resp, nil
+}
+
+// routeROA returns the ROA status of a route and its origin, from the cache or the router.
+func (s *server) routeROA(ctx context.Context, ipnet *net.IPNet, mask, origin uint32) (*pb.RoaResponse, error) {
 	// check local cache
 	roa, ok := s.checkROACache(ipnet)
 	if ok {
 		return &roa, nil
 	}
 
-	// If context cancelled, exit early here
-	if ctx.Err() == context.Canceled {
-		log.Println("Context is cancelled, exiting early")
-		return nil, nil
+	shared, err := s.flights[iroa].do(ctx, ipnet.String(), func(ctx context.Context) (interface{}, error) {
+		return s.roaFromRouter(ctx, ipnet, mask, origin)
+	})
+	if err != nil {
+		return &pb.RoaResponse{}, err
 	}
+	resp := shared.(*pb.RoaResponse)
 
-	status, exists, err := s.router.GetROA(ipnet, origin.GetOriginAsn())
-	if err != nil {
-		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+	// Each caller gets its own copy, as an explanation may be added to it.
+	roa = *resp
+	return &roa, nil
+}
+
+// roaFromRouter will get the ROA status of a route from the router and cache it.
+func (s *server) roaFromRouter(ctx context.Context, ipnet *net.IPNet, mask, origin uint32) (*pb.RoaResponse, error) {
+	// If context done, exit early here. The result may be shared, so it must be an error.
+	if err := ctx.Err(); err != nil {
+		log.Println("Context is done, exiting early")
 		return &pb.RoaResponse{}, err
 	}
 
-	// Check for an existing ROA
-	statuses := map[int]pb.RoaResponse_ROAStatus{
-		cli.RUnknown: pb.RoaResponse_UNKNOWN,
-		cli.RInvalid: pb.RoaResponse_INVALID,
-		cli.RValid:   pb.RoaResponse_VALID,
+	status, exists, err := s.router.GetROA(ctx, ipnet, origin)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.RoaResponse{}, err
 	}
 
-	mask, _ := ipnet.Mask.Size()
 	resp := pb.RoaResponse{
 		IpAddress: &pb.IpAddress{
 			Address: ipnet.IP.String(),
-			Mask:    uint32(mask),
+			Mask:    mask,
 		},
-		Status:    statuses[status],
+		Status:    roaStatuses[status],
 		Exists:    exists,
 		CacheTime: uint64(time.Now().Unix()),
 	}
@@ -545,10 +1244,50 @@ func (s *server) Roa(ctx context.Context, r *pb.RoaRequest) (*pb.RoaResponse, er
 	return &resp, nil
 }
 
+// explainROA returns the reason for the ROA status from the local ROAs, if loaded.
+func (s *server) explainROA(ipnet *net.IPNet, asn uint32) *pb.RoaExplanation {
+	roas := s.getROAStore()
+	if roas == nil {
+		return nil
+	}
+	_, explain := roas.validate(ipnet, asn)
+	return explain
+}
+
 func (s *server) Sourced(ctx context.Context, r *pb.SourceRequest) (*pb.SourceResponse, error) {
 	log.Printf("Running Sourced")
 	defer com.TimeFunction(time.Now(), "Sourced")
 
+	resp, err := s.sourced(ctx, r)
+	if err != nil {
+		return resp, err
+	}
+	return s.truncateSourced(resp), nil
+}
+
+// truncateSourced limits the amount of prefixes returned, so a giant ASN doesn't
+// exceed the gRPC message size. v4count and v6count are always the full counts.
+func (s *server) truncateSourced(resp *pb.SourceResponse) *pb.SourceResponse {
+	if s.maxPrefixes <= 0 || len(resp.GetIpAddress()) <= s.maxPrefixes {
+		return resp
+	}
+	log.Printf("Truncating Sourced response from %d to %d prefixes", len(resp.GetIpAddress()), s.maxPrefixes)
+
+	// The cached response is shared, so return a new one.
+	return &pb.SourceResponse{
+		IpAddress:     resp.GetIpAddress()[:s.maxPrefixes],
+		Exists:        resp.GetExists(),
+		V4Count:       resp.GetV4Count(),
+		V6Count:       resp.GetV6Count(),
+		CacheTime:     resp.GetCacheTime(),
+		Partial:       resp.GetPartial(),
+		PartialReason: resp.GetPartialReason(),
+		Truncated:     true,
+	}
+}
+
+// sourced returns all the prefixes originated by an ASN, without any truncation.
+func (s *server) sourced(ctx context.Context, r *pb.SourceRequest) (*pb.SourceResponse, error) {
 	if !com.ValidateASN(r.GetAsNumber()) {
 		return &pb.SourceResponse{}, fmt.Errorf("Invalid AS number")
 	}
@@ -559,27 +1298,62 @@ func (s *server) Sourced(ctx context.Context, r *pb.SourceRequest) (*pb.SourceRe
 		return &cache, nil
 	}
 
-	// If context cancelled, exit early here
-	if ctx.Err() == context.Canceled {
-		log.Println("Context is cancelled, exiting early")
-		return nil, nil
+	// Partial results are never cached, so requests allowing them can't share a
+	// lookup with those that don't.
+	key := strconv.FormatUint(uint64(r.GetAsNumber()), 10)
+	if r.GetAllowPartial() {
+		key += " partial"
+	}
+	resp, err := s.flights[isourced].do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return s.sourcedFromRouter(ctx, r)
+	})
+	if err != nil {
+		return &pb.SourceResponse{}, err
+	}
+	return resp.(*pb.SourceResponse), nil
+}
+
+// sourcedFromRouter will get the prefixes originated by an ASN from the router and cache them.
+func (s *server) sourcedFromRouter(ctx context.Context, r *pb.SourceRequest) (*pb.SourceResponse, error) {
+	// If context done, exit early here. The result may be shared, so it must be an error.
+	if err := ctx.Err(); err != nil {
+		log.Println("Context is done, exiting early")
+		return &pb.SourceResponse{}, err
 	}
 
-	v4, err := s.router.GetIPv4FromSource(r.GetAsNumber())
+	// If partial results are allowed, one family failing still returns the other.
+	var partial []string
+	v4, err := s.router.GetIPv4FromSource(ctx, r.GetAsNumber())
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
-		return &pb.SourceResponse{}, fmt.Errorf("Error on getting IPv4 from source: %w", err)
+		if !r.GetAllowPartial() {
+			return &pb.SourceResponse{}, fmt.Errorf("Error on getting IPv4 from source: %w", err)
+		}
+		partial = append(partial, fmt.Sprintf("unable to get IPv4 prefixes: %v", err))
 	}
-	v6, err := s.router.GetIPv6FromSource(r.GetAsNumber())
+	v6, err := s.router.GetIPv6FromSource(ctx, r.GetAsNumber())
 	if err != nil {
 		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
-		return &pb.SourceResponse{}, fmt.Errorf("Error on getting IPv6 from source: %w", err)
+		if !r.GetAllowPartial() {
+			return &pb.SourceResponse{}, fmt.Errorf("Error on getting IPv6 from source: %w", err)
+		}
+		partial = append(partial, fmt.Sprintf("unable to get IPv6 prefixes: %v", err))
+	}
+	if len(partial) == 2 {
+		return &pb.SourceResponse{}, fmt.Errorf("Error on getting prefixes from source: %s", strings.Join(partial, ", "))
 	}
 	// No prefixes will return empty, but no error
 	if len(v4)+len(v6) == 0 {
-		return &pb.SourceResponse{}, nil
+		return &pb.SourceResponse{
+			Partial:       len(partial) > 0,
+			PartialReason: strings.Join(partial, ", "),
+		}, nil
 	}
 
+	// Bird does not guarantee the order, so sort to keep responses stable.
+	sortPrefixes(v4)
+	sortPrefixes(v6)
+
 	prefixes := make([]*pb.IpAddress, 0, len(v4)+len(v6))
 	for _, v := range v4 {
 		mask, _ := v.Mask.Size()
@@ -604,27 +1378,609 @@ func (s *server) Sourced(ctx context.Context, r *pb.SourceRequest) (*pb.SourceRe
 		CacheTime: uint64(time.Now().Unix()),
 	}
 
+	// A partial result should not be served from the cache as if it were complete.
+	if len(partial) > 0 {
+		resp.Partial = true
+		resp.PartialReason = strings.Join(partial, ", ")
+		return &resp, nil
+	}
+
 	// Update the local cache
 	s.updateSourcedCache(r.GetAsNumber(), resp)
 
 	return &resp, nil
 }
 
-// bgpsql server might go offline, if so we should attempt to reconnect.
-func (s *server) handleUnavailableRPC(err error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	st, ok := status.FromError(err)
-	if !ok {
-		log.Printf("RPC error, but not a status code. Error if : %+v\n", err)
+// Lookup returns everything known about the route for an IP address in one response.
+// The route is fetched once, and the origin and ROA status are derived from it and
+// the AS path rather than each being looked up again.
+func (s *server) Lookup(ctx context.Context, r *pb.LookupRequest) (*pb.LookupResponse, error) {
+	log.Printf("Running Lookup")
+	defer com.TimeFunction(time.Now(), "Lookup")
+
+	// The request is resolved once, so the route, path and origin all come
+	// from the one route it asks for.
+	ip, err := requestIP(r.GetIpAddress())
+	if err != nil {
+		return &pb.LookupResponse{}, err
+	}
+	addr := &pb.IpAddress{Address: ip.String()}
+
+	route, err := s.Route(ctx, &pb.RouteRequest{IpAddress: addr})
+	if err != nil {
+		return &pb.LookupResponse{}, err
+	}
+	if !route.GetExists() {
+		return &pb.LookupResponse{}, nil
+	}
+	prefix := route.GetIpAddress()
+	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix.GetAddress(), prefix.GetMask()))
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.LookupResponse{}, status.Errorf(codes.Internal, "bad route %v: %v", prefix, err)
+	}
+
+	// The AS path and ROA status are left out if the router doesn't support them.
+	path, err := s.Aspath(ctx, &pb.AspathRequest{IpAddress: addr})
+	if err != nil && status.Code(err) != codes.Unimplemented {
+		return &pb.LookupResponse{}, err
+	}
+
+	// The origin is the last AS in the path. It only needs its own lookup
+	// when there is no path, or an AS set makes the origin unclear.
+	var origin uint32
+	if asns := path.GetAsn(); len(asns) > 0 && len(path.GetSet()) == 0 {
+		origin = asns[len(asns)-1].GetAsplain()
+	} else {
+		o, err := s.Origin(ctx, &pb.OriginRequest{IpAddress: addr})
+		if err != nil {
+			return &pb.LookupResponse{}, err
+		}
+		origin = o.GetOriginAsn()
+	}
+
+	var roa *pb.RoaResponse
+	if s.router.Capabilities().ROA {
+		roa, err = s.routeROA(ctx, ipnet, prefix.GetMask(), origin)
+		if err != nil {
+			return &pb.LookupResponse{}, err
+		}
+	}
+
+	resp := &pb.LookupResponse{
+		Prefix:        prefix,
+		Exists:        true,
+		Origin:        s.namedASN(ctx, origin),
+		RoaStatus:     roa.GetStatus(),
+		CacheTime:     uint64(time.Now().Unix()),
+		AnomalousPath: path.GetAnomalous(),
+	}
+	for i, asn := range path.GetAsn() {
+		// Looking up a name for every hop of an anomalous path is wasted effort.
+		if path.GetAnomalous() && i >= s.maxPathLength {
+			resp.AsPath = append(resp.AsPath, &pb.NamedAsn{
+				Asplain: asn.GetAsplain(),
+				Asdot:   asn.GetAsdot(),
+			})
+			continue
+		}
+		resp.AsPath = append(resp.AsPath, s.namedASN(ctx, asn.GetAsplain()))
+	}
+	for _, asn := range path.GetSet() {
+		resp.AsSet = append(resp.AsSet, s.namedASN(ctx, asn.GetAsplain()))
+	}
+
+	return resp, nil
+}
+
+// Subscribe sends a lookup for each IP address the client watches, then sends
+// it again whenever it changes. Watched lookups are checked each time a route
+// is cached, and on every refresh interval.
+func (s *server) Subscribe(stream pb.LookingGlass_SubscribeServer) error {
+	log.Printf("Running Subscribe")
+	defer com.TimeFunction(time.Now(), "Subscribe")
+	ctx := stream.Context()
+
+	reqs := make(chan *pb.SubscribeRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			r, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var refresh <-chan time.Time
+	if s.subscribeRefresh > 0 {
+		t := time.NewTicker(s.subscribeRefresh)
+		defer t.Stop()
+		refresh = t.C
+	}
+
+	// watching holds the last lookup sent for each address.
+	watching := make(map[string]*pb.LookupResponse)
+	updated := s.routeUpdates()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case r := <-reqs:
+			ip, err := requestIP(r.GetIpAddress())
+			if err != nil {
+				return err
+			}
+			addr := ip.String()
+			if r.GetRemove() {
+				delete(watching, addr)
+				continue
+			}
+			watching[addr] = nil
+			if err := s.sendLookup(stream, addr, watching); err != nil {
+				return err
+			}
+			continue
+		case <-updated:
+		case <-refresh:
+		}
+
+		// Taken before the lookups, so a route cached while they run isn't missed.
+		updated = s.routeUpdates()
+		for addr := range watching {
+			if err := s.sendLookup(stream, addr, watching); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+const (
+	// maxBulkLookups is the most addresses BulkLookup will look up in one request.
+	maxBulkLookups = 1000
+	// bulkLookupWorkers is how many lookups BulkLookup runs at once.
+	bulkLookupWorkers = 8
+)
+
+// BulkLookup looks up each address requested, sending each lookup as it's done,
+// so in no particular order. Duplicate addresses are only looked up and sent once.
+// An address that fails to look up is left out, as it is for Subscribe.
+func (s *server) BulkLookup(r *pb.BulkLookupRequest, stream pb.LookingGlass_BulkLookupServer) error {
+	log.Printf("Running BulkLookup")
+	defer com.TimeFunction(time.Now(), "BulkLookup")
+
+	if len(r.GetIpAddresses()) > maxBulkLookups {
+		return status.Errorf(codes.InvalidArgument, "%d addresses is more than the maximum of %d", len(r.GetIpAddresses()), maxBulkLookups)
+	}
+
+	// Addresses are compared as they're looked up, so 8.8.8.8 and 8.8.8.8/32 are the same.
+	seen := make(map[string]bool)
+	var addrs []*pb.IpAddress
+	for _, a := range r.GetIpAddresses() {
+		ip, err := requestIP(a)
+		if err != nil {
+			return err
+		}
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		addrs = append(addrs, a)
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	todo := make(chan *pb.IpAddress)
+	go func() {
+		defer close(todo)
+		for _, a := range addrs {
+			select {
+			case todo <- a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan *pb.LookupResponse)
+	var wg sync.WaitGroup
+	for i := 0; i < bulkLookupWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range todo {
+				resp, err := s.Lookup(ctx, &pb.LookupRequest{IpAddress: a})
+				if err != nil {
+					log.Printf("Unable to look up bulk address %s: %v", a.GetAddress(), err)
+					continue
+				}
+				resp.IpAddress = a
+				select {
+				case results <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for resp := range results {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// sendLookup looks up a watched address and sends the result if it's changed
+// since it was last sent. A failed lookup is tried again on the next check.
+func (s *server) sendLookup(stream pb.LookingGlass_SubscribeServer, addr string, watching map[string]*pb.LookupResponse) error {
+	ipAddress := &pb.IpAddress{Address: addr}
+	resp, err := s.Lookup(stream.Context(), &pb.LookupRequest{IpAddress: ipAddress})
+	if err != nil {
+		log.Printf("Unable to look up watched address %s: %v", addr, err)
+		return nil
+	}
+	if last := watching[addr]; last != nil && sameLookup(last, resp) {
+		return nil
+	}
+	resp.IpAddress = ipAddress
+	watching[addr] = resp
+	return stream.Send(resp)
+}
+
+// sameLookup returns true if two lookups have the same route, origin, AS path and ROA status.
+func sameLookup(a, b *pb.LookupResponse) bool {
+	if a.GetExists() != b.GetExists() ||
+		a.GetPrefix().GetAddress() != b.GetPrefix().GetAddress() ||
+		a.GetPrefix().GetMask() != b.GetPrefix().GetMask() ||
+		a.GetOrigin().GetAsplain() != b.GetOrigin().GetAsplain() ||
+		a.GetRoaStatus() != b.GetRoaStatus() ||
+		a.GetAnomalousPath() != b.GetAnomalousPath() ||
+		len(a.GetAsPath()) != len(b.GetAsPath()) ||
+		len(a.GetAsSet()) != len(b.GetAsSet()) {
+		return false
+	}
+	for i := range a.GetAsPath() {
+		if a.GetAsPath()[i].GetAsplain() != b.GetAsPath()[i].GetAsplain() {
+			return false
+		}
+	}
+	for i := range a.GetAsSet() {
+		if a.GetAsSet()[i].GetAsplain() != b.GetAsSet()[i].GetAsplain() {
+			return false
+		}
+	}
+	return true
+}
+
+// namedASN adds the name to an AS number. Names are nice to have, so a failed
+// lookup leaves the name empty rather than failing.
+func (s *server) namedASN(ctx context.Context, asn uint32) *pb.NamedAsn {
+	named := &pb.NamedAsn{
+		Asplain: asn,
+		Asdot:   com.ASPlainToASDot(asn),
+	}
+	if !com.ValidateASN(asn) {
+		return named
+	}
+	name, err := s.Asname(ctx, &pb.AsnameRequest{AsNumber: asn})
+	if err != nil {
+		log.Printf("Unable to get name for AS%d: %v", asn, err)
+		return named
+	}
+	named.AsName = name.GetAsName()
+	named.Locale = name.GetLocale()
+	return named
+}
+
+// sortPrefixes sorts prefixes by address family, then numerically by address, then by mask.
+func sortPrefixes(prefixes []*net.IPNet) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		a4, b4 := a.IP.To4() != nil, b.IP.To4() != nil
+		if a4 != b4 {
+			return a4
+		}
+		if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+			return c < 0
+		}
+		am, _ := a.Mask.Size()
+		bm, _ := b.Mask.Size()
+		return am < bm
+	})
+}
+
+// CompareOrigins will compare the prefixes originated by two ASNs.
+// Prefixes overlap if they are equal, or if one covers the other.
+func (s *server) CompareOrigins(ctx context.Context, r *pb.CompareRequest) (*pb.CompareResponse, error) {
+	log.Printf("Running CompareOrigins")
+	defer com.TimeFunction(time.Now(), "CompareOrigins")
+
+	// sourced validates and caches each ASN. The full set is needed for the comparison.
+	a, err := s.sourced(ctx, &pb.SourceRequest{AsNumber: r.GetAsnA()})
+	if err != nil {
+		return &pb.CompareResponse{}, err
+	}
+	b, err := s.sourced(ctx, &pb.SourceRequest{AsNumber: r.GetAsnB()})
+	if err != nil {
+		return &pb.CompareResponse{}, err
+	}
+
+	aNets, err := protoToIPNets(a.GetIpAddress())
+	if err != nil {
+		return &pb.CompareResponse{}, err
+	}
+	bNets, err := protoToIPNets(b.GetIpAddress())
+	if err != nil {
+		return &pb.CompareResponse{}, err
+	}
+
+	var resp pb.CompareResponse
+	bOverlaps := make([]bool, len(bNets))
+	for i, an := range aNets {
+		var overlaps bool
+		for j, bn := range bNets {
+			if an.Contains(bn.IP) || bn.Contains(an.IP) {
+				overlaps = true
+				bOverlaps[j] = true
+				resp.Common = append(resp.Common, &pb.PrefixOverlap{
+					A: a.GetIpAddress()[i],
+					B: b.GetIpAddress()[j],
+				})
+			}
+		}
+		if !overlaps {
+			resp.OnlyA = append(resp.OnlyA, a.GetIpAddress()[i])
+		}
+	}
+	for j, overlaps := range bOverlaps {
+		if !overlaps {
+			resp.OnlyB = append(resp.OnlyB, b.GetIpAddress()[j])
+		}
+	}
+	resp.CacheTime = uint64(time.Now().Unix())
+
+	return &resp, nil
+}
+
+// protoToIPNets converts proto IpAddresses to prefixes.
+func protoToIPNets(addresses []*pb.IpAddress) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0, len(addresses))
+	for _, address := range addresses {
+		_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", address.GetAddress(), address.GetMask()))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	return prefixes, nil
+}
+
+// maxExpectedPrefixes is the most expected prefixes OriginCheck will look up.
+const maxExpectedPrefixes = 1000
+
+// OriginCheck will compare the prefixes an ASN originates against the prefixes it is
+// expected to. Prefixes outside the expected set may be originated by someone claiming
+// to be the ASN, while expected prefixes with another origin may have been hijacked.
+func (s *server) OriginCheck(ctx context.Context, r *pb.OriginCheckRequest) (*pb.OriginCheckResponse, error) {
+	log.Printf("Running OriginCheck")
+	defer com.TimeFunction(time.Now(), "OriginCheck")
+
+	if len(r.GetExpected()) > maxExpectedPrefixes {
+		return &pb.OriginCheckResponse{}, status.Errorf(codes.InvalidArgument,
+			"%d expected prefixes is more than the maximum of %d", len(r.GetExpected()), maxExpectedPrefixes)
+	}
+	expected, err := protoToIPNets(r.GetExpected())
+	if err != nil {
+		return &pb.OriginCheckResponse{}, status.Errorf(codes.InvalidArgument, "invalid expected prefix: %v", err)
+	}
+
+	// sourced validates and caches the ASN. The full set is needed for the comparison.
+	sourced, err := s.sourced(ctx, &pb.SourceRequest{AsNumber: r.GetAsNumber()})
+	if err != nil {
+		return &pb.OriginCheckResponse{}, err
+	}
+	observed, err := protoToIPNets(sourced.GetIpAddress())
+	if err != nil {
+		return &pb.OriginCheckResponse{}, err
+	}
+
+	var resp pb.OriginCheckResponse
+	seen := make(map[string]bool)
+	for i, prefix := range observed {
+		seen[prefix.String()] = true
+		if !covered(prefix, expected) {
+			resp.Unexpected = append(resp.Unexpected, sourced.GetIpAddress()[i])
+		}
+	}
+
+	// An expected prefix not originated as is may still be covered by another
+	// of the ASN's routes, so check who originates the active route.
+	for i, prefix := range expected {
+		if seen[prefix.String()] {
+			continue
+		}
+		origin, exists, err := s.router.GetOriginFromIP(ctx, prefix.IP)
+		if err != nil {
+			log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+			return &pb.OriginCheckResponse{}, err
+		}
+		switch {
+		case !exists:
+			resp.Missing = append(resp.Missing, r.GetExpected()[i])
+		case origin != r.GetAsNumber():
+			resp.Conflicts = append(resp.Conflicts, &pb.OriginConflict{
+				Prefix:    r.GetExpected()[i],
+				OriginAsn: origin,
+			})
+		}
+	}
+	resp.CacheTime = uint64(time.Now().Unix())
+
+	return &resp, nil
+}
+
+// covered returns true if the prefix is the same as, or more specific than, any of the aggregates.
+func covered(prefix *net.IPNet, aggregates []*net.IPNet) bool {
+	ones, _ := prefix.Mask.Size()
+	for _, a := range aggregates {
+		aggOnes, _ := a.Mask.Size()
+		if aggOnes <= ones && a.Contains(prefix.IP) {
+			return true
+		}
 	}
-	if st.Code() == codes.Unavailable {
-		log.Printf("Server not available")
-		conn, err := dialGRPC(s.bgprpc)
+	return false
+}
+
+// AggregationCheck will return the prefixes an ASN originates which are already covered
+// by a shorter aggregate from the same ASN. If an IP address is passed instead of an ASN,
+// the origin ASN of that address is checked.
+func (s *server) AggregationCheck(ctx context.Context, r *pb.AggregationRequest) (*pb.AggregationResponse, error) {
+	log.Printf("Running AggregationCheck")
+	defer com.TimeFunction(time.Now(), "AggregationCheck")
+
+	asn := r.GetAsNumber()
+	if asn == 0 && r.GetIpAddress().GetAddress() != "" {
+		ip, err := com.ValidateIP(r.GetIpAddress().GetAddress())
+		if err != nil {
+			return &pb.AggregationResponse{}, err
+		}
+		origin, exists, err := s.router.GetOriginFromIP(ctx, ip)
 		if err != nil {
-			log.Printf("Still unable to reconnect to gRPC server: %v", err)
+			log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+			return &pb.AggregationResponse{}, err
+		}
+		if !exists {
+			return &pb.AggregationResponse{}, nil
 		}
-		s.bsql = conn
+		asn = origin
+	}
+
+	if !com.ValidateASN(asn) {
+		return &pb.AggregationResponse{}, fmt.Errorf("Invalid AS number")
+	}
+
+	v4, err := s.router.GetIPv4FromSource(ctx, asn)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.AggregationResponse{}, fmt.Errorf("Error on getting IPv4 from source: %w", err)
+	}
+	v6, err := s.router.GetIPv6FromSource(ctx, asn)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.AggregationResponse{}, fmt.Errorf("Error on getting IPv6 from source: %w", err)
+	}
+	if len(v4)+len(v6) == 0 {
+		return &pb.AggregationResponse{AsNumber: asn}, nil
+	}
+
+	return &pb.AggregationResponse{
+		AsNumber:   asn,
+		Aggregates: append(findAggregates(v4), findAggregates(v6)...),
+		Exists:     true,
+		CacheTime:  uint64(time.Now().Unix()),
+	}, nil
+}
+
+// findAggregates groups each prefix under the shortest other prefix in the list that covers it.
+// All prefixes must be of the same address family.
+func findAggregates(prefixes []*net.IPNet) []*pb.Aggregate {
+	sortPrefixes(prefixes)
+
+	var aggregates []*net.IPNet
+	specifics := make(map[*net.IPNet][]*net.IPNet)
+	for _, p := range prefixes {
+		pm, _ := p.Mask.Size()
+		for _, agg := range prefixes {
+			am, _ := agg.Mask.Size()
+			if am >= pm || !agg.Contains(p.IP) {
+				continue
+			}
+			// prefixes are sorted, so the first covering prefix found is the shortest.
+			if _, ok := specifics[agg]; !ok {
+				aggregates = append(aggregates, agg)
+			}
+			specifics[agg] = append(specifics[agg], p)
+			break
+		}
+	}
+
+	var found []*pb.Aggregate
+	for _, agg := range aggregates {
+		a := &pb.Aggregate{
+			Aggregate: ipnetToProto(agg),
+			Complete:  isCovered(agg, specifics[agg]),
+		}
+		for _, p := range specifics[agg] {
+			a.MoreSpecifics = append(a.MoreSpecifics, ipnetToProto(p))
+		}
+		found = append(found, a)
+	}
+
+	return found
+}
+
+// isCovered returns true if the prefix is entirely covered by the list of more specifics.
+func isCovered(prefix *net.IPNet, specifics []*net.IPNet) bool {
+	pm, _ := prefix.Mask.Size()
+	var inside []*net.IPNet
+	for _, s := range specifics {
+		sm, _ := s.Mask.Size()
+		if sm == pm && s.IP.Equal(prefix.IP) {
+			return true
+		}
+		if sm > pm && prefix.Contains(s.IP) {
+			inside = append(inside, s)
+		}
+	}
+	if len(inside) == 0 {
+		return false
+	}
+
+	low, high := splitPrefix(prefix)
+	return isCovered(low, inside) && isCovered(high, inside)
+}
+
+// splitPrefix returns both halves of a prefix. It must not be a host prefix.
+func splitPrefix(prefix *net.IPNet) (*net.IPNet, *net.IPNet) {
+	ones, bits := prefix.Mask.Size()
+	ip := prefix.IP.To16()
+	if bits == 32 {
+		ip = prefix.IP.To4()
+	}
+	mask := net.CIDRMask(ones+1, bits)
+
+	low := ip.Mask(mask)
+	high := make(net.IP, len(low))
+	copy(high, low)
+	high[ones/8] |= 0x80 >> (ones % 8)
+
+	return &net.IPNet{IP: low, Mask: mask}, &net.IPNet{IP: high, Mask: mask}
+}
+
+// ipnetToProto converts a prefix to the proto IpAddress.
+func ipnetToProto(prefix *net.IPNet) *pb.IpAddress {
+	mask, _ := prefix.Mask.Size()
+	return &pb.IpAddress{
+		Address: prefix.IP.String(),
+		Mask:    uint32(mask),
 	}
 }
 
@@ -692,7 +2048,7 @@ func (s *server) warmCache() {
 // the location response with a base64 encoded version of the image.
 func (s *server) addMap(ctx context.Context, r *pb.LocationResponse) error {
 	// check local cache first
-	cor := fmt.Sprintf("%s%s", r.GetLat(), r.GetLong())
+	cor := mapKey(r.GetLat(), r.GetLong())
 	cmap, ok := s.checkMapCache(cor)
 	if ok {
 		r.Image = cmap
@@ -1,10 +1,111 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	cli "github.com/mellowdrifter/bgp_infrastructure/clidecode"
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"gopkg.in/ini.v1"
 )
 
+// fakeRouter is a decoder returning canned data for handler tests.
+type fakeRouter struct {
+	cli.FakeConn
+	v4, v6       []*net.IPNet
+	v4Err, v6Err error
+	route        *net.IPNet
+	filtered     *net.IPNet
+	origin       uint32
+	path         cli.ASPath
+	since        time.Time
+	communities  cli.Communities
+	nextHop      cli.NextHop
+	pingErr      error
+	// slow makes GetRoute wait until the context is done.
+	slow bool
+}
+
+func (f fakeRouter) Ping(context.Context) error {
+	return f.pingErr
+}
+
+func (f fakeRouter) GetRoute(ctx context.Context, ip net.IP) (*net.IPNet, bool, error) {
+	if f.slow {
+		<-ctx.Done()
+		return nil, false, ctx.Err()
+	}
+	return f.route, f.route != nil, nil
+}
+
+func (f fakeRouter) GetFilteredRoute(context.Context, net.IP) (*net.IPNet, bool, error) {
+	return f.filtered, f.filtered != nil, nil
+}
+
+func (f fakeRouter) GetASPathFromIP(context.Context, net.IP) (cli.ASPath, bool, error) {
+	return f.path, len(f.path.Path) > 0, nil
+}
+
+func (f fakeRouter) GetOriginFromIP(context.Context, net.IP) (uint32, bool, error) {
+	return f.origin, f.origin != 0, nil
+}
+
+func (f fakeRouter) GetRouteSince(context.Context, net.IP) (time.Time, bool, error) {
+	return f.since, !f.since.IsZero(), nil
+}
+
+func (f fakeRouter) GetCommunities(context.Context, net.IP) (cli.Communities, bool, error) {
+	return f.communities, f.route != nil, nil
+}
+
+func (f fakeRouter) GetNextHop(context.Context, net.IP) (cli.NextHop, bool, error) {
+	return f.nextHop, f.route != nil, nil
+}
+
+func (f fakeRouter) GetIPv4FromSource(context.Context, uint32) ([]*net.IPNet, error) {
+	return f.v4, f.v4Err
+}
+
+func (f fakeRouter) GetIPv6FromSource(context.Context, uint32) ([]*net.IPNet, error) {
+	return f.v6, f.v6Err
+}
+
+func getTestServer(router cli.Decoder) *server {
+	return &server{
+		router: router,
+		mu:     &sync.RWMutex{},
+		cache:  getNewCache(),
+	}
+}
+
+func parseCIDRs(t *testing.T, prefixes ...string) []*net.IPNet {
+	t.Helper()
+	var nets []*net.IPNet
+	for _, p := range prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
 func TestLoadAirports(t *testing.T) {
 	t.Parallel()
 	airFile := "/home/mellowd/go/src/github.com/mellowdrifter/bgp_infrastructure/glass/airports/airports.dat"
@@ -68,3 +169,1506 @@ func TestLoadAirports(t *testing.T) {
 	}
 
 }
+
+func TestSortPrefixes(t *testing.T) {
+	prefixes := parseCIDRs(t,
+		"2001:db8::/48",
+		"9.0.0.0/8",
+		"10.0.0.0/16",
+		"2001:db8::/32",
+		"10.0.0.0/8",
+		"1.1.1.0/24",
+		"2000::/3",
+	)
+	sortPrefixes(prefixes)
+
+	want := []string{
+		"1.1.1.0/24",
+		"9.0.0.0/8",
+		"10.0.0.0/8",
+		"10.0.0.0/16",
+		"2000::/3",
+		"2001:db8::/32",
+		"2001:db8::/48",
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSourcedSorted(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		v4: parseCIDRs(t, "10.0.0.0/8", "9.0.0.0/8", "9.0.0.0/16"),
+		v6: parseCIDRs(t, "2001:db8:1::/48", "2001:db8::/48"),
+	})
+
+	resp, err := srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*pb.IpAddress{
+		{Address: "9.0.0.0", Mask: 8},
+		{Address: "9.0.0.0", Mask: 16},
+		{Address: "10.0.0.0", Mask: 8},
+		{Address: "2001:db8::", Mask: 48},
+		{Address: "2001:db8:1::", Mask: 48},
+	}
+	if !reflect.DeepEqual(resp.GetIpAddress(), want) {
+		t.Errorf("got %v, want %v", resp.GetIpAddress(), want)
+	}
+}
+
+func TestRouteAge(t *testing.T) {
+	since := time.Now().Add(-time.Hour)
+	srv := getTestServer(fakeRouter{
+		route: parseCIDRs(t, "8.8.8.0/24")[0],
+		since: since,
+	})
+
+	resp, err := srv.Route(context.Background(), &pb.RouteRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetLastChange() != uint64(since.Unix()) {
+		t.Errorf("got last change %d, want %d", resp.GetLastChange(), since.Unix())
+	}
+	if resp.GetAge() < 3600 || resp.GetAge() > 3660 {
+		t.Errorf("got age %d, want roughly 3600", resp.GetAge())
+	}
+
+	// No last change time exposed, so no age either.
+	srv = getTestServer(fakeRouter{
+		route: parseCIDRs(t, "8.8.8.0/24")[0],
+	})
+	resp, err = srv.Route(context.Background(), &pb.RouteRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAge() != 0 || resp.GetLastChange() != 0 {
+		t.Errorf("expected no age, got age %d and last change %d", resp.GetAge(), resp.GetLastChange())
+	}
+}
+
+func TestAsnameFromFile(t *testing.T) {
+	names := `<pre>
+<a href="/cgi-bin/as-report?as=AS49&view=2.0">AS49   </a> US-NATIONAL-INSTITUTE-OF-STANDARDS-AND-TECHNOLOGY, US
+<a href="/cgi-bin/as-report?as=AS16030&view=2.0">AS16030</a> ALTECOM, ES
+</pre>`
+	asnFile := filepath.Join(t.TempDir(), "autnums.html")
+	if err := ioutil.WriteFile(asnFile, []byte(names), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadASNames(asnFile)
+	if err != nil {
+		t.Fatalf("loadASNames() error: %v", err)
+	}
+
+	// No bgpsql connection, so names can only come from the file.
+	srv := getTestServer(fakeRouter{})
+	srv.updateASNFile(loaded)
+
+	tests := []struct {
+		asn    uint32
+		name   string
+		locale string
+		exists bool
+	}{
+		{
+			asn:    16030,
+			name:   "ALTECOM",
+			locale: "ES",
+			exists: true,
+		},
+		{
+			asn:    49,
+			name:   "US-NATIONAL-INSTITUTE-OF-STANDARDS-AND-TECHNOLOGY",
+			locale: "US",
+			exists: true,
+		},
+		{
+			asn: 3356,
+		},
+	}
+	for _, tc := range tests {
+		got, err := srv.Asname(context.Background(), &pb.AsnameRequest{AsNumber: tc.asn})
+		if err != nil {
+			t.Fatalf("Asname(%d) error: %v", tc.asn, err)
+		}
+		if got.GetAsName() != tc.name || got.GetLocale() != tc.locale || got.GetExists() != tc.exists {
+			t.Errorf("Asname(%d) = %q, %q, %t. Want %q, %q, %t", tc.asn,
+				got.GetAsName(), got.GetLocale(), got.GetExists(), tc.name, tc.locale, tc.exists)
+		}
+	}
+}
+
+func TestAggregationCheck(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		v4: parseCIDRs(t, "192.0.3.0/24", "192.0.2.0/23", "198.51.100.0/24", "192.0.2.0/24"),
+		v6: parseCIDRs(t, "2001:db8::/32", "2001:db8:1::/48"),
+	})
+
+	resp, err := srv.AggregationCheck(context.Background(), &pb.AggregationRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*pb.Aggregate{
+		{
+			Aggregate: &pb.IpAddress{Address: "192.0.2.0", Mask: 23},
+			MoreSpecifics: []*pb.IpAddress{
+				{Address: "192.0.2.0", Mask: 24},
+				{Address: "192.0.3.0", Mask: 24},
+			},
+			Complete: true,
+		},
+		{
+			Aggregate: &pb.IpAddress{Address: "2001:db8::", Mask: 32},
+			MoreSpecifics: []*pb.IpAddress{
+				{Address: "2001:db8:1::", Mask: 48},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp.GetAggregates(), want) {
+		t.Errorf("got %v, want %v", resp.GetAggregates(), want)
+	}
+}
+
+func TestRouteCoveringCache(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		route: parseCIDRs(t, "8.8.8.0/24")[0],
+	})
+	if _, err := srv.Route(context.Background(), &pb.RouteRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The router no longer has the route, so only the cache can answer.
+	srv.router = fakeRouter{}
+	resp, err := srv.Route(context.Background(), &pb.RouteRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.IpAddress{Address: "8.8.8.0", Mask: 24}
+	if !resp.GetExists() || !reflect.DeepEqual(resp.GetIpAddress(), want) {
+		t.Errorf("got %v, want cached %v", resp.GetIpAddress(), want)
+	}
+}
+
+func TestAsnameValidation(t *testing.T) {
+	srv := getTestServer(fakeRouter{})
+	srv.updateASNFile(map[uint32]pb.AsnameResponse{
+		15169: {AsName: "GOOGLE", Locale: "US", Exists: true},
+	})
+
+	var tests = []struct {
+		asn  uint32
+		code codes.Code
+	}{
+		{asn: 0, code: codes.InvalidArgument},
+		{asn: 23456, code: codes.InvalidArgument},
+		{asn: 64512, code: codes.InvalidArgument},
+		{asn: 15169, code: codes.OK},
+	}
+	for _, tc := range tests {
+		_, err := srv.Asname(context.Background(), &pb.AsnameRequest{AsNumber: tc.asn})
+		if status.Code(err) != tc.code {
+			t.Errorf("Asname(%d) got code %v, want %v", tc.asn, status.Code(err), tc.code)
+		}
+	}
+
+	// Invalid numbers should never reach the cache.
+	if len(srv.asNameCache) != 0 {
+		t.Errorf("expected an empty cache, but got %d entries", len(srv.asNameCache))
+	}
+}
+
+func TestCompareOrigins(t *testing.T) {
+	// Both ASNs are already cached, so the router is never asked.
+	srv := getTestServer(fakeRouter{})
+	srv.updateSourcedCache(15169, pb.SourceResponse{
+		IpAddress: []*pb.IpAddress{
+			{Address: "8.8.8.0", Mask: 24},
+			{Address: "192.0.2.0", Mask: 24},
+			{Address: "198.51.100.0", Mask: 24},
+			{Address: "2001:db8::", Mask: 32},
+		},
+		Exists: true,
+	})
+	srv.updateSourcedCache(13335, pb.SourceResponse{
+		IpAddress: []*pb.IpAddress{
+			{Address: "8.8.8.0", Mask: 24},
+			{Address: "192.0.0.0", Mask: 16},
+			{Address: "203.0.113.0", Mask: 24},
+			{Address: "2001:db8:1::", Mask: 48},
+		},
+		Exists: true,
+	})
+
+	resp, err := srv.CompareOrigins(context.Background(), &pb.CompareRequest{AsnA: 15169, AsnB: 13335})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	common := []*pb.PrefixOverlap{
+		{A: &pb.IpAddress{Address: "8.8.8.0", Mask: 24}, B: &pb.IpAddress{Address: "8.8.8.0", Mask: 24}},
+		{A: &pb.IpAddress{Address: "192.0.2.0", Mask: 24}, B: &pb.IpAddress{Address: "192.0.0.0", Mask: 16}},
+		{A: &pb.IpAddress{Address: "2001:db8::", Mask: 32}, B: &pb.IpAddress{Address: "2001:db8:1::", Mask: 48}},
+	}
+	onlyA := []*pb.IpAddress{{Address: "198.51.100.0", Mask: 24}}
+	onlyB := []*pb.IpAddress{{Address: "203.0.113.0", Mask: 24}}
+
+	if !reflect.DeepEqual(resp.GetCommon(), common) {
+		t.Errorf("got common %v, want %v", resp.GetCommon(), common)
+	}
+	if !reflect.DeepEqual(resp.GetOnlyA(), onlyA) {
+		t.Errorf("got only A %v, want %v", resp.GetOnlyA(), onlyA)
+	}
+	if !reflect.DeepEqual(resp.GetOnlyB(), onlyB) {
+		t.Errorf("got only B %v, want %v", resp.GetOnlyB(), onlyB)
+	}
+}
+
+func TestRouteCancelled(t *testing.T) {
+	srv := getTestServer(fakeRouter{slow: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		_, err := srv.Route(ctx, &pb.RouteRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Route did not return after the context was done")
+	}
+}
+
+func TestRouteDiagnose(t *testing.T) {
+	var tests = []struct {
+		name     string
+		router   cli.Decoder
+		diagnose bool
+		filtered bool
+		prefix   string
+	}{
+		{
+			name:     "filtered",
+			router:   fakeRouter{filtered: parseCIDRs(t, "8.8.8.0/25")[0]},
+			diagnose: true,
+			filtered: true,
+			prefix:   "8.8.8.0/25",
+		},
+		{
+			name:     "absent",
+			router:   fakeRouter{},
+			diagnose: true,
+		},
+		{
+			name:   "filtered, not diagnosed",
+			router: fakeRouter{filtered: parseCIDRs(t, "8.8.8.0/25")[0]},
+		},
+		{
+			name:     "filtered, not supported",
+			router:   limitedRouter{fakeRouter{filtered: parseCIDRs(t, "8.8.8.0/25")[0]}},
+			diagnose: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := getTestServer(tc.router)
+			resp, err := srv.Route(context.Background(), &pb.RouteRequest{
+				IpAddress: &pb.IpAddress{Address: "8.8.8.8"},
+				Diagnose:  tc.diagnose,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetExists() {
+				t.Error("got an active route, want none")
+			}
+			if resp.GetFiltered() != tc.filtered {
+				t.Errorf("got filtered %t, want %t", resp.GetFiltered(), tc.filtered)
+			}
+			if !tc.filtered {
+				return
+			}
+			if got := fmt.Sprintf("%s/%d", resp.GetIpAddress().GetAddress(), resp.GetIpAddress().GetMask()); got != tc.prefix {
+				t.Errorf("got filtered prefix %s, want %s", got, tc.prefix)
+			}
+		})
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	logfile := filepath.Join(t.TempDir(), "glass.log")
+	var tests = []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:   "Good config",
+			config: "[log]\nlogfile = " + logfile + "\n[local]\ndaemon = bird2\n",
+		},
+		{
+			name:    "Missing daemon",
+			config:  "[log]\nlogfile = " + logfile + "\n",
+			wantErr: `missing required key "daemon" in section [local]`,
+		},
+		{
+			name:    "Bad refresh",
+			config:  "[log]\nlogfile = " + logfile + "\n[local]\ndaemon = bird2\n[asnames]\nrefresh = daily\n",
+			wantErr: `[asnames] refresh: "daily" is not a valid duration`,
+		},
+		{
+			name:    "Bad cache age",
+			config:  "[log]\nlogfile = " + logfile + "\n[local]\ndaemon = bird2\n[cache]\nroute_age = soon\n",
+			wantErr: `[cache] route_age: "soon" is not a valid duration`,
+		},
+		{
+			name:    "Client CA without a certificate",
+			config:  "[log]\nlogfile = " + logfile + "\n[local]\ndaemon = bird2\n[tls]\nclient_ca = glass_test.go\n",
+			wantErr: `missing required key "cert" in section [tls]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cf, err := ini.Load([]byte(tc.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkConfig(cf)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSourcedPartial(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		v4:    parseCIDRs(t, "8.8.8.0/24"),
+		v6Err: errors.New("v6 table unavailable"),
+	})
+
+	// Without opting in, any failure is an error.
+	if _, err := srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169}); err == nil {
+		t.Error("expected an error when partial results are not allowed")
+	}
+
+	resp, err := srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169, AllowPartial: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetPartial() || !strings.Contains(resp.GetPartialReason(), "IPv6") {
+		t.Errorf("expected a partial response noting IPv6, got partial %t: %q", resp.GetPartial(), resp.GetPartialReason())
+	}
+	want := []*pb.IpAddress{{Address: "8.8.8.0", Mask: 24}}
+	if !reflect.DeepEqual(resp.GetIpAddress(), want) {
+		t.Errorf("got %v, want %v", resp.GetIpAddress(), want)
+	}
+
+	// Partial results are not cached.
+	if _, ok := srv.checkSourcedCache(15169); ok {
+		t.Error("partial result should not be cached")
+	}
+}
+
+func TestSourcedTruncated(t *testing.T) {
+	// 300 IPv4 and 10 IPv6 prefixes.
+	var v4, v6 []*net.IPNet
+	for i := 0; i < 300; i++ {
+		v4 = append(v4, &net.IPNet{IP: net.IPv4(8, 8, byte(i/256), byte(i%256)).To4(), Mask: net.CIDRMask(32, 32)})
+	}
+	for i := 0; i < 10; i++ {
+		v6 = append(v6, &net.IPNet{IP: net.ParseIP(fmt.Sprintf("2001:4860:%x::", i)), Mask: net.CIDRMask(48, 128)})
+	}
+	srv := getTestServer(fakeRouter{v4: v4, v6: v6})
+	srv.maxPrefixes = 100
+
+	resp, err := srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetTruncated() {
+		t.Error("expected the response to be truncated")
+	}
+	if len(resp.GetIpAddress()) != 100 {
+		t.Errorf("got %d prefixes, want 100", len(resp.GetIpAddress()))
+	}
+	if resp.GetV4Count() != 300 || resp.GetV6Count() != 10 {
+		t.Errorf("got counts %d/%d, want the full counts of 300/10", resp.GetV4Count(), resp.GetV6Count())
+	}
+
+	// The cache holds the full set, and a cached response is truncated the same way.
+	cached, ok := srv.checkSourcedCache(15169)
+	if !ok || len(cached.GetIpAddress()) != 310 {
+		t.Errorf("expected all 310 prefixes to be cached, got %d", len(cached.GetIpAddress()))
+	}
+	resp, err = srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetTruncated() || len(resp.GetIpAddress()) != 100 {
+		t.Errorf("cached response: got truncated %t with %d prefixes", resp.GetTruncated(), len(resp.GetIpAddress()))
+	}
+
+	// No limit returns everything.
+	srv.maxPrefixes = 0
+	resp, err = srv.Sourced(context.Background(), &pb.SourceRequest{AsNumber: 15169})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetTruncated() || len(resp.GetIpAddress()) != 310 {
+		t.Errorf("no limit: got truncated %t with %d prefixes", resp.GetTruncated(), len(resp.GetIpAddress()))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		route:  parseCIDRs(t, "1.1.1.0/24")[0],
+		origin: 13335,
+		path: cli.ASPath{
+			Path: []uint32{3356, 13335},
+			Set:  []uint32{394536},
+		},
+	})
+	srv.updateASNFile(map[uint32]pb.AsnameResponse{
+		3356:  {AsName: "LEVEL3", Locale: "US", Exists: true},
+		13335: {AsName: "CLOUDFLARENET", Locale: "US", Exists: true},
+	})
+
+	resp, err := srv.Lookup(context.Background(), &pb.LookupRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !resp.GetExists() {
+		t.Fatal("expected the route to exist")
+	}
+	if resp.GetPrefix().GetAddress() != "1.1.1.0" || resp.GetPrefix().GetMask() != 24 {
+		t.Errorf("got prefix %v, want 1.1.1.0/24", resp.GetPrefix())
+	}
+	if resp.GetOrigin().GetAsplain() != 13335 || resp.GetOrigin().GetAsName() != "CLOUDFLARENET" {
+		t.Errorf("got origin %v, want AS13335 CLOUDFLARENET", resp.GetOrigin())
+	}
+	if resp.GetRoaStatus() != pb.RoaResponse_UNKNOWN {
+		t.Errorf("got ROA status %v, want UNKNOWN", resp.GetRoaStatus())
+	}
+
+	var path []string
+	for _, asn := range resp.GetAsPath() {
+		path = append(path, fmt.Sprintf("%d %s %s", asn.GetAsplain(), asn.GetAsName(), asn.GetLocale()))
+	}
+	want := []string{"3356 LEVEL3 US", "13335 CLOUDFLARENET US"}
+	if !reflect.DeepEqual(path, want) {
+		t.Errorf("got path %v, want %v", path, want)
+	}
+
+	// Names that can't be found are left empty.
+	if len(resp.GetAsSet()) != 1 || resp.GetAsSet()[0].GetAsdot() != "6.1320" || resp.GetAsSet()[0].GetAsName() != "" {
+		t.Errorf("got set %v, want AS6.1320 with no name", resp.GetAsSet())
+	}
+
+	// A masked request gets the route, path and origin of the prefix it asks
+	// for, even with a more-specific route from another origin covering the address.
+	srv = getTestServer(specificRouter{
+		fakeRouter: fakeRouter{
+			route:  parseCIDRs(t, "1.1.1.0/24")[0],
+			origin: 13335,
+			path:   cli.ASPath{Path: []uint32{3356, 13335}},
+		},
+		specific:       parseCIDRs(t, "1.1.1.128/25")[0],
+		specificOrigin: 6939,
+		specificPath:   cli.ASPath{Path: []uint32{174, 6939}},
+	})
+	resp, err = srv.Lookup(context.Background(), &pb.LookupRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.200", Mask: 24}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetPrefix().GetAddress() != "1.1.1.0" || resp.GetPrefix().GetMask() != 24 {
+		t.Errorf("got prefix %v, want 1.1.1.0/24", resp.GetPrefix())
+	}
+	if resp.GetOrigin().GetAsplain() != 13335 {
+		t.Errorf("got origin %v, want AS13335", resp.GetOrigin())
+	}
+	path = nil
+	for _, asn := range resp.GetAsPath() {
+		path = append(path, fmt.Sprint(asn.GetAsplain()))
+	}
+	if want := []string{"3356", "13335"}; !reflect.DeepEqual(path, want) {
+		t.Errorf("got path %v, want %v", path, want)
+	}
+
+	// No route returns nothing, but no error.
+	srv = getTestServer(fakeRouter{})
+	resp, err = srv.Lookup(context.Background(), &pb.LookupRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}})
+	if err != nil || resp.GetExists() {
+		t.Errorf("got %v, %v, want an empty response", resp, err)
+	}
+}
+
+// specificRouter has a more-specific route, with its own origin and path,
+// within the covering route.
+type specificRouter struct {
+	fakeRouter
+	specific       *net.IPNet
+	specificOrigin uint32
+	specificPath   cli.ASPath
+}
+
+func (f specificRouter) GetRoute(ctx context.Context, ip net.IP) (*net.IPNet, bool, error) {
+	if f.specific.Contains(ip) {
+		return f.specific, true, nil
+	}
+	return f.fakeRouter.GetRoute(ctx, ip)
+}
+
+func (f specificRouter) GetOriginFromIP(ctx context.Context, ip net.IP) (uint32, bool, error) {
+	if f.specific.Contains(ip) {
+		return f.specificOrigin, true, nil
+	}
+	return f.fakeRouter.GetOriginFromIP(ctx, ip)
+}
+
+func (f specificRouter) GetASPathFromIP(ctx context.Context, ip net.IP) (cli.ASPath, bool, error) {
+	if f.specific.Contains(ip) {
+		return f.specificPath, true, nil
+	}
+	return f.fakeRouter.GetASPathFromIP(ctx, ip)
+}
+
+func TestAnomalousPath(t *testing.T) {
+	// Prepending gives a long path of only a few ASNs.
+	hops := []uint32{3356, 2906, 6939}
+	var path []uint32
+	for i := 0; i < 299; i++ {
+		path = append(path, hops[i%len(hops)])
+	}
+	path = append(path, 15169)
+
+	srv := getTestServer(fakeRouter{
+		route:  parseCIDRs(t, "8.8.8.0/24")[0],
+		origin: 15169,
+		path:   cli.ASPath{Path: path},
+	})
+	srv.maxPathLength = 50
+	srv.updateASNFile(map[uint32]pb.AsnameResponse{
+		2906:  {AsName: "AS-SSI", Locale: "US", Exists: true},
+		3356:  {AsName: "LEVEL3", Locale: "US", Exists: true},
+		6939:  {AsName: "HURRICANE", Locale: "US", Exists: true},
+		15169: {AsName: "GOOGLE", Locale: "US", Exists: true},
+	})
+	ip := &pb.IpAddress{Address: "8.8.8.8"}
+
+	// The raw path is still returned in full.
+	aspath, err := srv.Aspath(context.Background(), &pb.AspathRequest{IpAddress: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aspath.GetAnomalous() || len(aspath.GetAsn()) != 300 {
+		t.Errorf("got anomalous %t with %d hops, want an anomalous 300 hop path", aspath.GetAnomalous(), len(aspath.GetAsn()))
+	}
+
+	// Names are only added up to the maximum length.
+	resp, err := srv.Lookup(context.Background(), &pb.LookupRequest{IpAddress: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetAnomalousPath() || len(resp.GetAsPath()) != 300 {
+		t.Fatalf("got anomalous %t with %d hops, want an anomalous 300 hop path", resp.GetAnomalousPath(), len(resp.GetAsPath()))
+	}
+	var named int
+	for _, asn := range resp.GetAsPath() {
+		if asn.GetAsName() != "" {
+			named++
+		}
+	}
+	if named != srv.maxPathLength {
+		t.Errorf("got %d named hops, want %d", named, srv.maxPathLength)
+	}
+
+	// A path within the maximum is not anomalous.
+	srv = getTestServer(fakeRouter{path: cli.ASPath{Path: []uint32{3356, 15169}}})
+	srv.maxPathLength = 50
+	aspath, err = srv.Aspath(context.Background(), &pb.AspathRequest{IpAddress: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aspath.GetAnomalous() {
+		t.Errorf("a two hop path was flagged as anomalous")
+	}
+}
+
+// roaRouter is valid only for one route and origin.
+type roaRouter struct {
+	fakeRouter
+}
+
+func (f roaRouter) GetROA(ctx context.Context, prefix *net.IPNet, asn uint32) (int, bool, error) {
+	if prefix.String() == f.route.String() && asn == f.origin {
+		return cli.RValid, true, nil
+	}
+	return cli.RInvalid, true, nil
+}
+
+func TestRequestPrefix(t *testing.T) {
+	var tests = []struct {
+		name    string
+		addr    *pb.IpAddress
+		wantErr bool
+	}{
+		{
+			name: "Bare IP",
+			addr: &pb.IpAddress{Address: "8.8.8.8"},
+		},
+		{
+			name: "CIDR",
+			addr: &pb.IpAddress{Address: "8.8.8.0/24"},
+		},
+		{
+			name: "Mask set",
+			addr: &pb.IpAddress{Address: "8.8.8.0", Mask: 24},
+		},
+		{
+			name: "Host bits set",
+			addr: &pb.IpAddress{Address: "8.8.8.77", Mask: 25},
+		},
+		{
+			name:    "IPv4 mask too long",
+			addr:    &pb.IpAddress{Address: "8.8.8.0", Mask: 33},
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 mask too long",
+			addr:    &pb.IpAddress{Address: "2001:4860::/129"},
+			wantErr: true,
+		},
+		{
+			name:    "Bad mask",
+			addr:    &pb.IpAddress{Address: "8.8.8.0/abc"},
+			wantErr: true,
+		},
+		{
+			name:    "Not public once masked",
+			addr:    &pb.IpAddress{Address: "8.8.8.8/1"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := getTestServer(roaRouter{fakeRouter{
+				route:  parseCIDRs(t, "8.8.8.0/24")[0],
+				origin: 15169,
+				path:   cli.ASPath{Path: []uint32{3356, 15169}},
+			}})
+
+			route, err := srv.Route(context.Background(), &pb.RouteRequest{IpAddress: tc.addr})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Route: got error %v, wantErr %t", err, tc.wantErr)
+			}
+			roa, roaErr := srv.Roa(context.Background(), &pb.RoaRequest{IpAddress: tc.addr})
+			if (roaErr != nil) != tc.wantErr {
+				t.Fatalf("Roa: got error %v, wantErr %t", roaErr, tc.wantErr)
+			}
+			path, pathErr := srv.Aspath(context.Background(), &pb.AspathRequest{IpAddress: tc.addr})
+			if (pathErr != nil) != tc.wantErr {
+				t.Fatalf("Aspath: got error %v, wantErr %t", pathErr, tc.wantErr)
+			}
+			length, lengthErr := srv.AspathLength(context.Background(), &pb.AspathRequest{IpAddress: tc.addr})
+			if (lengthErr != nil) != tc.wantErr {
+				t.Fatalf("AspathLength: got error %v, wantErr %t", lengthErr, tc.wantErr)
+			}
+			if tc.wantErr {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("got error %v, want an invalid argument", err)
+				}
+				return
+			}
+
+			// Every form gives the same route, ROA status and AS path.
+			if got := route.GetIpAddress(); got.GetAddress() != "8.8.8.0" || got.GetMask() != 24 {
+				t.Errorf("got route %v, want 8.8.8.0/24", got)
+			}
+			if roa.GetStatus() != pb.RoaResponse_VALID {
+				t.Errorf("got ROA status %v, want VALID", roa.GetStatus())
+			}
+			if len(path.GetAsn()) != 2 || length.GetLength() != 2 {
+				t.Errorf("got AS path %v of length %d, want 2 hops", path.GetAsn(), length.GetLength())
+			}
+		})
+	}
+}
+
+// countingRouter counts the calls made to each router lookup.
+type countingRouter struct {
+	fakeRouter
+	mu    *sync.Mutex
+	calls map[string]int
+}
+
+func (f countingRouter) count(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[name]++
+}
+
+func (f countingRouter) GetRoute(ctx context.Context, ip net.IP) (*net.IPNet, bool, error) {
+	f.count("GetRoute")
+	return f.fakeRouter.GetRoute(ctx, ip)
+}
+
+func (f countingRouter) GetRouteSince(ctx context.Context, ip net.IP) (time.Time, bool, error) {
+	f.count("GetRouteSince")
+	return f.fakeRouter.GetRouteSince(ctx, ip)
+}
+
+func (f countingRouter) GetOriginFromIP(ctx context.Context, ip net.IP) (uint32, bool, error) {
+	f.count("GetOriginFromIP")
+	return f.fakeRouter.GetOriginFromIP(ctx, ip)
+}
+
+func (f countingRouter) GetASPathFromIP(ctx context.Context, ip net.IP) (cli.ASPath, bool, error) {
+	f.count("GetASPathFromIP")
+	return f.fakeRouter.GetASPathFromIP(ctx, ip)
+}
+
+func (f countingRouter) GetROA(ctx context.Context, prefix *net.IPNet, asn uint32) (int, bool, error) {
+	f.count("GetROA")
+	return f.fakeRouter.GetROA(ctx, prefix, asn)
+}
+
+func (f countingRouter) GetCommunities(ctx context.Context, ip net.IP) (cli.Communities, bool, error) {
+	f.count("GetCommunities")
+	return f.fakeRouter.GetCommunities(ctx, ip)
+}
+
+func TestLookupRouterCalls(t *testing.T) {
+	router := countingRouter{
+		fakeRouter: fakeRouter{
+			route:  parseCIDRs(t, "8.8.8.0/24")[0],
+			origin: 15169,
+			path:   cli.ASPath{Path: []uint32{3356, 15169}},
+		},
+		mu:    &sync.Mutex{},
+		calls: map[string]int{},
+	}
+	srv := getTestServer(router)
+	req := &pb.LookupRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}
+
+	resp, err := srv.Lookup(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetOrigin().GetAsplain() != 15169 {
+		t.Errorf("got origin %v, want AS15169 from the AS path", resp.GetOrigin())
+	}
+
+	// One route lookup, with the origin taken from the AS path.
+	want := map[string]int{
+		"GetRoute":        1,
+		"GetRouteSince":   1,
+		"GetASPathFromIP": 1,
+		"GetROA":          1,
+	}
+	if !reflect.DeepEqual(router.calls, want) {
+		t.Errorf("got router calls %v, want %v", router.calls, want)
+	}
+
+	// Everything is then cached.
+	if _, err := srv.Lookup(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(router.calls, want) {
+		t.Errorf("got router calls %v after a cached lookup, want %v", router.calls, want)
+	}
+}
+
+func TestRoaRouterCalls(t *testing.T) {
+	router := countingRouter{
+		fakeRouter: fakeRouter{
+			route:  parseCIDRs(t, "8.8.8.0/24")[0],
+			origin: 15169,
+		},
+		mu:    &sync.Mutex{},
+		calls: map[string]int{},
+	}
+	srv := getTestServer(router)
+	req := &pb.RoaRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}
+
+	resp, err := srv.Roa(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.GetIpAddress(); got.GetAddress() != "8.8.8.0" || got.GetMask() != 24 {
+		t.Errorf("got prefix %v, want 8.8.8.0/24", got)
+	}
+
+	// The route is looked up once, and shared with the origin lookup.
+	want := map[string]int{
+		"GetRoute":        1,
+		"GetRouteSince":   1,
+		"GetOriginFromIP": 1,
+		"GetROA":          1,
+	}
+	if !reflect.DeepEqual(router.calls, want) {
+		t.Errorf("got router calls %v, want %v", router.calls, want)
+	}
+
+	// Everything is then cached.
+	if _, err := srv.Roa(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(router.calls, want) {
+		t.Errorf("got router calls %v after a cached lookup, want %v", router.calls, want)
+	}
+}
+
+// refreshRouter counts origin lookups, blocking each until released.
+type refreshRouter struct {
+	fakeRouter
+	calls   *int32
+	release chan struct{}
+}
+
+func (f refreshRouter) GetOriginFromIP(ctx context.Context, ip net.IP) (uint32, bool, error) {
+	atomic.AddInt32(f.calls, 1)
+	<-f.release
+	return f.fakeRouter.GetOriginFromIP(ctx, ip)
+}
+
+func TestOriginStaleWhileRevalidate(t *testing.T) {
+	defer func(j float64, swr map[int]time.Duration) { ttlJitter, swrAge = j, swr }(ttlJitter, swrAge)
+	ttlJitter = 0
+	swrAge = map[int]time.Duration{iorigin: time.Minute}
+
+	router := refreshRouter{
+		fakeRouter: fakeRouter{origin: 15169, route: parseCIDRs(t, "8.8.8.0/24")[0]},
+		calls:      new(int32),
+		release:    make(chan struct{}),
+	}
+	srv := getTestServer(router)
+	req := &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}
+	srv.originCache["8.8.8.0/24"] = originAge{
+		origin: pb.OriginResponse{OriginAsn: 13335, Exists: true},
+		age:    time.Now().Add(-srv.maxAge[iorigin] - time.Second),
+	}
+
+	// Within the window the stale entry is returned, with only one refresh started.
+	for i := 0; i < 3; i++ {
+		resp, err := srv.Origin(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetOriginAsn() != 13335 {
+			t.Errorf("got origin %d, want the stale origin 13335", resp.GetOriginAsn())
+		}
+	}
+	close(router.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if cache, res := srv.checkOriginCache(router.route); res == cachedPositive && cache.GetOriginAsn() == 15169 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry was not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := atomic.LoadInt32(router.calls); calls != 1 {
+		t.Errorf("got %d background refreshes, want 1", calls)
+	}
+
+	// Beyond the window the router is queried before returning.
+	srv.originCache["8.8.8.0/24"] = originAge{
+		origin: pb.OriginResponse{OriginAsn: 13335, Exists: true},
+		age:    time.Now().Add(-srv.maxAge[iorigin] - swrAge[iorigin] - time.Second),
+	}
+	resp, err := srv.Origin(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetOriginAsn() != 15169 {
+		t.Errorf("got origin %d, want the refreshed origin 15169", resp.GetOriginAsn())
+	}
+	if calls := atomic.LoadInt32(router.calls); calls != 2 {
+		t.Errorf("got %d router lookups, want 2", calls)
+	}
+}
+
+func TestOriginCheck(t *testing.T) {
+	router := fakeRouter{
+		v4:     parseCIDRs(t, "1.1.1.0/24", "104.16.0.0/13", "104.16.5.0/24", "8.8.8.0/24"),
+		v6:     parseCIDRs(t, "2606:4700::/32"),
+		origin: 15169,
+	}
+	req := &pb.OriginCheckRequest{
+		AsNumber: 13335,
+		Expected: []*pb.IpAddress{
+			{Address: "1.1.1.0", Mask: 24},
+			{Address: "1.0.0.0", Mask: 24},
+			{Address: "104.16.0.0", Mask: 13},
+			{Address: "2606:4700::", Mask: 32},
+		},
+	}
+
+	srv := getTestServer(router)
+	resp, err := srv.OriginCheck(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 8.8.8.0/24 isn't expected, while the more specific 104.16.5.0/24 is.
+	if len(resp.GetUnexpected()) != 1 || resp.GetUnexpected()[0].GetAddress() != "8.8.8.0" {
+		t.Errorf("got unexpected %v, want only 8.8.8.0/24", resp.GetUnexpected())
+	}
+	conflicts := resp.GetConflicts()
+	if len(conflicts) != 1 || conflicts[0].GetPrefix().GetAddress() != "1.0.0.0" || conflicts[0].GetOriginAsn() != 15169 {
+		t.Errorf("got conflicts %v, want 1.0.0.0/24 originated by AS15169", conflicts)
+	}
+	if len(resp.GetMissing()) != 0 {
+		t.Errorf("got missing %v, want none", resp.GetMissing())
+	}
+
+	// With no active route, the expected prefix is missing.
+	router.origin = 0
+	srv = getTestServer(router)
+	resp, err = srv.OriginCheck(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetConflicts()) != 0 || len(resp.GetMissing()) != 1 || resp.GetMissing()[0].GetAddress() != "1.0.0.0" {
+		t.Errorf("got conflicts %v and missing %v, want only 1.0.0.0/24 missing", resp.GetConflicts(), resp.GetMissing())
+	}
+
+	// A bad expected prefix is rejected.
+	req.Expected = append(req.Expected, &pb.IpAddress{Address: "1.1.1.0", Mask: 33})
+	if _, err := srv.OriginCheck(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+}
+
+// limitedRouter only supports the required lookups.
+type limitedRouter struct {
+	fakeRouter
+}
+
+func (limitedRouter) Capabilities() cli.DecoderCaps {
+	return cli.DecoderCaps{}
+}
+
+func TestUnsupportedLookups(t *testing.T) {
+	srv := getTestServer(limitedRouter{fakeRouter{
+		route:  parseCIDRs(t, "1.1.1.0/24")[0],
+		origin: 13335,
+		path:   cli.ASPath{Path: []uint32{3356, 13335}},
+		since:  time.Now().Add(-time.Hour),
+	}})
+	ip := &pb.IpAddress{Address: "1.1.1.1"}
+
+	if _, err := srv.Aspath(context.Background(), &pb.AspathRequest{IpAddress: ip}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Aspath: got %v, want Unimplemented", err)
+	}
+	if _, err := srv.Roa(context.Background(), &pb.RoaRequest{IpAddress: ip}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Roa: got %v, want Unimplemented", err)
+	}
+	if _, err := srv.Invalids(context.Background(), &pb.InvalidsRequest{Asn: "0"}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Invalids: got %v, want Unimplemented", err)
+	}
+
+	// Route still works, without asking when it last changed.
+	route, err := srv.Route(context.Background(), &pb.RouteRequest{IpAddress: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !route.GetExists() || route.GetLastChange() != 0 {
+		t.Errorf("got route %v, want one with no last change", route)
+	}
+
+	// Lookup leaves out the parts that aren't supported.
+	resp, err := srv.Lookup(context.Background(), &pb.LookupRequest{IpAddress: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetOrigin().GetAsplain() != 13335 || len(resp.GetAsPath()) != 0 {
+		t.Errorf("got origin %v and path %v, want AS13335 and no path", resp.GetOrigin(), resp.GetAsPath())
+	}
+}
+
+func TestNonCanonicalMask(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		route:  &net.IPNet{IP: net.IPv4(1, 1, 1, 0).To4(), Mask: net.IPMask{255, 0, 255, 0}},
+		origin: 13335,
+	})
+	ip := &pb.IpAddress{Address: "1.1.1.1"}
+
+	if resp, err := srv.Route(context.Background(), &pb.RouteRequest{IpAddress: ip}); status.Code(err) != codes.Internal {
+		t.Errorf("Route: got %v, %v, want an Internal error", resp, err)
+	}
+	if resp, err := srv.Roa(context.Background(), &pb.RoaRequest{IpAddress: ip}); status.Code(err) != codes.Internal {
+		t.Errorf("Roa: got %v, %v, want an Internal error", resp, err)
+	}
+
+	// Nothing is cached, so a fixed route is returned next time.
+	if _, res := srv.checkRouteCache(net.ParseIP("1.1.1.1")); res != notCached {
+		t.Error("expected the bad route not to be cached")
+	}
+}
+
+// fakeSubscribeStream passes requests to Subscribe, and collects what it sends.
+type fakeSubscribeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs chan *pb.SubscribeRequest
+	sent chan *pb.LookupResponse
+}
+
+func (f fakeSubscribeStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f fakeSubscribeStream) Recv() (*pb.SubscribeRequest, error) {
+	r, ok := <-f.reqs
+	if !ok {
+		return nil, io.EOF
+	}
+	return r, nil
+}
+
+func (f fakeSubscribeStream) Send(resp *pb.LookupResponse) error {
+	f.sent <- resp
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := getTestServer(fakeRouter{
+		route:  parseCIDRs(t, "8.8.0.0/16")[0],
+		origin: 15169,
+		path:   cli.ASPath{Path: []uint32{3356, 15169}},
+	})
+	stream := fakeSubscribeStream{
+		ctx:  context.Background(),
+		reqs: make(chan *pb.SubscribeRequest),
+		sent: make(chan *pb.LookupResponse),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Subscribe(stream)
+	}()
+
+	next := func(addr, prefix string) {
+		t.Helper()
+		select {
+		case resp := <-stream.sent:
+			got := fmt.Sprintf("%s/%d", resp.GetPrefix().GetAddress(), resp.GetPrefix().GetMask())
+			if resp.GetIpAddress().GetAddress() != addr || got != prefix {
+				t.Errorf("got %s for %s, want %s for %s", got, resp.GetIpAddress().GetAddress(), prefix, addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no lookup sent for %s", addr)
+		}
+	}
+	cacheRoute := func(prefix string) {
+		ipnet := parseCIDRs(t, prefix)[0]
+		mask, _ := ipnet.Mask.Size()
+		srv.updateRouteCache(ipnet, pb.RouteResponse{
+			IpAddress: &pb.IpAddress{Address: ipnet.IP.String(), Mask: uint32(mask)},
+			Exists:    true,
+		})
+	}
+
+	stream.reqs <- &pb.SubscribeRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}
+	next("8.8.8.8", "8.8.0.0/16")
+
+	// A more specific route is cached, so the watched address has moved to it.
+	cacheRoute("8.8.8.0/24")
+	next("8.8.8.8", "8.8.8.0/24")
+
+	// Requests are handled in order, so the first is removed before the second is sent.
+	stream.reqs <- &pb.SubscribeRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}, Remove: true}
+	stream.reqs <- &pb.SubscribeRequest{IpAddress: &pb.IpAddress{Address: "8.8.4.4"}}
+	next("8.8.4.4", "8.8.0.0/16")
+
+	// Neither the removed address, nor the unchanged one, is sent again.
+	cacheRoute("8.8.8.0/25")
+	close(stream.reqs)
+	select {
+	case resp := <-stream.sent:
+		t.Errorf("got unexpected lookup for %s", resp.GetIpAddress().GetAddress())
+	case err := <-done:
+		if err != nil {
+			t.Errorf("subscription ended with %v, want nil", err)
+		}
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	router := countingRouter{
+		mu:    &sync.Mutex{},
+		calls: map[string]int{},
+	}
+	srv := getTestServer(router)
+	ctx := context.Background()
+
+	// Nothing is routed, so the first lookups ask the router and the miss
+	// is cached for the second. Without a route there's no origin to look up.
+	for i := 0; i < 2; i++ {
+		route, err := srv.Route(ctx, &pb.RouteRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}})
+		if err != nil || route.GetExists() {
+			t.Fatalf("Route: got %v, %v, want no route", route, err)
+		}
+		origin, err := srv.Origin(ctx, &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}})
+		if err != nil || origin.GetExists() {
+			t.Fatalf("Origin: got %v, %v, want no origin", origin, err)
+		}
+	}
+	want := map[string]int{
+		"GetRoute": 1,
+	}
+	if !reflect.DeepEqual(router.calls, want) {
+		t.Errorf("got router calls %v, want %v", router.calls, want)
+	}
+
+	// A route cached later for the address wins over the cached miss.
+	_, ipnet, _ := net.ParseCIDR("1.1.1.0/24")
+	srv.updateRouteCache(ipnet, pb.RouteResponse{IpAddress: &pb.IpAddress{Address: "1.1.1.0", Mask: 24}, Exists: true})
+	if _, res := srv.checkRouteCache(net.ParseIP("1.1.1.1")); res != cachedPositive {
+		t.Errorf("got cache result %d, want a cached route", res)
+	}
+
+	// The route has no origin, which is cached for the second lookup.
+	for i := 0; i < 2; i++ {
+		if _, err := srv.Origin(ctx, &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if router.calls["GetOriginFromIP"] != 1 {
+		t.Errorf("got %d origin lookups, want 1 with the miss cached", router.calls["GetOriginFromIP"])
+	}
+
+	// Once past the negative max age, the router is asked again.
+	srv.negativeAge = 0
+	if _, err := srv.Origin(ctx, &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if router.calls["GetOriginFromIP"] != 2 {
+		t.Errorf("got %d origin lookups, want 2 once the miss expired", router.calls["GetOriginFromIP"])
+	}
+}
+
+func TestOriginCacheByRoute(t *testing.T) {
+	router := countingRouter{
+		fakeRouter: fakeRouter{
+			route:  parseCIDRs(t, "9.9.9.0/24")[0],
+			origin: 19281,
+		},
+		mu:    &sync.Mutex{},
+		calls: map[string]int{},
+	}
+	srv := getTestServer(router)
+	ctx := context.Background()
+
+	if _, err := srv.Origin(ctx, &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "9.9.9.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.originCache["9.9.9.0/24"]; !ok {
+		t.Fatal("expected the origin to be cached under 9.9.9.0/24")
+	}
+
+	// Another address in the same route is a cache hit. Private ranges such as
+	// 10.0.0.0/24 are refused before the cache is checked, so a public one is used.
+	origin, err := srv.Origin(ctx, &pb.OriginRequest{IpAddress: &pb.IpAddress{Address: "9.9.9.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin.GetOriginAsn() != 19281 {
+		t.Errorf("got origin %d, want 19281", origin.GetOriginAsn())
+	}
+	if router.calls["GetOriginFromIP"] != 1 {
+		t.Errorf("got %d origin lookups, want 1 for two addresses in one route", router.calls["GetOriginFromIP"])
+	}
+}
+
+func TestTotalsFromCache(t *testing.T) {
+	// No bgpsql server is configured, so only a cached total can be returned.
+	srv := getTestServer(fakeRouter{})
+	if _, err := srv.Totals(context.Background(), &pb.Empty{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v with nothing cached, want Unavailable", err)
+	}
+
+	want := pb.TotalResponse{
+		Active_4: 950000,
+		Active_6: 190000,
+		Time:     uint64(time.Now().Unix()),
+	}
+	srv.updateTotalCache(want)
+
+	got, err := srv.Totals(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetActive_4() != want.GetActive_4() || got.GetActive_6() != want.GetActive_6() || got.GetTime() != want.GetTime() {
+		t.Errorf("got totals %v, %v at %v, want %v, %v at %v", got.GetActive_4(), got.GetActive_6(), got.GetTime(),
+			want.GetActive_4(), want.GetActive_6(), want.GetTime())
+	}
+}
+
+func TestCommunities(t *testing.T) {
+	router := countingRouter{
+		fakeRouter: fakeRouter{
+			route: parseCIDRs(t, "8.8.8.0/24")[0],
+			communities: cli.Communities{
+				Standard: []cli.Community{{ASN: 65000, Value: 100}, {ASN: 3356, Value: 2}},
+				Large:    []cli.LargeCommunity{{ASN: 65000, Data1: 1, Data2: 2}},
+				Extended: []cli.ExtendedCommunity{{Type: "rt", Admin: "65000", Value: 100}},
+			},
+		},
+		mu:    &sync.Mutex{},
+		calls: map[string]int{},
+	}
+	srv := getTestServer(router)
+	dict, err := parseCommunities(strings.NewReader("65000:100 learned from a customer\n65000:1:* blackholed\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.communities = dict
+
+	// Both addresses are within the same route, so share a cache entry.
+	for _, addr := range []string{"8.8.8.8", "8.8.8.4"} {
+		resp, err := srv.Communities(context.Background(), &pb.CommunitiesRequest{IpAddress: &pb.IpAddress{Address: addr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.GetExists() || resp.GetIpAddress().GetAddress() != "8.8.8.0" || resp.GetIpAddress().GetMask() != 24 {
+			t.Fatalf("got route %v, exists %t, want 8.8.8.0/24", resp.GetIpAddress(), resp.GetExists())
+		}
+
+		var standard, large, extended []string
+		for _, c := range resp.GetStandard() {
+			standard = append(standard, fmt.Sprintf("%d:%d %s", c.GetAsn(), c.GetValue(), c.GetMeaning()))
+		}
+		for _, c := range resp.GetLarge() {
+			large = append(large, fmt.Sprintf("%d:%d:%d %s", c.GetAsn(), c.GetData1(), c.GetData2(), c.GetMeaning()))
+		}
+		for _, c := range resp.GetExtended() {
+			extended = append(extended, fmt.Sprintf("%s %s:%d", c.GetType(), c.GetAdmin(), c.GetValue()))
+		}
+		if want := []string{"65000:100 learned from a customer", "3356:2 "}; !reflect.DeepEqual(standard, want) {
+			t.Errorf("got standard communities %q, want %q", standard, want)
+		}
+		if want := []string{"65000:1:2 blackholed"}; !reflect.DeepEqual(large, want) {
+			t.Errorf("got large communities %q, want %q", large, want)
+		}
+		if want := []string{"rt 65000:100"}; !reflect.DeepEqual(extended, want) {
+			t.Errorf("got extended communities %q, want %q", extended, want)
+		}
+	}
+	if router.calls["GetCommunities"] != 1 {
+		t.Errorf("got %d community lookups, want 1 with the second cached", router.calls["GetCommunities"])
+	}
+
+	// No route, no communities.
+	srv = getTestServer(fakeRouter{})
+	resp, err := srv.Communities(context.Background(), &pb.CommunitiesRequest{IpAddress: &pb.IpAddress{Address: "1.1.1.1"}})
+	if err != nil || resp.GetExists() {
+		t.Errorf("got %v, %v, want no communities without a route", resp, err)
+	}
+}
+
+func TestNextHop(t *testing.T) {
+	tests := []struct {
+		name   string
+		router fakeRouter
+		want   string
+		wantIf string
+	}{
+		{
+			name: "Via a router",
+			router: fakeRouter{
+				route:   parseCIDRs(t, "8.8.8.0/24")[0],
+				nextHop: cli.NextHop{IP: net.ParseIP("192.0.2.1"), Interface: "eth0"},
+			},
+			want:   "192.0.2.1",
+			wantIf: "eth0",
+		},
+		{
+			name: "Directly connected",
+			router: fakeRouter{
+				route:   parseCIDRs(t, "8.8.8.0/24")[0],
+				nextHop: cli.NextHop{Interface: "eth1"},
+			},
+			wantIf: "eth1",
+		},
+		{
+			name:   "No route",
+			router: fakeRouter{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := getTestServer(tc.router)
+			resp, err := srv.NextHop(context.Background(), &pb.NextHopRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetNextHop() != tc.want || resp.GetInterface() != tc.wantIf {
+				t.Errorf("got next hop %q on %q, want %q on %q", resp.GetNextHop(), resp.GetInterface(), tc.want, tc.wantIf)
+			}
+			if tc.router.route == nil {
+				return
+			}
+
+			// The next hop is cached for the route.
+			if _, ok := srv.checkNextHopCache(tc.router.route); !ok {
+				t.Error("expected the next hop to be cached")
+			}
+		})
+	}
+}
+
+// fakeBulkLookupStream collects what BulkLookup sends.
+type fakeBulkLookupStream struct {
+	grpc.ServerStream
+	mu   *sync.Mutex
+	sent *[]*pb.LookupResponse
+}
+
+func (f fakeBulkLookupStream) Context() context.Context {
+	return context.Background()
+}
+
+func (f fakeBulkLookupStream) Send(resp *pb.LookupResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*f.sent = append(*f.sent, resp)
+	return nil
+}
+
+// hostRouter has a host route for every address.
+type hostRouter struct {
+	countingRouter
+}
+
+func (f hostRouter) GetRoute(ctx context.Context, ip net.IP) (*net.IPNet, bool, error) {
+	f.count("GetRoute")
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, true, nil
+}
+
+func TestBulkLookup(t *testing.T) {
+	router := hostRouter{countingRouter{
+		fakeRouter: fakeRouter{origin: 15169},
+		mu:         &sync.Mutex{},
+		calls:      map[string]int{},
+	}}
+	srv := getTestServer(router)
+
+	// 50 addresses, each requested twice and one way as a /32.
+	var addrs []*pb.IpAddress
+	for i := 0; i < 50; i++ {
+		addrs = append(addrs, &pb.IpAddress{Address: fmt.Sprintf("8.8.8.%d", i)})
+	}
+	for i := 0; i < 50; i++ {
+		addrs = append(addrs, &pb.IpAddress{Address: fmt.Sprintf("8.8.8.%d", i), Mask: 32})
+	}
+
+	var sent []*pb.LookupResponse
+	stream := fakeBulkLookupStream{mu: &sync.Mutex{}, sent: &sent}
+	if err := srv.BulkLookup(&pb.BulkLookupRequest{IpAddresses: addrs}, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 50 {
+		t.Errorf("got %d lookups, want 50", len(sent))
+	}
+	got := make(map[string]bool)
+	for _, resp := range sent {
+		if !resp.GetExists() || resp.GetOrigin().GetAsplain() != 15169 {
+			t.Errorf("got %v for %s, want a route from AS15169", resp, resp.GetIpAddress().GetAddress())
+		}
+		got[resp.GetIpAddress().GetAddress()] = true
+	}
+	if len(got) != 50 {
+		t.Errorf("got lookups for %d addresses, want 50", len(got))
+	}
+	if router.calls["GetRoute"] != 50 {
+		t.Errorf("got %d route lookups, want one for each of the 50 addresses", router.calls["GetRoute"])
+	}
+
+	// Nothing is looked up if an address is bad.
+	bad := append(addrs[:1:1], &pb.IpAddress{Address: "8.8.8"})
+	if err := srv.BulkLookup(&pb.BulkLookupRequest{IpAddresses: bad}, stream); err == nil {
+		t.Error("got no error for a bad address")
+	}
+	if router.calls["GetRoute"] != 50 {
+		t.Errorf("got %d route lookups, want none for a request with a bad address", router.calls["GetRoute"]-50)
+	}
+}
+
+func TestAspathLength(t *testing.T) {
+	router := countingRouter{
+		mu:    &sync.Mutex{},
+		calls: map[string]int{},
+	}
+	srv := getTestServer(router)
+
+	asns := func(nums ...uint32) []*pb.Asn {
+		var a []*pb.Asn
+		for _, n := range nums {
+			a = append(a, &pb.Asn{Asplain: n})
+		}
+		return a
+	}
+	srv.updateASPathCache(net.ParseIP("8.8.8.8"), pb.AspathResponse{
+		Asn:    asns(3356, 2914, 6453, 15169),
+		Set:    asns(64512, 64513),
+		Exists: true,
+	})
+	srv.updateASPathCache(net.ParseIP("1.1.1.1"), pb.AspathResponse{
+		Asn:    asns(3356, 13335),
+		Exists: true,
+	})
+
+	tests := []struct {
+		addr string
+		want uint32
+	}{
+		// The set is a single hop.
+		{addr: "8.8.8.8", want: 5},
+		{addr: "1.1.1.1", want: 2},
+	}
+	for _, tc := range tests {
+		resp, err := srv.AspathLength(context.Background(), &pb.AspathRequest{IpAddress: &pb.IpAddress{Address: tc.addr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.GetExists() || resp.GetLength() != tc.want {
+			t.Errorf("got length %d, exists %t for %s, want %d", resp.GetLength(), resp.GetExists(), tc.addr, tc.want)
+		}
+	}
+
+	// Both were served from the cache.
+	if router.calls["GetASPathFromIP"] != 0 {
+		t.Errorf("got %d as-path lookups, want none", router.calls["GetASPathFromIP"])
+	}
+}
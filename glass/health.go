@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthService is the service name health is reported for, as well as for
+// the server as a whole.
+const healthService = "glass.looking_glass"
+
+// pingTimeout limits how long bird has to answer a health check.
+const pingTimeout = 5 * time.Second
+
+// pingBird returns an error if bird doesn't answer in time.
+func (s *server) pingBird(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return s.router.Ping(ctx)
+}
+
+// bgpsqlState returns the state of the bgpsql connection, or empty if bgpsql
+// isn't configured.
+func (s *server) bgpsqlState() string {
+	if s.bsql == nil {
+		return ""
+	}
+	return s.bsql.get().GetState().String()
+}
+
+// serving returns true if bird is answering and bgpsql, if configured, is connected.
+func serving(birdErr error, bgpsql string) bool {
+	return birdErr == nil && (bgpsql == "" || bgpsql == connectivity.Ready.String())
+}
+
+// updateHealth sets the status reported by the health service.
+func (s *server) updateHealth(ctx context.Context) {
+	birdErr, bgpsql := s.pingBird(ctx), s.bgpsqlState()
+	status := healthpb.HealthCheckResponse_SERVING
+	if !serving(birdErr, bgpsql) {
+		log.Printf("Not serving. bird error: %v, bgpsql state: %q", birdErr, bgpsql)
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	s.health.SetServingStatus("", status)
+	s.health.SetServingStatus(healthService, status)
+}
+
+// watchHealth updates the health status every interval, until the context is cancelled.
+func (s *server) watchHealth(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.updateHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// GetStatus will return whether glass can reach bird and bgpsql, along with
+// its uptime and the number of entries in each cache.
+func (s *server) GetStatus(ctx context.Context, e *pb.Empty) (*pb.StatusResponse, error) {
+	log.Printf("Running GetStatus")
+
+	birdErr, bgpsql := s.pingBird(ctx), s.bgpsqlState()
+	if birdErr != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), birdErr)
+	}
+	resp := &pb.StatusResponse{
+		Serving: serving(birdErr, bgpsql),
+		Bird:    birdErr == nil,
+		Bgpsql:  bgpsql,
+		Uptime:  uint64(time.Since(s.started).Seconds()),
+	}
+
+	sizes := s.cacheSizes()
+	var ttypes []int
+	for ttype := range cacheNames {
+		ttypes = append(ttypes, ttype)
+	}
+	sort.Ints(ttypes)
+	for _, ttype := range ttypes {
+		resp.Caches = append(resp.Caches, &pb.CacheSize{
+			Cache:   cacheNames[ttype],
+			Entries: uint32(sizes[ttype]),
+		})
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealth(t *testing.T) {
+	srv := getTestServer(fakeRouter{})
+	srv.health = health.NewServer()
+	ctx := context.Background()
+
+	check := func() healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := srv.health.Check(ctx, &healthpb.HealthCheckRequest{Service: healthService})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetStatus()
+	}
+
+	srv.updateHealth(ctx)
+	if got := check(); got != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got %v with bird answering, want SERVING", got)
+	}
+
+	srv.router = fakeRouter{pingErr: errors.New("bird is not running")}
+	srv.updateHealth(ctx)
+	if got := check(); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("got %v with bird down, want NOT_SERVING", got)
+	}
+
+	srv.router = fakeRouter{}
+	srv.updateHealth(ctx)
+	if got := check(); got != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got %v once bird is back, want SERVING", got)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	srv := getTestServer(fakeRouter{pingErr: errors.New("bird is not running")})
+	srv.started = time.Now().Add(-time.Hour)
+	srv.updateOriginCache(parseCIDRs(t, "8.8.8.0/24")[0], pb.OriginResponse{OriginAsn: 15169, Exists: true})
+
+	resp, err := srv.GetStatus(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetServing() || resp.GetBird() {
+		t.Errorf("got serving %t, bird %t, want both false with bird down", resp.GetServing(), resp.GetBird())
+	}
+	if resp.GetBgpsql() != "" {
+		t.Errorf("got bgpsql state %q, want empty when not configured", resp.GetBgpsql())
+	}
+	if resp.GetUptime() < 3600 {
+		t.Errorf("got uptime %ds, want at least an hour", resp.GetUptime())
+	}
+	if len(resp.GetCaches()) != len(cacheNames) {
+		t.Errorf("got %d caches, want %d", len(resp.GetCaches()), len(cacheNames))
+	}
+	for _, c := range resp.GetCaches() {
+		if c.GetCache() == "origin" && c.GetEntries() != 1 {
+			t.Errorf("got %d origin entries, want 1", c.GetEntries())
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/mellowdrifter/bgp_infrastructure/clidecode"
+	com "github.com/mellowdrifter/bgp_infrastructure/common"
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxASSetDepth is how deep nested as-sets are expanded.
+const maxASSetDepth = 10
+
+// irr is a source of routing registry data.
+type irr interface {
+	// members returns the direct members of an as-set. Members are AS numbers or other as-sets.
+	members(ctx context.Context, asSet string) ([]string, error)
+
+	// routes returns the prefixes of all route and route6 objects with the AS number as origin.
+	routes(ctx context.Context, asn uint32) ([]*net.IPNet, error)
+}
+
+// whoisIRR queries an IRRd server, e.g. whois.radb.net:43
+type whoisIRR struct {
+	server string
+}
+
+// members uses the IRRd !i query, which returns the direct members of a set.
+func (w whoisIRR) members(ctx context.Context, asSet string) ([]string, error) {
+	return w.query(ctx, "!i"+asSet)
+}
+
+// routes uses the IRRd !g and !6 queries, which return the IPv4 and IPv6 route objects for an origin.
+func (w whoisIRR) routes(ctx context.Context, asn uint32) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for _, q := range []string{"!gAS%d", "!6AS%d"} {
+		objects, err := w.query(ctx, fmt.Sprintf(q, asn))
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			_, prefix, err := net.ParseCIDR(object)
+			if err != nil {
+				log.Printf("skipping route object with bad prefix %q: %v", object, err)
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// query sends a single query to the IRRd server and returns the decoded response.
+func (w whoisIRR) query(ctx context.Context, q string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", w.server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial IRR server: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\n", q); err != nil {
+		return nil, err
+	}
+
+	return decodeIRRResponse(bufio.NewReader(conn))
+}
+
+// decodeIRRResponse decodes an IRRd response.
+// A<length> is followed by the data and then C. D means no data, and F is an error.
+func decodeIRRResponse(r *bufio.Reader) ([]string, error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("unable to read IRR response: %w", err)
+	}
+	status = strings.TrimSpace(status)
+
+	switch {
+	case status == "C", status == "D":
+		return nil, nil
+	case strings.HasPrefix(status, "F"):
+		return nil, fmt.Errorf("IRR error: %s", strings.TrimSpace(status[1:]))
+	case !strings.HasPrefix(status, "A"):
+		return nil, fmt.Errorf("unexpected IRR response: %q", status)
+	}
+
+	length, err := strconv.Atoi(status[1:])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected IRR response: %q", status)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("unable to read IRR response: %w", err)
+	}
+
+	return strings.Fields(string(data)), nil
+}
+
+// expandASSet searches an as-set, and all nested as-sets, for an AS number.
+// Returns the chain of as-sets leading to the AS number, and if the depth limit was reached.
+func expandASSet(ctx context.Context, src irr, asSet string, asn uint32) ([]string, bool, error) {
+	seen := make(map[string]bool)
+	var truncated bool
+
+	var search func(set string, depth int) ([]string, error)
+	search = func(set string, depth int) ([]string, error) {
+		set = strings.ToUpper(set)
+		if seen[set] {
+			return nil, nil
+		}
+		seen[set] = true
+
+		if depth > maxASSetDepth {
+			truncated = true
+			return nil, nil
+		}
+
+		members, err := src.members(ctx, set)
+		if err != nil {
+			return nil, err
+		}
+
+		var nested []string
+		for _, member := range members {
+			if number, ok := parseASN(member); ok {
+				if number == asn {
+					return []string{set}, nil
+				}
+				continue
+			}
+			nested = append(nested, member)
+		}
+		for _, member := range nested {
+			path, err := search(member, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if path != nil {
+				return append([]string{set}, path...), nil
+			}
+		}
+
+		return nil, nil
+	}
+
+	path, err := search(asSet, 1)
+	return path, truncated, err
+}
+
+// parseASN returns the AS number if the member is an AS number rather than an as-set.
+func parseASN(member string) (uint32, bool) {
+	if len(member) < 3 || !strings.EqualFold(member[:2], "AS") {
+		return 0, false
+	}
+	asn, err := strconv.ParseUint(member[2:], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(asn), true
+}
+
+// AsSetMembership will return whether an ASN is a member of an IRR as-set.
+// If an IP address is passed instead of an ASN, the origin ASN of that address is checked.
+func (s *server) AsSetMembership(ctx context.Context, r *pb.MembershipRequest) (*pb.MembershipResponse, error) {
+	log.Printf("Running AsSetMembership")
+	defer com.TimeFunction(time.Now(), "AsSetMembership")
+
+	if s.irr == nil {
+		return &pb.MembershipResponse{}, fmt.Errorf("IRR server not configured")
+	}
+	if r.GetAsSet() == "" {
+		return &pb.MembershipResponse{}, fmt.Errorf("as-set must be specified")
+	}
+
+	asn := r.GetAsNumber()
+	if asn == 0 && r.GetIpAddress().GetAddress() != "" {
+		ip, err := com.ValidateIP(r.GetIpAddress().GetAddress())
+		if err != nil {
+			return &pb.MembershipResponse{}, err
+		}
+		origin, exists, err := s.router.GetOriginFromIP(ctx, ip)
+		if err != nil {
+			log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+			return &pb.MembershipResponse{}, err
+		}
+		if !exists {
+			return &pb.MembershipResponse{AsSet: r.GetAsSet()}, nil
+		}
+		asn = origin
+	}
+
+	if !com.ValidateASN(asn) {
+		return &pb.MembershipResponse{}, fmt.Errorf("Invalid AS number")
+	}
+
+	path, truncated, err := expandASSet(ctx, s.irr, r.GetAsSet(), asn)
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.MembershipResponse{}, err
+	}
+
+	return &pb.MembershipResponse{
+		AsSet:     r.GetAsSet(),
+		AsNumber:  asn,
+		Member:    path != nil,
+		Path:      path,
+		Truncated: truncated,
+	}, nil
+}
+
+// RegistryDiscrepancies will check each prefix an ASN originates against both the local ROAs
+// and its IRR route objects. Prefixes that are RPKI valid but have no route object, and those
+// with a route object that are not RPKI valid, are reported so the two can be brought in line.
+func (s *server) RegistryDiscrepancies(ctx context.Context, r *pb.DiscrepancyRequest) (*pb.DiscrepancyReport, error) {
+	log.Printf("Running RegistryDiscrepancies")
+	defer com.TimeFunction(time.Now(), "RegistryDiscrepancies")
+
+	if s.irr == nil {
+		return &pb.DiscrepancyReport{}, fmt.Errorf("IRR server not configured")
+	}
+	roas := s.getROAStore()
+	if roas == nil {
+		return &pb.DiscrepancyReport{}, status.Error(codes.FailedPrecondition, "no local ROA file loaded")
+	}
+
+	// sourced validates and caches the ASN. The full set is needed for the comparison.
+	sourced, err := s.sourced(ctx, &pb.SourceRequest{AsNumber: r.GetAsNumber()})
+	if err != nil {
+		return &pb.DiscrepancyReport{}, err
+	}
+	observed, err := protoToIPNets(sourced.GetIpAddress())
+	if err != nil {
+		return &pb.DiscrepancyReport{}, err
+	}
+
+	objects, err := s.irr.routes(ctx, r.GetAsNumber())
+	if err != nil {
+		log.Printf("Error on request id %s: %v", getTracerFromContext(ctx), err)
+		return &pb.DiscrepancyReport{}, err
+	}
+	registered := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		registered[object.String()] = true
+	}
+
+	var resp pb.DiscrepancyReport
+	for i, prefix := range observed {
+		state, explain := roas.validate(prefix, r.GetAsNumber())
+		hasObject := registered[prefix.String()]
+		switch {
+		case state == cli.RValid && !hasObject:
+			resp.NoRouteObject = append(resp.NoRouteObject, sourced.GetIpAddress()[i])
+		case state != cli.RValid && hasObject:
+			resp.NotRpkiValid = append(resp.NotRpkiValid, &pb.RoaVerdict{
+				Prefix: sourced.GetIpAddress()[i],
+				Asn:    r.GetAsNumber(),
+				Status: roaStatuses[state],
+				Reason: explain.GetReason(),
+			})
+		}
+	}
+	resp.CacheTime = uint64(time.Now().Unix())
+
+	return &resp, nil
+}
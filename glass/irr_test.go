@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+// fakeIRR returns as-set members from a map and counts the queries made.
+type fakeIRR struct {
+	sets    map[string][]string
+	objects map[uint32][]*net.IPNet
+	queries map[string]int
+}
+
+func (f fakeIRR) members(ctx context.Context, asSet string) ([]string, error) {
+	f.queries[asSet]++
+	members, ok := f.sets[asSet]
+	if !ok {
+		return nil, fmt.Errorf("no such as-set %s", asSet)
+	}
+	return members, nil
+}
+
+func (f fakeIRR) routes(ctx context.Context, asn uint32) ([]*net.IPNet, error) {
+	return f.objects[asn], nil
+}
+
+func TestAsSetMembership(t *testing.T) {
+	var tests = []struct {
+		name      string
+		sets      map[string][]string
+		asn       uint32
+		member    bool
+		path      []string
+		truncated bool
+	}{
+		{
+			name: "Direct member",
+			sets: map[string][]string{
+				"AS-CUSTOMER": {"AS15169", "AS13335"},
+			},
+			asn:    13335,
+			member: true,
+			path:   []string{"AS-CUSTOMER"},
+		},
+		{
+			name: "Nested member",
+			sets: map[string][]string{
+				"AS-CUSTOMER":   {"AS15169", "AS-DOWNSTREAM"},
+				"AS-DOWNSTREAM": {"AS2906", "as-deeper"},
+				"AS-DEEPER":     {"AS13335"},
+			},
+			asn:    13335,
+			member: true,
+			path:   []string{"AS-CUSTOMER", "AS-DOWNSTREAM", "AS-DEEPER"},
+		},
+		{
+			name: "Not a member",
+			sets: map[string][]string{
+				"AS-CUSTOMER":   {"AS15169", "AS-DOWNSTREAM"},
+				"AS-DOWNSTREAM": {"AS2906"},
+			},
+			asn: 13335,
+		},
+		{
+			name: "Loop",
+			sets: map[string][]string{
+				"AS-CUSTOMER": {"AS15169", "AS-LOOP"},
+				"AS-LOOP":     {"AS-CUSTOMER", "AS-LOOP"},
+			},
+			asn: 13335,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := fakeIRR{sets: tc.sets, queries: make(map[string]int)}
+			srv := getTestServer(fakeRouter{})
+			srv.irr = f
+
+			resp, err := srv.AsSetMembership(context.Background(), &pb.MembershipRequest{
+				AsSet:    "AS-CUSTOMER",
+				AsNumber: tc.asn,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetMember() != tc.member {
+				t.Errorf("got member %t, want %t", resp.GetMember(), tc.member)
+			}
+			if !reflect.DeepEqual(resp.GetPath(), tc.path) {
+				t.Errorf("got path %v, want %v", resp.GetPath(), tc.path)
+			}
+			if resp.GetTruncated() != tc.truncated {
+				t.Errorf("got truncated %t, want %t", resp.GetTruncated(), tc.truncated)
+			}
+			for set, count := range f.queries {
+				if count > 1 {
+					t.Errorf("%s queried %d times", set, count)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandASSetDepth(t *testing.T) {
+	sets := make(map[string][]string)
+	for i := 1; i <= maxASSetDepth+1; i++ {
+		sets[fmt.Sprintf("AS-%d", i)] = []string{fmt.Sprintf("AS-%d", i+1)}
+	}
+	sets[fmt.Sprintf("AS-%d", maxASSetDepth+2)] = []string{"AS13335"}
+
+	f := fakeIRR{sets: sets, queries: make(map[string]int)}
+	path, truncated, err := expandASSet(context.Background(), f, "AS-1", 13335)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != nil {
+		t.Errorf("got path %v, want none", path)
+	}
+	if !truncated {
+		t.Errorf("expected expansion to be truncated")
+	}
+	if len(f.queries) != maxASSetDepth {
+		t.Errorf("got %d queries, want %d", len(f.queries), maxASSetDepth)
+	}
+}
+
+func TestDecodeIRRResponse(t *testing.T) {
+	var tests = []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Members",
+			in:   "A19\nAS15169 AS-EXAMPLE\nC\n",
+			want: []string{"AS15169", "AS-EXAMPLE"},
+		},
+		{
+			name: "No entries",
+			in:   "D\n",
+		},
+		{
+			name:    "Error",
+			in:      "F Invalid query\n",
+			wantErr: true,
+		},
+		{
+			name:    "Short data",
+			in:      "A50\nAS15169\n",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeIRRResponse(bufio.NewReader(strings.NewReader(tc.in)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, wantErr %t", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegistryDiscrepancies(t *testing.T) {
+	roas, err := decodeROAs([]byte(`{"roas": [
+		{"prefix": "1.1.1.0/24", "maxLength": 24, "asn": "AS13335"},
+		{"prefix": "1.0.0.0/24", "maxLength": 24, "asn": "AS13335"},
+		{"prefix": "104.16.0.0/12", "maxLength": 12, "asn": "AS13335"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := getTestServer(fakeRouter{
+		v4: parseCIDRs(t, "1.1.1.0/24", "1.0.0.0/24", "104.16.0.0/13"),
+		v6: parseCIDRs(t, "2606:4700::/32"),
+	})
+	srv.irr = fakeIRR{objects: map[uint32][]*net.IPNet{
+		13335: parseCIDRs(t, "1.1.1.0/24", "104.16.0.0/13", "2606:4700::/32"),
+	}}
+
+	// Nothing can be checked without the local ROAs.
+	if _, err := srv.RegistryDiscrepancies(context.Background(), &pb.DiscrepancyRequest{AsNumber: 13335}); err == nil {
+		t.Error("expected an error with no local ROAs loaded")
+	}
+	srv.roas = roas
+
+	resp, err := srv.RegistryDiscrepancies(context.Background(), &pb.DiscrepancyRequest{AsNumber: 13335})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var missing []string
+	for _, p := range resp.GetNoRouteObject() {
+		missing = append(missing, fmt.Sprintf("%s/%d", p.GetAddress(), p.GetMask()))
+	}
+	if want := []string{"1.0.0.0/24"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("got %v with no route object, want %v", missing, want)
+	}
+
+	var notValid []string
+	for _, v := range resp.GetNotRpkiValid() {
+		notValid = append(notValid, fmt.Sprintf("%s/%d", v.GetPrefix().GetAddress(), v.GetPrefix().GetMask()))
+	}
+	if want := []string{"104.16.0.0/13", "2606:4700::/32"}; !reflect.DeepEqual(notValid, want) {
+		t.Fatalf("got %v not RPKI valid, want %v", notValid, want)
+	}
+	if v := resp.GetNotRpkiValid()[0]; v.GetStatus() != pb.RoaResponse_INVALID || v.GetReason() != pb.RoaExplanation_TOO_SPECIFIC {
+		t.Errorf("got %v, %v for %v, want INVALID, TOO_SPECIFIC", v.GetStatus(), v.GetReason(), v.GetPrefix())
+	}
+	if v := resp.GetNotRpkiValid()[1]; v.GetStatus() != pb.RoaResponse_UNKNOWN || v.GetReason() != pb.RoaExplanation_NO_COVERING_ROA {
+		t.Errorf("got %v, %v for %v, want UNKNOWN, NO_COVERING_ROA", v.GetStatus(), v.GetReason(), v.GetPrefix())
+	}
+}
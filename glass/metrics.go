@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+// Counters are published on /debug/vars when the metrics port is set.
+// expvar updates them atomically, so no extra locking is needed.
+var (
+	cacheHits   = expvar.NewMap("cache_hits")
+	cacheMisses = expvar.NewMap("cache_misses")
+	requests    = expvar.NewMap("requests")
+)
+
+// Cache metrics are served for Prometheus on /metrics. Entries are only
+// counted when scraped.
+var (
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "glass_cache_lookups_total",
+		Help: "Cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+	cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "glass_cache_entries",
+		Help: "Entries in each cache.",
+	}, []string{"cache"})
+	cacheMaxEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "glass_cache_max_entries",
+		Help: "Entries each cache is swept back to.",
+	}, []string{"cache"})
+)
+
+// cacheNames are the names each cache type is published under.
+var cacheNames = map[int]string{
+	iasn:       "asn",
+	isourced:   "sourced",
+	iroute:     "route",
+	iorigin:    "origin",
+	iaspath:    "aspath",
+	iroa:       "roa",
+	ilocation:  "location",
+	imap:       "map",
+	itotal:     "total",
+	iinvalids:  "invalids",
+	icommunity: "community",
+	inexthop:   "nexthop",
+}
+
+// countCache records a hit or miss against the cache type.
+func countCache(ttype int, hit bool) {
+	if hit {
+		cacheHits.Add(cacheNames[ttype], 1)
+		cacheLookups.WithLabelValues(cacheNames[ttype], "hit").Inc()
+		return
+	}
+	cacheMisses.Add(cacheNames[ttype], 1)
+	cacheLookups.WithLabelValues(cacheNames[ttype], "miss").Inc()
+}
+
+// countRequests is a gRPC interceptor counting requests to each method.
+func countRequests(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requests.Add(path.Base(info.FullMethod), 1)
+	return handler(ctx, req)
+}
+
+// cacheSizes returns the number of entries in each cache.
+func (s *server) cacheSizes() map[int]int {
+	sizes := make(map[int]int)
+	for ttype := range cacheNames {
+		s.locks[ttype].RLock()
+		switch ttype {
+		case iasn:
+			sizes[ttype] = len(s.asNameCache)
+		case isourced:
+			sizes[ttype] = len(s.sourcedCache)
+		case iroute:
+			sizes[ttype] = s.routeCache.len()
+		case iorigin:
+			sizes[ttype] = len(s.originCache)
+		case iaspath:
+			sizes[ttype] = len(s.aspathCache)
+		case iroa:
+			sizes[ttype] = len(s.roaCache)
+		case ilocation:
+			sizes[ttype] = len(s.locCache)
+		case imap:
+			sizes[ttype] = len(s.mapCache)
+		case icommunity:
+			sizes[ttype] = len(s.commCache)
+		case inexthop:
+			sizes[ttype] = len(s.nhCache)
+		case itotal:
+			if s.totalCache.set {
+				sizes[ttype] = 1
+			}
+		case iinvalids:
+			if s.invCache.set {
+				sizes[ttype] = 1
+			}
+		}
+		s.locks[ttype].RUnlock()
+	}
+	return sizes
+}
+
+// metricsHandler serves the cache metrics for Prometheus, updating the cache
+// sizes on each scrape.
+func (s *server) metricsHandler() http.Handler {
+	h := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for ttype, size := range s.cacheSizes() {
+			cacheEntries.WithLabelValues(cacheNames[ttype]).Set(float64(size))
+		}
+		for ttype, max := range s.maxCache {
+			cacheMaxEntries.WithLabelValues(cacheNames[ttype]).Set(float64(max))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+// published returns the current value of a counter in a published expvar map.
+func published(t *testing.T, name, key string) int64 {
+	t.Helper()
+	m, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		t.Fatalf("%s is not published", name)
+	}
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestCacheCounters(t *testing.T) {
+	srv := getServer()
+	hits, misses := published(t, "cache_hits", "location"), published(t, "cache_misses", "location")
+
+	srv.checkLocationCache("CPT")
+	srv.updateLocationCache("CPT", pb.LocationResponse{City: "Cape Town"})
+	srv.checkLocationCache("CPT")
+	srv.checkLocationCache("CPT")
+	srv.checkLocationCache("SIN")
+
+	if got := published(t, "cache_hits", "location") - hits; got != 2 {
+		t.Errorf("got %d location hits, want 2", got)
+	}
+	if got := published(t, "cache_misses", "location") - misses; got != 2 {
+		t.Errorf("got %d location misses, want 2", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	srv := getServer()
+	hits := testutil.ToFloat64(cacheLookups.WithLabelValues("origin", "hit"))
+	misses := testutil.ToFloat64(cacheLookups.WithLabelValues("origin", "miss"))
+
+	_, ipnet, _ := net.ParseCIDR("8.8.8.0/24")
+	srv.checkOriginCache(ipnet)
+	srv.updateOriginCache(ipnet, pb.OriginResponse{OriginAsn: 15169})
+	srv.checkOriginCache(ipnet)
+
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("origin", "hit")) - hits; got != 1 {
+		t.Errorf("got %v origin hits, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("origin", "miss")) - misses; got != 1 {
+		t.Errorf("got %v origin misses, want 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`glass_cache_entries{cache="origin"} 1`,
+		`glass_cache_entries{cache="route"} 0`,
+		fmt.Sprintf(`glass_cache_max_entries{cache="origin"} %d`, srv.maxCache[iorigin]),
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestCountRequests(t *testing.T) {
+	before := published(t, "requests", "Origin")
+	info := &grpc.UnaryServerInfo{FullMethod: "/glass.looking_glass/Origin"}
+	handler := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+	for i := 0; i < 3; i++ {
+		if _, err := countRequests(context.Background(), nil, info, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := published(t, "requests", "Origin") - before; got != 3 {
+		t.Errorf("got %d Origin requests, want 3", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+// savedCache is the location and map caches as written to disk. Both are slow
+// to fill, as each entry needs an external API call, so they're kept over restarts.
+type savedCache struct {
+	Locations map[string]savedLocation
+	Maps      map[string]savedMap
+}
+
+type savedLocation struct {
+	City, Country, Lat, Long, Image string
+	Age                             time.Time
+}
+
+type savedMap struct {
+	Map string
+	Age time.Time
+}
+
+// saveCache writes the location and map caches to the file. The file is
+// replaced in one go, so a crash mid-write leaves the last save in place.
+func (s *server) saveCache(file string) error {
+	saved := savedCache{
+		Locations: make(map[string]savedLocation),
+		Maps:      make(map[string]savedMap),
+	}
+
+	s.locks[ilocation].RLock()
+	for key, val := range s.locCache {
+		saved.Locations[key] = savedLocation{
+			City:    val.loc.GetCity(),
+			Country: val.loc.GetCountry(),
+			Lat:     val.loc.GetLat(),
+			Long:    val.loc.GetLong(),
+			Image:   val.loc.GetImage(),
+			Age:     val.age,
+		}
+	}
+	s.locks[ilocation].RUnlock()
+
+	s.locks[imap].RLock()
+	for key, val := range s.mapCache {
+		saved.Maps[key] = savedMap{Map: val.imap, Age: val.age}
+	}
+	s.locks[imap].RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(saved); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+
+	log.Printf("Saved %d locations and %d maps to %s", len(saved.Locations), len(saved.Maps), file)
+	return nil
+}
+
+// loadCache reads the location and map caches saved to the file. Entries past
+// their max age are dropped. A missing or empty file is an empty cache.
+func (s *server) loadCache(file string) error {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var saved savedCache
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	s.locks[ilocation].Lock()
+	for key, val := range saved.Locations {
+		if s.remaining(val.Age, ilocation) == 0 {
+			continue
+		}
+		s.locCache[key] = locAge{
+			loc: pb.LocationResponse{
+				City:    val.City,
+				Country: val.Country,
+				Lat:     val.Lat,
+				Long:    val.Long,
+				Image:   val.Image,
+			},
+			age: val.Age,
+		}
+	}
+	locations := len(s.locCache)
+	s.locks[ilocation].Unlock()
+
+	s.locks[imap].Lock()
+	for key, val := range saved.Maps {
+		if s.remaining(val.Age, imap) == 0 {
+			continue
+		}
+		s.mapCache[key] = mapAge{imap: val.Map, age: val.Age}
+	}
+	maps := len(s.mapCache)
+	s.locks[imap].Unlock()
+
+	log.Printf("Loaded %d locations and %d maps from %s", locations, maps, file)
+	return nil
+}
+
+// persistCache saves the location and map caches to the file every interval,
+// until the context is cancelled.
+func (s *server) persistCache(ctx context.Context, file string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := s.saveCache(file); err != nil {
+			log.Printf("Error saving cache: %v", err)
+		}
+	}
+}
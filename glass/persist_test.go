@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+)
+
+func TestSaveCache(t *testing.T) {
+	defer func(j float64) { ttlJitter = j }(ttlJitter)
+	ttlJitter = 0
+
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	srv := getServer()
+	srv.updateLocationCache("LHR", pb.LocationResponse{City: "London", Country: "United Kingdom", Lat: "51.47", Long: "-0.46"})
+	srv.updateLocationCache("JNB", pb.LocationResponse{City: "Johannesburg", Country: "South Africa"})
+	srv.updateMapCache("51.47,-0.46", "image")
+
+	// JNB was added long enough ago that it's expired by the time it's loaded.
+	srv.locCache["JNB"] = locAge{
+		loc: srv.locCache["JNB"].loc,
+		age: time.Now().Add(-srv.maxAge[ilocation] - time.Hour),
+	}
+
+	if err := srv.saveCache(file); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := getServer()
+	if err := loaded.loadCache(file); err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := loaded.checkLocationCache("LHR")
+	if !ok || loc.GetCity() != "London" || loc.GetLat() != "51.47" {
+		t.Errorf("got %v, %t for LHR, want London to survive a reload", loc, ok)
+	}
+	if _, ok := loaded.locCache["JNB"]; ok {
+		t.Error("expected the expired JNB entry to be dropped on reload")
+	}
+	if img, ok := loaded.checkMapCache("51.47,-0.46"); !ok || img != "image" {
+		t.Errorf("got %q, %t for the map, want it to survive a reload", img, ok)
+	}
+
+	// Nothing saved yet is an empty cache, not an error.
+	if err := loaded.loadCache(filepath.Join(t.TempDir(), "missing.gob")); err != nil {
+		t.Errorf("got %v loading a missing file, want no error", err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.gob")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.loadCache(empty); err != nil {
+		t.Errorf("got %v loading an empty file, want no error", err)
+	}
+}
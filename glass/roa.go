@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/mellowdrifter/bgp_infrastructure/clidecode"
+	com "github.com/mellowdrifter/bgp_infrastructure/common"
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchSize is the most pairs ValidateBatch will check in one request.
+const maxBatchSize = 10000
+
+// roaStatuses maps the router ROA status to the proto status.
+var roaStatuses = map[int]pb.RoaResponse_ROAStatus{
+	cli.RUnknown: pb.RoaResponse_UNKNOWN,
+	cli.RInvalid: pb.RoaResponse_INVALID,
+	cli.RValid:   pb.RoaResponse_VALID,
+}
+
+// roa is a single validated ROA payload.
+type roa struct {
+	prefix *net.IPNet
+	maxLen int
+	asn    uint32
+}
+
+// roaStore holds validated ROAs keyed by prefix, so covering ROAs can be found
+// with one lookup per prefix length.
+type roaStore struct {
+	roas  map[string][]roa
+	count int
+}
+
+// roaFile is the JSON exported by validators such as rpki-client and routinator.
+type roaFile struct {
+	Roas []struct {
+		Prefix    string          `json:"prefix"`
+		MaxLength int             `json:"maxLength"`
+		ASN       json.RawMessage `json:"asn"`
+	} `json:"roas"`
+}
+
+// loadROAs will read a validator JSON export into a roaStore.
+func loadROAs(name string) (*roaStore, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open ROA file: %v", err)
+	}
+	return decodeROAs(contents)
+}
+
+func decodeROAs(contents []byte) (*roaStore, error) {
+	var file roaFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("unable to decode ROA file: %v", err)
+	}
+
+	store := &roaStore{roas: make(map[string][]roa)}
+	for _, r := range file.Roas {
+		_, prefix, err := net.ParseCIDR(r.Prefix)
+		if err != nil {
+			log.Printf("skipping ROA with bad prefix %q: %v", r.Prefix, err)
+			continue
+		}
+		asn, err := decodeROAASN(r.ASN)
+		if err != nil {
+			log.Printf("skipping ROA for %s: %v", r.Prefix, err)
+			continue
+		}
+		store.add(roa{
+			prefix: prefix,
+			maxLen: r.MaxLength,
+			asn:    asn,
+		})
+	}
+
+	return store, nil
+}
+
+// decodeROAASN accepts the AS number as a number, or as a string with or without the AS prefix.
+func decodeROAASN(raw json.RawMessage) (uint32, error) {
+	in := strings.Trim(string(raw), `"`)
+	in = strings.TrimPrefix(strings.ToUpper(in), "AS")
+	asn, err := strconv.ParseUint(in, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad AS number %s", raw)
+	}
+	return uint32(asn), nil
+}
+
+func (r *roaStore) add(entry roa) {
+	key := entry.prefix.String()
+	r.roas[key] = append(r.roas[key], entry)
+	r.count++
+}
+
+// covering returns all ROAs whose prefix covers the given prefix.
+func (r *roaStore) covering(prefix *net.IPNet) []roa {
+	ones, bits := prefix.Mask.Size()
+	var found []roa
+	for l := 0; l <= ones; l++ {
+		mask := net.CIDRMask(l, bits)
+		key := (&net.IPNet{IP: prefix.IP.Mask(mask), Mask: mask}).String()
+		found = append(found, r.roas[key]...)
+	}
+	return found
+}
+
+// validate checks a prefix and origin against the ROAs as per RFC 6811,
+// returning the status along with the reason for it.
+func (r *roaStore) validate(prefix *net.IPNet, asn uint32) (int, *pb.RoaExplanation) {
+	explain := &pb.RoaExplanation{
+		OriginAsn: asn,
+	}
+	ones, _ := prefix.Mask.Size()
+
+	covering := r.covering(prefix)
+	var tooSpecific bool
+	status := cli.RUnknown
+	for _, c := range covering {
+		mask, _ := c.prefix.Mask.Size()
+		explain.Covering = append(explain.Covering, &pb.CoveringRoa{
+			Prefix: &pb.IpAddress{
+				Address: c.prefix.IP.String(),
+				Mask:    uint32(mask),
+			},
+			MaxLength: uint32(c.maxLen),
+			Asn:       c.asn,
+		})
+		// AS0 ROAs can never be matched.
+		if c.asn == 0 || c.asn != asn {
+			continue
+		}
+		if ones <= c.maxLen {
+			status = cli.RValid
+		} else {
+			tooSpecific = true
+		}
+	}
+
+	switch {
+	case status == cli.RValid:
+		explain.Reason = pb.RoaExplanation_MATCHED
+	case len(covering) == 0:
+		explain.Reason = pb.RoaExplanation_NO_COVERING_ROA
+	case tooSpecific:
+		status = cli.RInvalid
+		explain.Reason = pb.RoaExplanation_TOO_SPECIFIC
+	default:
+		status = cli.RInvalid
+		explain.Reason = pb.RoaExplanation_ORIGIN_MISMATCH
+	}
+
+	return status, explain
+}
+
+// refreshROAs will load ROAs from a local file, then reload every sleep interval.
+// If a reload fails, the previously loaded ROAs are kept.
+func (s *server) refreshROAs(name string, sleep time.Duration) {
+	for {
+		roas, err := loadROAs(name)
+		if err != nil {
+			log.Printf("Unable to load ROAs: %v", err)
+		} else {
+			s.mu.Lock()
+			s.roas = roas
+			s.mu.Unlock()
+			log.Printf("Loaded %d ROAs from local file", roas.count)
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// getROAStore returns the local ROAs, or nil if none are loaded.
+func (s *server) getROAStore() *roaStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roas
+}
+
+// ValidateBatch will validate each prefix and origin pair against the local ROAs.
+// A bad pair is noted in its own verdict rather than failing the whole batch.
+func (s *server) ValidateBatch(ctx context.Context, r *pb.ValidateBatchRequest) (*pb.ValidateBatchResponse, error) {
+	log.Printf("Running ValidateBatch")
+	defer com.TimeFunction(time.Now(), "ValidateBatch")
+
+	roas := s.getROAStore()
+	if roas == nil {
+		return &pb.ValidateBatchResponse{}, status.Error(codes.FailedPrecondition, "no local ROA file loaded")
+	}
+	if len(r.GetPairs()) > maxBatchSize {
+		return &pb.ValidateBatchResponse{}, status.Errorf(codes.InvalidArgument,
+			"batch of %d pairs is larger than the maximum of %d", len(r.GetPairs()), maxBatchSize)
+	}
+
+	verdicts := make([]*pb.RoaVerdict, 0, len(r.GetPairs()))
+	for _, pair := range r.GetPairs() {
+		verdict := &pb.RoaVerdict{
+			Prefix: pair.GetPrefix(),
+			Asn:    pair.GetAsn(),
+		}
+		verdicts = append(verdicts, verdict)
+
+		prefix := pair.GetPrefix()
+		_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix.GetAddress(), prefix.GetMask()))
+		if err != nil {
+			verdict.Error = fmt.Sprintf("invalid prefix: %v", err)
+			continue
+		}
+		state, explain := roas.validate(ipnet, pair.GetAsn())
+		verdict.Status = roaStatuses[state]
+		verdict.Reason = explain.GetReason()
+	}
+
+	return &pb.ValidateBatchResponse{
+		Verdicts: verdicts,
+	}, nil
+}
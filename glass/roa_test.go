@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	cli "github.com/mellowdrifter/bgp_infrastructure/clidecode"
+	pb "github.com/mellowdrifter/bgp_infrastructure/proto/glass"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testROAs mixes the routinator (string) and rpki-client (number) AS formats.
+const testROAs = `{
+  "roas": [
+    {"asn": "AS13335", "prefix": "1.1.1.0/24", "maxLength": 24, "ta": "apnic"},
+    {"asn": 15169, "prefix": "8.8.8.0/23", "maxLength": 23, "ta": "arin"},
+    {"asn": "AS0", "prefix": "9.9.0.0/16", "maxLength": 24, "ta": "arin"},
+    {"asn": "AS15169", "prefix": "2001:4860::/32", "maxLength": 48, "ta": "arin"}
+  ]
+}`
+
+func TestDecodeROAs(t *testing.T) {
+	store, err := decodeROAs([]byte(testROAs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.count != 4 {
+		t.Errorf("got %d ROAs, want 4", store.count)
+	}
+	if _, err := decodeROAs([]byte("not json")); err == nil {
+		t.Error("expected an error decoding a bad ROA file")
+	}
+}
+
+func TestROAValidate(t *testing.T) {
+	store, err := decodeROAs([]byte(testROAs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		prefix   string
+		asn      uint32
+		status   int
+		reason   pb.RoaExplanation_Reason
+		covering int
+	}{
+		{
+			name:     "Valid",
+			prefix:   "1.1.1.0/24",
+			asn:      13335,
+			status:   cli.RValid,
+			reason:   pb.RoaExplanation_MATCHED,
+			covering: 1,
+		},
+		{
+			name:   "No covering ROA",
+			prefix: "4.4.4.0/24",
+			asn:    3356,
+			status: cli.RUnknown,
+			reason: pb.RoaExplanation_NO_COVERING_ROA,
+		},
+		{
+			name:     "Origin mismatch",
+			prefix:   "1.1.1.0/24",
+			asn:      15169,
+			status:   cli.RInvalid,
+			reason:   pb.RoaExplanation_ORIGIN_MISMATCH,
+			covering: 1,
+		},
+		{
+			name:     "More specific than max length",
+			prefix:   "8.8.8.0/24",
+			asn:      15169,
+			status:   cli.RInvalid,
+			reason:   pb.RoaExplanation_TOO_SPECIFIC,
+			covering: 1,
+		},
+		{
+			name:     "AS0 never matches",
+			prefix:   "9.9.9.0/24",
+			asn:      0,
+			status:   cli.RInvalid,
+			reason:   pb.RoaExplanation_ORIGIN_MISMATCH,
+			covering: 1,
+		},
+		{
+			name:     "IPv6 valid",
+			prefix:   "2001:4860:4860::/48",
+			asn:      15169,
+			status:   cli.RValid,
+			reason:   pb.RoaExplanation_MATCHED,
+			covering: 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, prefix, _ := net.ParseCIDR(tc.prefix)
+			status, explain := store.validate(prefix, tc.asn)
+			if status != tc.status {
+				t.Errorf("got status %d, want %d", status, tc.status)
+			}
+			if explain.GetReason() != tc.reason {
+				t.Errorf("got reason %v, want %v", explain.GetReason(), tc.reason)
+			}
+			if len(explain.GetCovering()) != tc.covering {
+				t.Errorf("got %d covering ROAs, want %d", len(explain.GetCovering()), tc.covering)
+			}
+		})
+	}
+}
+
+func TestRoaExplain(t *testing.T) {
+	store, err := decodeROAs([]byte(testROAs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := getTestServer(fakeRouter{
+		route:  parseCIDRs(t, "8.8.8.0/24")[0],
+		origin: 15169,
+	})
+	srv.roas = store
+
+	req := &pb.RoaRequest{IpAddress: &pb.IpAddress{Address: "8.8.8.8"}}
+	resp, err := srv.Roa(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetExplanation() != nil {
+		t.Errorf("explanation should only be added on request, got %v", resp.GetExplanation())
+	}
+
+	// The second request is served from the cache, but still explained.
+	req.Explain = true
+	resp, err = srv.Roa(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetExplanation().GetReason() != pb.RoaExplanation_TOO_SPECIFIC {
+		t.Errorf("got reason %v, want %v", resp.GetExplanation().GetReason(), pb.RoaExplanation_TOO_SPECIFIC)
+	}
+	if resp.GetExplanation().GetOriginAsn() != 15169 {
+		t.Errorf("got origin %d, want 15169", resp.GetExplanation().GetOriginAsn())
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	srv := getTestServer(fakeRouter{})
+
+	req := &pb.ValidateBatchRequest{
+		Pairs: []*pb.RoaPair{
+			{Prefix: &pb.IpAddress{Address: "1.1.1.0", Mask: 24}, Asn: 13335},
+			{Prefix: &pb.IpAddress{Address: "1.1.1.0", Mask: 24}, Asn: 15169},
+			{Prefix: &pb.IpAddress{Address: "8.8.8.0", Mask: 24}, Asn: 15169},
+			{Prefix: &pb.IpAddress{Address: "4.4.4.0", Mask: 24}, Asn: 3356},
+			{Prefix: &pb.IpAddress{Address: "2001:4860::", Mask: 32}, Asn: 15169},
+			{Prefix: &pb.IpAddress{Address: "not an address", Mask: 24}, Asn: 15169},
+		},
+	}
+
+	// Without a local ROA file there is nothing to validate against.
+	if _, err := srv.ValidateBatch(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got error %v, want FailedPrecondition", err)
+	}
+
+	store, err := decodeROAs([]byte(testROAs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.roas = store
+
+	resp, err := srv.ValidateBatch(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		status pb.RoaResponse_ROAStatus
+		reason pb.RoaExplanation_Reason
+		err    bool
+	}{
+		{status: pb.RoaResponse_VALID, reason: pb.RoaExplanation_MATCHED},
+		{status: pb.RoaResponse_INVALID, reason: pb.RoaExplanation_ORIGIN_MISMATCH},
+		{status: pb.RoaResponse_INVALID, reason: pb.RoaExplanation_TOO_SPECIFIC},
+		{status: pb.RoaResponse_UNKNOWN, reason: pb.RoaExplanation_NO_COVERING_ROA},
+		{status: pb.RoaResponse_VALID, reason: pb.RoaExplanation_MATCHED},
+		{err: true},
+	}
+	if len(resp.GetVerdicts()) != len(want) {
+		t.Fatalf("got %d verdicts, want %d", len(resp.GetVerdicts()), len(want))
+	}
+	for i, w := range want {
+		v := resp.GetVerdicts()[i]
+		if v.GetAsn() != req.GetPairs()[i].GetAsn() || v.GetPrefix().GetAddress() != req.GetPairs()[i].GetPrefix().GetAddress() {
+			t.Errorf("verdict %d is for %v AS%d, want the requested pair", i, v.GetPrefix(), v.GetAsn())
+		}
+		if (v.GetError() != "") != w.err {
+			t.Errorf("verdict %d: got error %q, want error %t", i, v.GetError(), w.err)
+			continue
+		}
+		if v.GetStatus() != w.status || v.GetReason() != w.reason {
+			t.Errorf("verdict %d: got %v/%v, want %v/%v", i, v.GetStatus(), v.GetReason(), w.status, w.reason)
+		}
+	}
+}
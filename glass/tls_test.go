@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testCA issues certificates for TLS tests, writing them as PEM to a temp dir.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key, ca.file = ca.issue("ca", &x509.Certificate{
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	return ca
+}
+
+// issue signs the template with the CA, or itself if there's no CA yet, and
+// returns the certificate and key along with the certificate file.
+func (ca *testCA) issue(name string, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := tmpl, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	file := filepath.Join(ca.dir, name+".pem")
+	ca.write(file, "CERTIFICATE", der)
+	ca.write(filepath.Join(ca.dir, name+".key"), "EC PRIVATE KEY", keyDer)
+	return cert, key, file
+}
+
+func (ca *testCA) write(file, kind string, der []byte) {
+	ca.t.Helper()
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+// serveTLS starts a health server with the credentials, returning its address.
+func serveTLS(t *testing.T, creds credentials.TransportCredentials) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.Creds(creds))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// checkTLS makes a health check over a connection with the credentials.
+func checkTLS(t *testing.T, addr string, creds credentials.TransportCredentials) error {
+	t.Helper()
+	conn, err := dialGRPC(addr, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	_, _, serverCert := ca.issue("server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	serverKey := filepath.Join(ca.dir, "server.key")
+	client, err := clientCreds(ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := serverCreds(serverCert, serverKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, creds)
+	if err := checkTLS(t, addr, client); err != nil {
+		t.Errorf("unable to reach the TLS server with the test CA: %v", err)
+	}
+	if err := checkTLS(t, addr, credentials.NewTLS(&tls.Config{})); err == nil {
+		t.Error("reached the TLS server without trusting the test CA")
+	}
+
+	// With a client CA, clients need a certificate signed by it.
+	creds, err = serverCreds(serverCert, serverKey, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = serveTLS(t, creds)
+	if err := checkTLS(t, addr, client); err == nil {
+		t.Error("reached the mutual TLS server without a client certificate")
+	}
+	_, _, clientCert := ca.issue("client", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	pair, err := tls.LoadX509KeyPair(clientCert, filepath.Join(ca.dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := certPool(ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutual := credentials.NewTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{pair}})
+	if err := checkTLS(t, addr, mutual); err != nil {
+		t.Errorf("unable to reach the mutual TLS server with a client certificate: %v", err)
+	}
+
+	if _, err := clientCreds(filepath.Join(ca.dir, "server.key")); err == nil {
+		t.Error("expected an error loading a CA with no certificates")
+	}
+}
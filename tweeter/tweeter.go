@@ -4,17 +4,21 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	com "github.com/mellowdrifter/bgp_infrastructure/common"
 	bpb "github.com/mellowdrifter/bgp_infrastructure/tweeter/proto/bgpsql"
 	gpb "github.com/mellowdrifter/bgp_infrastructure/tweeter/proto/grapher"
 
@@ -50,16 +54,105 @@ type toTweet struct {
 	subnetPie bool
 
 	rpkiPie bool
+
+	// topMovers tweets the ASNs with the largest change in originated prefixes.
+	topMovers bool
+
+	// asns tweets how many ASNs originate each address family.
+	asns bool
 }
 
 type config struct {
-	log     string
-	grapher string
-	action  *string
-	time    *string
-	servers []string
-	file    *ini.File
-	dryRun  bool
+	log       string
+	grapher   string
+	timeout   time.Duration
+	copyright string
+	v4Account string
+	v6Account string
+	action    *string
+	time      *string
+	output    *string
+	check     *bool
+	servers   []string
+	bots      []bot
+	file      *ini.File
+	dryRun    bool
+}
+
+// bot is a pair of accounts posting a chosen set of actions, with data from its
+// own bgpinfo servers.
+type bot struct {
+	name      string
+	v4Account string
+	v6Account string
+	servers   []string
+	actions   []string
+}
+
+// actionNames maps each action a bot can be configured with to its todo field.
+var actionNames = map[string]func(*toTweet) *bool{
+	"current":  func(t *toTweet) *bool { return &t.tableSize },
+	"week":     func(t *toTweet) *bool { return &t.weekGraph },
+	"month":    func(t *toTweet) *bool { return &t.monthGraph },
+	"sixmonth": func(t *toTweet) *bool { return &t.sixMonthGraph },
+	"annual":   func(t *toTweet) *bool { return &t.annualGraph },
+	"subnets":  func(t *toTweet) *bool { return &t.subnetPie },
+	"rpki":     func(t *toTweet) *bool { return &t.rpkiPie },
+	"movers":   func(t *toTweet) *bool { return &t.topMovers },
+	"asns":     func(t *toTweet) *bool { return &t.asns },
+}
+
+// allActionNames returns the name of every action, sorted.
+func allActionNames() []string {
+	var names []string
+	for name := range actionNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// only returns the todo list limited to the bot's actions.
+func (b bot) only(todo toTweet) toTweet {
+	var out toTweet
+	for _, a := range b.actions {
+		field, ok := actionNames[a]
+		if !ok {
+			continue
+		}
+		*field(&out) = *field(&todo)
+	}
+	return out
+}
+
+// loadBots reads each [bot.NAME] section. With none configured, a single bot
+// posts everything to the [accounts] pair using the [bgpinfo] servers.
+func loadBots(cf *ini.File, c config) []bot {
+	var bots []bot
+	for _, sec := range cf.Section("bot").ChildSections() {
+		b := bot{
+			name:      strings.TrimPrefix(sec.Name(), "bot."),
+			v4Account: sec.Key("v4").String(),
+			v6Account: sec.Key("v6").String(),
+			servers:   sec.Key("server").ValueWithShadows(),
+			actions:   sec.Key("actions").Strings(","),
+		}
+		if len(b.actions) == 0 {
+			b.actions = allActionNames()
+		}
+		bots = append(bots, b)
+	}
+	if len(bots) > 0 {
+		return bots
+	}
+
+	return []bot{{
+		name:      "default",
+		v4Account: c.v4Account,
+		v6Account: c.v6Account,
+		servers:   c.servers,
+		actions:   allActionNames(),
+	}}
 }
 
 type tweeter struct {
@@ -86,14 +179,70 @@ func setup() (config, error) {
 	config.file = cf
 
 	config.grapher = cf.Section("grapher").Key("server").String()
+	config.timeout = cf.Section("grapher").Key("timeout").MustDuration(defaultGrapherTimeout)
 	config.servers = cf.Section("bgpinfo").Key("server").ValueWithShadows()
+	config.copyright = cf.Section("grapher").Key("copyright").MustString(defaultCopyright)
+	config.v4Account = cf.Section("accounts").Key("v4").MustString(defaultV4Account)
+	config.v6Account = cf.Section("accounts").Key("v6").MustString(defaultV6Account)
+	config.bots = loadBots(cf, config)
 
+	config.output = flag.String("output", "", "set to json to print all composed tweets to stdout and exit")
+	config.check = flag.Bool("checkconfig", false, "validate config.ini and exit")
 	flag.Parse()
 
 	return config, nil
 
 }
 
+// Defaults used when not set in the config file.
+const (
+	defaultCopyright      = "data by @mellowdrifter | www.mellowd.dev"
+	defaultGrapherTimeout = 10 * time.Second
+	defaultV4Account      = "bgp4table"
+	defaultV6Account      = "bgp6table"
+)
+
+// checkConfig validates the config file without starting the service.
+func checkConfig(cf *ini.File) error {
+	var c com.ConfigCheck
+
+	c.Required("grapher", "server", cf.Section("grapher").Key("server").String())
+	c.Duration("grapher", "timeout", cf.Section("grapher").Key("timeout").String())
+
+	// Each bot brings its own accounts and servers. Without any, the
+	// [accounts] pair posts using the [bgpinfo] servers.
+	var accounts []string
+	bots := cf.Section("bot").ChildSections()
+	for _, sec := range bots {
+		c.Required(sec.Name(), "v4", sec.Key("v4").String())
+		c.Required(sec.Name(), "v6", sec.Key("v6").String())
+		c.Required(sec.Name(), "server", sec.Key("server").String())
+		for _, action := range sec.Key("actions").Strings(",") {
+			c.OneOf(sec.Name(), "actions", action, allActionNames()...)
+		}
+		accounts = append(accounts, sec.Key("v4").String(), sec.Key("v6").String())
+	}
+	if len(bots) == 0 {
+		c.Required("bgpinfo", "server", cf.Section("bgpinfo").Key("server").String())
+		accounts = []string{
+			cf.Section("accounts").Key("v4").MustString(defaultV4Account),
+			cf.Section("accounts").Key("v6").MustString(defaultV6Account),
+		}
+	}
+
+	// Each account needs credentials to post.
+	for _, account := range accounts {
+		if account == "" {
+			continue
+		}
+		for _, cred := range []string{"consumerKey", "consumerSecret", "accessToken", "accessSecret"} {
+			c.Required(account, cred, cf.Section(account).Key(cred).String())
+		}
+	}
+
+	return c.Err()
+}
+
 // Cloud Run should use this.
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -103,6 +252,28 @@ func main() {
 		log.Fatalf("unable to set things up: %v", err)
 	}
 
+	if *cfg.check {
+		if err := checkConfig(cfg.file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config OK")
+		return
+	}
+
+	// Print everything we would tweet as JSON, then exit.
+	if *cfg.output == "json" {
+		cfg.dryRun = true
+		tweetList, err := botTweets(allActions(), cfg, getTweets)
+		if err != nil {
+			log.Fatalf("unable to get tweets: %v", err)
+		}
+		if err := writeJSON(os.Stdout, tweetList); err != nil {
+			log.Fatalf("unable to write tweets as json: %v", err)
+		}
+		return
+	}
+
 	var srv tweeter
 	srv.mux = http.NewServeMux()
 	srv.cfg = cfg
@@ -149,7 +320,7 @@ func (t *tweeter) dryrun() http.HandlerFunc {
 		todo.annualGraph = true
 		// TEMP
 
-		tweetList, err := getTweets(todo, t.cfg)
+		tweetList, err := botTweets(todo, t.cfg, getTweets)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "unable to get tweets: %v", err)
@@ -182,7 +353,7 @@ func (t *tweeter) post() http.HandlerFunc {
 
 		t.cfg.dryRun = false
 
-		tweetList, err := getTweets(todo, t.cfg)
+		tweetList, err := botTweets(todo, t.cfg, getTweets)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "unable to get tweets: %v", err)
@@ -261,10 +432,53 @@ func getTweets(todo toTweet, cfg config) ([]tweet, error) {
 		listOfTweets = append(listOfTweets, tweets...)
 	}
 
+	if todo.topMovers {
+		tweets, err := topMovers(cfg)
+		if err != nil {
+			return listOfTweets, fmt.Errorf("Unable to generate top movers tweets: %v", err)
+		}
+		listOfTweets = append(listOfTweets, tweets...)
+	}
+
+	if todo.asns {
+		tweets, err := asns(cfg)
+		if err != nil {
+			return listOfTweets, fmt.Errorf("Unable to generate ASN tweets: %v", err)
+		}
+		listOfTweets = append(listOfTweets, tweets...)
+	}
+
 	return listOfTweets, nil
 
 }
 
+// botTweets composes the todo list for each bot, using its own accounts and
+// servers and only the actions it's configured for. A failing bot is logged
+// and skipped, so an error is returned only if every bot failed.
+func botTweets(todo toTweet, cfg config, compose func(toTweet, config) ([]tweet, error)) ([]tweet, error) {
+	var listOfTweets []tweet
+	var failed int
+	for _, b := range cfg.bots {
+		c := cfg
+		c.v4Account = b.v4Account
+		c.v6Account = b.v6Account
+		c.servers = b.servers
+
+		tweets, err := compose(b.only(todo), c)
+		if err != nil {
+			log.Printf("Unable to compose tweets for bot %s: %v", b.name, err)
+			failed++
+			continue
+		}
+		listOfTweets = append(listOfTweets, tweets...)
+	}
+	if failed > 0 && failed == len(cfg.bots) {
+		return listOfTweets, fmt.Errorf("unable to compose tweets for any of the %d bots", failed)
+	}
+
+	return listOfTweets, nil
+}
+
 // whatToTweet will determine exactly what information should be tweeted. This
 // is all determined by the time and day on which it's called.
 func whatToTweet(now time.Time) toTweet {
@@ -308,9 +522,53 @@ func whatToTweet(now time.Time) toTweet {
 	// On Thursday I tweet the RPKI status.
 	todo.rpkiPie = (now.Weekday() == time.Thursday)
 
+	// On Friday I tweet the top movers of the week.
+	todo.topMovers = (now.Weekday() == time.Friday)
+
+	// On Saturday I tweet the ASN totals.
+	todo.asns = (now.Weekday() == time.Saturday)
+
 	return todo
 }
 
+// allActions returns a todo list with every action set.
+func allActions() toTweet {
+	return toTweet{
+		tableSize:     true,
+		weekGraph:     true,
+		monthGraph:    true,
+		sixMonthGraph: true,
+		annualGraph:   true,
+		subnetPie:     true,
+		rpkiPie:       true,
+		topMovers:     true,
+		asns:          true,
+	}
+}
+
+// jsonTweet is the structured form of a tweet for downstream consumers.
+// Media is base64 encoded by encoding/json.
+type jsonTweet struct {
+	Account string `json:"account"`
+	Message string `json:"message"`
+	Media   []byte `json:"media,omitempty"`
+}
+
+// writeJSON writes the list of tweets to w as a JSON array.
+func writeJSON(w io.Writer, tweets []tweet) error {
+	out := make([]jsonTweet, 0, len(tweets))
+	for _, t := range tweets {
+		out = append(out, jsonTweet{
+			Account: t.account,
+			Message: t.message,
+			Media:   t.media,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
 func run() {
 
 	/*
@@ -328,15 +586,19 @@ func getConnection(srv string) (*grpc.ClientConn, error) {
 }
 
 // getTLSConnection is the same as getConnection, but it uses TLS as an option
-// as is required by Google Cloud Run.
-func getTLSConnection(srv string) (*grpc.ClientConn, error) {
+// as is required by Google Cloud Run. It blocks until the server is reached, so
+// a dead server is reported once the timeout expires.
+func getTLSConnection(srv string, timeout time.Duration) (*grpc.ClientConn, error) {
 	creds := credentials.NewTLS(&tls.Config{
 		InsecureSkipVerify: true,
 	})
 	opts := []grpc.DialOption{
 		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(),
 	}
-	tconn, err := grpc.Dial(srv, opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tconn, err := grpc.DialContext(ctx, srv, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to dial gRPC server: %v", err)
 	}
@@ -396,7 +658,7 @@ func allCurrent(c config) ([]tweet, error) {
 	for i, v := range connections {
 		if v.err == nil {
 			log.Printf("Connecting to server %d at %v\n", i+1, v.conn.Target())
-			tw, err := current(bpb.NewBgpInfoClient(v.conn), c.dryRun)
+			tw, err := current(bpb.NewBgpInfoClient(v.conn), c)
 			res = append(res, tweetErr{tweets: tw, err: err})
 		}
 	}
@@ -413,7 +675,7 @@ func allCurrent(c config) ([]tweet, error) {
 }
 
 // current grabs the current v4 and v6 table count for tweeting.
-func current(b bpb.BgpInfoClient, dryrun bool) ([]tweet, error) {
+func current(b bpb.BgpInfoClient, c config) ([]tweet, error) {
 
 	log.Println("Running current")
 	counts, err := b.GetPrefixCount(context.Background(), &bpb.Empty{})
@@ -432,10 +694,10 @@ func current(b bpb.BgpInfoClient, dryrun bool) ([]tweet, error) {
 	}
 
 	// Calculate deltas.
-	v4DeltaH := int(counts.GetActive_4()) - int(counts.GetSixhoursv4())
-	v6DeltaH := int(counts.GetActive_6()) - int(counts.GetSixhoursv6())
-	v4DeltaW := int(counts.GetActive_4()) - int(counts.GetWeekagov4())
-	v6DeltaW := int(counts.GetActive_6()) - int(counts.GetWeekagov6())
+	v4DeltaH := delta(counts.GetActive_4(), counts.GetSixhoursv4())
+	v6DeltaH := delta(counts.GetActive_6(), counts.GetSixhoursv6())
+	v4DeltaW := delta(counts.GetActive_4(), counts.GetWeekagov4())
+	v6DeltaW := delta(counts.GetActive_6(), counts.GetWeekagov6())
 
 	// Calculate large subnets percentages
 	percentV4 := float32(counts.GetSlash24()) / float32(counts.GetActive_4()) * 100
@@ -452,21 +714,27 @@ func current(b bpb.BgpInfoClient, dryrun bool) ([]tweet, error) {
 	v6Update.WriteString(fmt.Sprintf(". %.2f%% of prefixes are /48.", percentV6))
 
 	v4Tweet := tweet{
-		account: "bgp4table",
+		account: c.v4Account,
 		message: v4Update.String(),
 	}
 	v6Tweet := tweet{
-		account: "bgp6table",
+		account: c.v6Account,
 		message: v6Update.String(),
 	}
 
-	if err := setTweetBit(b, counts.GetTime(), dryrun); err != nil {
+	if err := setTweetBit(b, counts.GetTime(), c.dryRun); err != nil {
 		log.Printf("Unable to set tweet bit, but continuing on: %v", err)
 	}
 	return []tweet{v4Tweet, v6Tweet}, nil
 
 }
 
+// delta returns the change from then to now. Counts are converted before the
+// subtraction, so a count that has dropped is negative rather than wrapping.
+func delta(now, then uint32) int {
+	return int(int64(now) - int64(then))
+}
+
 // deltaMessage creates the update message itself. Uses the deltas to formulate the exact message.
 func deltaMessage(h, w int) string {
 	log.Println("Running deltaMessage")
@@ -534,13 +802,60 @@ func subnets(c config) ([]tweet, error) {
 	cpb := bpb.NewBgpInfoClient(conn)
 	pieData, err := cpb.GetPieSubnets(context.Background(), &bpb.Empty{})
 	if err != nil {
-		log.Fatalf("Unable to send proto: %s", err)
+		return nil, err
 	}
 
+	req := pieChartRequest(c, pieData)
+
+	return graphTweets(c, req.GetMetadatas()[0].GetTitle(), req.GetMetadatas()[1].GetTitle(),
+		func(ctx context.Context, g gpb.GrapherClient) (*gpb.GrapherResponse, error) {
+			return g.GetPieChart(ctx, req)
+		}), nil
+
+}
+
+// maskCounts returns the amount of prefixes for each mask used in the subnet pie charts.
+func maskCounts(m *bpb.Masks) (map[int]uint32, map[int]uint32) {
+	v4 := map[int]uint32{
+		16: m.GetV4_16(),
+		17: m.GetV4_17(),
+		18: m.GetV4_18(),
+		19: m.GetV4_19(),
+		20: m.GetV4_20(),
+		21: m.GetV4_21(),
+		22: m.GetV4_22(),
+		23: m.GetV4_23(),
+		24: m.GetV4_24(),
+	}
+	v6 := map[int]uint32{
+		29: m.GetV6_29(),
+		32: m.GetV6_32(),
+		36: m.GetV6_36(),
+		40: m.GetV6_40(),
+		44: m.GetV6_44(),
+		48: m.GetV6_48(),
+	}
+	return v4, v6
+}
+
+// pieChartRequest packs the subnet counts into a request for the grapher.
+func pieChartRequest(c config, pieData *bpb.PieSubnetsResponse) *gpb.PieChartRequest {
 	v4Colours := []string{"burlywood", "lightgreen", "lightskyblue", "lightcoral", "gold"}
 	v6Colours := []string{"lightgreen", "burlywood", "lightskyblue", "violet", "linen", "lightcoral", "gold"}
-	v4Labels := []string{"/19-/21", "/16-/18", "/22", "/23", "/24"}
-	v6Labels := []string{"/32", "/44", "/40", "/36", "/29", "The Rest", "/48"}
+
+	v4, v6 := maskCounts(pieData.GetMasks())
+	v4Buckets, v6Buckets := com.SubnetBuckets(v4, v6, pieData.GetV6Total())
+
+	var v4Labels, v6Labels []string
+	var v4Subnets, v6Subnets []uint32
+	for _, b := range v4Buckets {
+		v4Labels = append(v4Labels, b.Label)
+		v4Subnets = append(v4Subnets, b.Count)
+	}
+	for _, b := range v6Buckets {
+		v6Labels = append(v6Labels, b.Label)
+		v6Subnets = append(v6Subnets, b.Count)
+	}
 
 	t := time.Now()
 	v4Meta := &gpb.Metadata{
@@ -558,71 +873,19 @@ func subnets(c config) ([]tweet, error) {
 		Labels:  v6Labels,
 	}
 
-	v4Subnets := []uint32{
-		pieData.GetMasks().GetV4_19() + pieData.GetMasks().GetV4_20() + pieData.GetMasks().GetV4_21(),
-		pieData.GetMasks().GetV4_16() + pieData.GetMasks().GetV4_17() + pieData.GetMasks().GetV4_18(),
-		pieData.GetMasks().GetV4_22(),
-		pieData.GetMasks().GetV4_23(),
-		pieData.GetMasks().GetV4_24(),
-	}
-	v6Subnets := []uint32{
-		pieData.GetMasks().GetV6_32(),
-		pieData.GetMasks().GetV6_44(),
-		pieData.GetMasks().GetV6_40(),
-		pieData.GetMasks().GetV6_36(),
-		pieData.GetMasks().GetV6_29(),
-		pieData.GetV6Total() - pieData.GetMasks().GetV6_32() - pieData.GetMasks().GetV6_44() -
-			pieData.GetMasks().GetV6_40() - pieData.GetMasks().GetV6_36() - pieData.GetMasks().GetV6_29() -
-			pieData.GetMasks().GetV6_48(),
-		pieData.GetMasks().GetV6_48(),
-	}
-
-	// Dial the grapher to retrieve graphs via matplotlib
-	// TODO: IS this not too much stuff in a single function?
-	req := &gpb.PieChartRequest{
+	return &gpb.PieChartRequest{
 		Metadatas: []*gpb.Metadata{v4Meta, v6Meta},
 		Subnets: &gpb.SubnetFamily{
 			V4Values: v4Subnets,
 			V6Values: v6Subnets,
 		},
-		Copyright: "data by @mellowdrifter | www.mellowd.dev",
+		Copyright: c.copyright,
 	}
-
-	grp, err := getTLSConnection(c.grapher)
-	defer grp.Close()
-	gpb := gpb.NewGrapherClient(grp)
-
-	resp, err := gpb.GetPieChart(context.Background(), req)
-	if err != nil {
-		return nil, err
-	}
-
-	// There should be two images, if not something's gone wrong.
-	if len(resp.GetImages()) < 2 {
-		return nil, fmt.Errorf("Less than two images returned")
-	}
-
-	v4Tweet := tweet{
-		account: "bgp4table",
-		message: v4Meta.Title,
-		media:   resp.GetImages()[0].GetImage(),
-	}
-	v6Tweet := tweet{
-		account: "bgp6table",
-		message: v6Meta.Title,
-		media:   resp.GetImages()[1].GetImage(),
-	}
-
-	return []tweet{v4Tweet, v6Tweet}, nil
-
 }
 
 func movement(c config, p bpb.MovementRequest_TimePeriod) ([]tweet, error) {
 	log.Println("Running movement")
 
-	// Get yesterday's date
-	y := time.Now().AddDate(0, 0, -1)
-
 	conn, err := getLiveServer(c)
 	defer conn.Close()
 	if err != nil {
@@ -655,6 +918,61 @@ func movement(c config, p bpb.MovementRequest_TimePeriod) ([]tweet, error) {
 		return nil, fmt.Errorf("Time Period not set")
 	}
 
+	req := lineGraphRequest(c, period, graphData)
+
+	return graphTweets(c, message, message,
+		func(ctx context.Context, g gpb.GrapherClient) (*gpb.GrapherResponse, error) {
+			return g.GetLineGraph(ctx, req)
+		}), nil
+
+}
+
+// graphTweets returns the v4 and v6 tweets with the images drawn by the grapher.
+// If the grapher can't be reached or fails to draw, the tweets are text-only so
+// the daily post still goes out.
+func graphTweets(c config, v4, v6 string, draw func(context.Context, gpb.GrapherClient) (*gpb.GrapherResponse, error)) []tweet {
+	v4Tweet := tweet{
+		account: c.v4Account,
+		message: v4,
+	}
+	v6Tweet := tweet{
+		account: c.v6Account,
+		message: v6,
+	}
+
+	// Dial the grapher to retrieve graphs via matplotlib
+	grp, err := getTLSConnection(c.grapher, c.timeout)
+	if err != nil {
+		log.Printf("Posting text-only, grapher unavailable: %v", err)
+		return []tweet{v4Tweet, v6Tweet}
+	}
+	defer grp.Close()
+
+	// A grapher can accept the connection and then hang, so drawing is limited too.
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	resp, err := draw(ctx, gpb.NewGrapherClient(grp))
+	if err != nil {
+		log.Printf("Posting text-only, grapher failed: %v", err)
+		return []tweet{v4Tweet, v6Tweet}
+	}
+
+	// There should be two images, if not something's gone wrong.
+	if len(resp.GetImages()) < 2 {
+		log.Printf("Posting text-only, less than two images returned")
+		return []tweet{v4Tweet, v6Tweet}
+	}
+	v4Tweet.media = resp.GetImages()[0].GetImage()
+	v6Tweet.media = resp.GetImages()[1].GetImage()
+
+	return []tweet{v4Tweet, v6Tweet}
+}
+
+// lineGraphRequest packs the table movement totals into a request for the grapher.
+func lineGraphRequest(c config, period string, graphData *bpb.MovementTotalsResponse) *gpb.LineGraphRequest {
+	// Get yesterday's date
+	y := time.Now().AddDate(0, 0, -1)
+
 	// metadata to create images
 	v4Meta := &gpb.Metadata{
 		Title:  fmt.Sprintf("IPv4 table movement for %s ending %s", period, y.Format("02-Jan-2006")),
@@ -678,44 +996,12 @@ func movement(c config, p bpb.MovementRequest_TimePeriod) ([]tweet, error) {
 			Time:     i.GetTime(),
 		})
 	}
-	req := &gpb.LineGraphRequest{
+
+	return &gpb.LineGraphRequest{
 		Metadatas:  []*gpb.Metadata{v4Meta, v6Meta},
 		TotalsTime: tt,
-		Copyright:  "data by @mellowdrifter | www.mellowd.dev",
-	}
-
-	// Dial the grapher to retrive graphs via matplotlib
-	// TODO: seperate this?
-	grp, err := getTLSConnection(c.grapher)
-	if err != nil {
-		return nil, err
+		Copyright:  c.copyright,
 	}
-	defer grp.Close()
-	gpb := gpb.NewGrapherClient(grp)
-
-	resp, err := gpb.GetLineGraph(context.Background(), req)
-	if err != nil {
-		return nil, err
-	}
-
-	// There should be two images, if not something's gone wrong.
-	if len(resp.GetImages()) < 2 {
-		return nil, fmt.Errorf("Less than two images returned")
-	}
-
-	v4Tweet := tweet{
-		account: "bgp4table",
-		message: message,
-		media:   resp.GetImages()[0].GetImage(),
-	}
-	v6Tweet := tweet{
-		account: "bgp6table",
-		message: message,
-		media:   resp.GetImages()[1].GetImage(),
-	}
-
-	return []tweet{v4Tweet, v6Tweet}, nil
-
 }
 
 func rpki(c config) ([]tweet, error) {
@@ -759,40 +1045,153 @@ func rpki(c config) ([]tweet, error) {
 	req := &gpb.RPKIRequest{
 		Metadatas: []*gpb.Metadata{v4Meta, v6Meta},
 		Rpkis:     rpkis,
-		Copyright: "data by @mellowdrifter | www.mellowd.dev",
+		Copyright: c.copyright,
 	}
 
-	// Dial the grapher to retrive graphs via matplotlib
-	grp, err := getTLSConnection(c.grapher)
+	return graphTweets(c, "Current RPKI status IPv4 #RPKI", "Current RPKI status IPv6 #RPKI",
+		func(ctx context.Context, g gpb.GrapherClient) (*gpb.GrapherResponse, error) {
+			return g.GetRPKI(ctx, req)
+		}), nil
+
+}
+
+// topMovers tweets the ASNs that added or removed the most prefixes this week.
+func topMovers(c config) ([]tweet, error) {
+	log.Println("Running topMovers")
+
+	conn, err := getLiveServer(c)
 	if err != nil {
 		return nil, err
 	}
-	defer grp.Close()
-	gpb := gpb.NewGrapherClient(grp)
+	defer conn.Close()
+
+	return topMoversTweets(bpb.NewBgpInfoClient(conn), c)
+}
+
+// topMoversTweets creates a tweet for each address family listing the top movers.
+func topMoversTweets(b bpb.BgpInfoClient, c config) ([]tweet, error) {
+	families := []struct {
+		family  bpb.AddressFamily
+		name    string
+		account string
+	}{
+		{bpb.AddressFamily_IPV4, "IPv4", c.v4Account},
+		{bpb.AddressFamily_IPV6, "IPv6", c.v6Account},
+	}
+
+	var tweets []tweet
+	for _, f := range families {
+		movers, err := b.GetTopMovers(context.Background(), &bpb.TopMoversRequest{
+			Period: bpb.MovementRequest_WEEK,
+			Family: f.family,
+			Count:  5,
+		})
+		if err != nil {
+			return nil, err
+		}
+		tweets = append(tweets, tweet{
+			account: f.account,
+			message: moversMessage(f.name, movers.GetMovers()),
+		})
+	}
+
+	return tweets, nil
+}
 
-	resp, err := gpb.GetRPKI(context.Background(), req)
+// moversMessage lists each mover and the change in prefixes they originate.
+func moversMessage(family string, movers []*bpb.Mover) string {
+	var update strings.Builder
+	update.WriteString(fmt.Sprintf("Largest %s origin changes this week:", family))
+	for _, m := range movers {
+		update.WriteString(fmt.Sprintf("\nAS%d", m.GetAsNumber()))
+		if name := m.GetAsName(); name != "" {
+			// Keep long names from pushing the tweet over the limit.
+			if r := []rune(name); len(r) > 20 {
+				name = string(r[:20])
+			}
+			update.WriteString(fmt.Sprintf(" (%s)", name))
+		}
+		update.WriteString(fmt.Sprintf(" %+d", m.GetDelta()))
+	}
+
+	return update.String()
+}
+
+// asns tweets how many ASNs originate each address family, and the change from a week ago.
+func asns(c config) ([]tweet, error) {
+	log.Println("Running asns")
+
+	conn, err := getLiveServer(c)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	// There should be two images, if not something's gone wrong.
-	if len(resp.GetImages()) < 2 {
-		return nil, fmt.Errorf("Less than two images returned")
-	}
+	return asnsTweets(bpb.NewBgpInfoClient(conn), c)
+}
 
-	v4Tweet := tweet{
-		account: "bgp4table",
-		message: "Current RPKI status IPv4 #RPKI",
-		media:   resp.GetImages()[0].GetImage(),
+// asnCount is an ASN total now and a week ago.
+type asnCount struct {
+	now, week uint32
+}
+
+// asnsTweets creates a tweet for each address family with the ASN totals.
+func asnsTweets(b bpb.BgpInfoClient, c config) ([]tweet, error) {
+	counts, err := b.GetAsnCounts(context.Background(), &bpb.Empty{})
+	if err != nil {
+		return nil, err
 	}
-	v6Tweet := tweet{
-		account: "bgp6table",
-		message: "Current RPKI status IPv6 #RPKI",
-		media:   resp.GetImages()[1].GetImage(),
+	now, week := counts.GetCurrent(), counts.GetWeekAgo()
+	if now.GetAs10() == 0 {
+		return nil, fmt.Errorf("no ASN counts found")
 	}
 
-	return []tweet{v4Tweet, v6Tweet}, nil
+	both := asnCount{now.GetAsBoth(), week.GetAsBoth()}
+	return []tweet{
+		{
+			account: c.v4Account,
+			message: asnsMessage("IPv4", asnCount{now.GetAs4(), week.GetAs4()},
+				asnCount{now.GetAs4Only(), week.GetAs4Only()}, both, week != nil),
+		},
+		{
+			account: c.v6Account,
+			message: asnsMessage("IPv6", asnCount{now.GetAs6(), week.GetAs6()},
+				asnCount{now.GetAs6Only(), week.GetAs6Only()}, both, week != nil),
+		},
+	}, nil
+}
+
+// asnsMessage breaks down the ASNs originating the family. The change from a
+// week ago is only added if there are counts from a week ago.
+func asnsMessage(family string, all, only, both asnCount, hasWeek bool) string {
+	delta := func(a asnCount) string {
+		if !hasWeek {
+			return ""
+		}
+		return ", " + weekDelta(int(a.now)-int(a.week))
+	}
+
+	var update strings.Builder
+	update.WriteString(fmt.Sprintf("%d ASNs originate %s prefixes%s. ", all.now, family, delta(all)))
+	update.WriteString(fmt.Sprintf("%d originate only %s%s, ", only.now, family, delta(only)))
+	update.WriteString(fmt.Sprintf("and %d originate both IPv4 and IPv6%s.", both.now, delta(both)))
+
+	return update.String()
+}
 
+// weekDelta describes a change from a week ago.
+func weekDelta(w int) string {
+	switch {
+	case w == 1:
+		return "1 more than a week ago"
+	case w == -1:
+		return "1 fewer than a week ago"
+	case w < 0:
+		return fmt.Sprintf("%d fewer than a week ago", -w)
+	case w > 0:
+		return fmt.Sprintf("%d more than a week ago", w)
+	}
+	return "no change from a week ago"
 }
 
 func postTweet(t tweet, cf *ini.File) error {
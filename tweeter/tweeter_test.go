@@ -1,11 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	bpb "github.com/mellowdrifter/bgp_infrastructure/tweeter/proto/bgpsql"
+	gpb "github.com/mellowdrifter/bgp_infrastructure/tweeter/proto/grapher"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/ini.v1"
 )
 
+// fakeBgpInfo returns canned data in place of a bgpinfo server.
+type fakeBgpInfo struct {
+	bpb.BgpInfoClient
+	counts *bpb.PrefixCountResponse
+	movers map[bpb.AddressFamily][]*bpb.Mover
+	asns   *bpb.AsnCountsResponse
+}
+
+func (f fakeBgpInfo) GetPrefixCount(ctx context.Context, in *bpb.Empty, opts ...grpc.CallOption) (*bpb.PrefixCountResponse, error) {
+	return f.counts, nil
+}
+
+func (f fakeBgpInfo) GetTopMovers(ctx context.Context, in *bpb.TopMoversRequest, opts ...grpc.CallOption) (*bpb.TopMoversResponse, error) {
+	return &bpb.TopMoversResponse{Movers: f.movers[in.GetFamily()]}, nil
+}
+
+func (f fakeBgpInfo) GetAsnCounts(ctx context.Context, in *bpb.Empty, opts ...grpc.CallOption) (*bpb.AsnCountsResponse, error) {
+	return f.asns, nil
+}
+
 func TestDeltaMessage(t *testing.T) {
 	var tests = []struct {
 		name       string
@@ -76,6 +112,15 @@ func TestWhatToTweet(t *testing.T) {
 			want: toTweet{
 				tableSize:   true,
 				annualGraph: true,
+				topMovers:   true,
+			},
+		},
+		{
+			name: "Saturday, 20:00",
+			time: "2020-01-11T20:00:00Z",
+			want: toTweet{
+				tableSize: true,
+				asns:      true,
 			},
 		},
 		{
@@ -110,3 +155,391 @@ func TestWhatToTweet(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteJSONCurrent(t *testing.T) {
+	fake := fakeBgpInfo{
+		counts: &bpb.PrefixCountResponse{
+			Active_4:   850000,
+			Active_6:   100000,
+			Sixhoursv4: 849990,
+			Sixhoursv6: 100001,
+			Weekagov4:  849900,
+			Weekagov6:  100000,
+			Slash24:    425000,
+			Slash48:    50000,
+		},
+	}
+	cfg := config{
+		v4Account: defaultV4Account,
+		v6Account: defaultV6Account,
+		dryRun:    true,
+	}
+	tweets, err := current(fake, cfg)
+	if err != nil {
+		t.Fatalf("unable to compose current tweets: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, tweets); err != nil {
+		t.Fatalf("unable to write json: %v", err)
+	}
+
+	want := `[
+  {
+    "account": "bgp4table",
+    "message": "I see 850000 IPv4 prefixes. This is 10 more prefixes than 6 hours ago and 100 more than a week ago. 50.00% of prefixes are /24."
+  },
+  {
+    "account": "bgp6table",
+    "message": "I see 100000 IPv6 prefixes. This is 1 less prefix than 6 hours ago and no change in the amount from a week ago. 50.00% of prefixes are /48."
+  }
+]
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWriteJSONMedia(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, []tweet{{account: "bgp4table", message: "graph", media: []byte("png")}}); err != nil {
+		t.Fatalf("unable to write json: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"media": "cG5n"`)) {
+		t.Errorf("expected base64 encoded media, got %s", buf.String())
+	}
+}
+
+func TestAttribution(t *testing.T) {
+	cfg := config{copyright: "data by @example | example.net"}
+
+	pie := pieChartRequest(cfg, &bpb.PieSubnetsResponse{})
+	if pie.GetCopyright() != cfg.copyright {
+		t.Errorf("pie chart copyright is %q, want %q", pie.GetCopyright(), cfg.copyright)
+	}
+
+	line := lineGraphRequest(cfg, "week", &bpb.MovementTotalsResponse{})
+	if line.GetCopyright() != cfg.copyright {
+		t.Errorf("line graph copyright is %q, want %q", line.GetCopyright(), cfg.copyright)
+	}
+}
+
+func TestGrapherTimeout(t *testing.T) {
+	// A grapher that accepts connections but never completes the handshake.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer lis.Close()
+
+	cfg := config{
+		grapher:   lis.Addr().String(),
+		timeout:   100 * time.Millisecond,
+		v4Account: "bgp4table",
+		v6Account: "bgp6table",
+	}
+	draw := func(context.Context, gpb.GrapherClient) (*gpb.GrapherResponse, error) {
+		t.Error("grapher called after the dial timed out")
+		return nil, nil
+	}
+
+	start := time.Now()
+	tweets := graphTweets(cfg, "v4 message", "v6 message", draw)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dial took %v, want it to give up after %v", elapsed, cfg.timeout)
+	}
+
+	want := []tweet{
+		{account: "bgp4table", message: "v4 message"},
+		{account: "bgp6table", message: "v6 message"},
+	}
+	if !reflect.DeepEqual(tweets, want) {
+		t.Errorf("got %+v, want text-only tweets %+v", tweets, want)
+	}
+}
+
+func TestCurrentNegativeDelta(t *testing.T) {
+	// The table has shrunk since six hours and a week ago.
+	fake := fakeBgpInfo{
+		counts: &bpb.PrefixCountResponse{
+			Active_4:   850000,
+			Active_6:   100000,
+			Sixhoursv4: 850250,
+			Sixhoursv6: 100000,
+			Weekagov4:  851000,
+			Weekagov6:  100000,
+		},
+	}
+	cfg := config{
+		v4Account: defaultV4Account,
+		v6Account: defaultV6Account,
+		dryRun:    true,
+	}
+	tweets, err := current(fake, cfg)
+	if err != nil {
+		t.Fatalf("unable to compose current tweets: %v", err)
+	}
+
+	want := "I see 850000 IPv4 prefixes. This is 250 fewer prefixes than 6 hours ago and 1000 fewer than a week ago. 0.00% of prefixes are /24."
+	if tweets[0].message != want {
+		t.Errorf("got %q, want %q", tweets[0].message, want)
+	}
+}
+
+// hangingGrapher accepts requests but never answers them.
+type hangingGrapher struct {
+	gpb.UnimplementedGrapherServer
+}
+
+func (hangingGrapher) GetLineGraph(ctx context.Context, r *gpb.LineGraphRequest) (*gpb.GrapherResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// selfSignedCert returns a certificate for the grapher, which tweeter doesn't verify.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestGrapherHangs(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	cert := selfSignedCert(t)
+	srv := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	gpb.RegisterGrapherServer(srv, hangingGrapher{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cfg := config{
+		grapher:   lis.Addr().String(),
+		timeout:   time.Second,
+		v4Account: "bgp4table",
+		v6Account: "bgp6table",
+	}
+	draw := func(ctx context.Context, grp gpb.GrapherClient) (*gpb.GrapherResponse, error) {
+		return grp.GetLineGraph(ctx, &gpb.LineGraphRequest{})
+	}
+
+	start := time.Now()
+	tweets := graphTweets(cfg, "v4 message", "v6 message", draw)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("drawing took %v, want it to give up after %v", elapsed, cfg.timeout)
+	}
+
+	want := []tweet{
+		{account: "bgp4table", message: "v4 message"},
+		{account: "bgp6table", message: "v6 message"},
+	}
+	if !reflect.DeepEqual(tweets, want) {
+		t.Errorf("got %+v, want text-only tweets %+v", tweets, want)
+	}
+}
+
+func TestAccountNames(t *testing.T) {
+	fake := fakeBgpInfo{
+		counts: &bpb.PrefixCountResponse{
+			Active_4: 850000,
+			Active_6: 100000,
+		},
+	}
+	cfg := config{
+		v4Account: "myv4bot",
+		v6Account: "myv6bot",
+		dryRun:    true,
+	}
+	tweets, err := current(fake, cfg)
+	if err != nil {
+		t.Fatalf("unable to compose current tweets: %v", err)
+	}
+	if tweets[0].account != "myv4bot" || tweets[1].account != "myv6bot" {
+		t.Errorf("got accounts %q and %q, want myv4bot and myv6bot", tweets[0].account, tweets[1].account)
+	}
+}
+
+func TestTopMovers(t *testing.T) {
+	fake := fakeBgpInfo{
+		movers: map[bpb.AddressFamily][]*bpb.Mover{
+			bpb.AddressFamily_IPV4: {
+				{AsNumber: 3356, AsName: "LEVEL3", Delta: -300},
+				{AsNumber: 2906, AsName: "AS-SSI - Netflix Streaming Services Inc.", Delta: 25},
+				// Cut on characters, not bytes, so the tweet stays valid UTF-8.
+				{AsNumber: 8359, AsName: "Московская Телефонная Сеть", Delta: 12},
+			},
+			bpb.AddressFamily_IPV6: {
+				{AsNumber: 15169, Delta: 30},
+			},
+		},
+	}
+	cfg := config{
+		v4Account: defaultV4Account,
+		v6Account: defaultV6Account,
+	}
+	tweets, err := topMoversTweets(fake, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []tweet{
+		{
+			account: defaultV4Account,
+			message: "Largest IPv4 origin changes this week:\nAS3356 (LEVEL3) -300\nAS2906 (AS-SSI - Netflix Str) +25\nAS8359 (Московская Телефонна) +12",
+		},
+		{
+			account: defaultV6Account,
+			message: "Largest IPv6 origin changes this week:\nAS15169 +30",
+		},
+	}
+	if !reflect.DeepEqual(tweets, want) {
+		t.Errorf("got %#v, want %#v", tweets, want)
+	}
+}
+
+func TestASNs(t *testing.T) {
+	cfg := config{
+		v4Account: defaultV4Account,
+		v6Account: defaultV6Account,
+	}
+	current := &bpb.AsCount{As4: 70100, As6: 26000, As10: 73500, As4Only: 47500, As6Only: 3400, AsBoth: 22600}
+
+	var tests = []struct {
+		name string
+		asns *bpb.AsnCountsResponse
+		want []tweet
+	}{
+		{
+			name: "Week over week",
+			asns: &bpb.AsnCountsResponse{
+				Current: current,
+				WeekAgo: &bpb.AsCount{As4: 70000, As6: 25999, As10: 73400, As4Only: 47501, As6Only: 3400, AsBoth: 22499},
+			},
+			want: []tweet{
+				{
+					account: defaultV4Account,
+					message: "70100 ASNs originate IPv4 prefixes, 100 more than a week ago. " +
+						"47500 originate only IPv4, 1 fewer than a week ago, " +
+						"and 22600 originate both IPv4 and IPv6, 101 more than a week ago.",
+				},
+				{
+					account: defaultV6Account,
+					message: "26000 ASNs originate IPv6 prefixes, 1 more than a week ago. " +
+						"3400 originate only IPv6, no change from a week ago, " +
+						"and 22600 originate both IPv4 and IPv6, 101 more than a week ago.",
+				},
+			},
+		},
+		{
+			name: "No history",
+			asns: &bpb.AsnCountsResponse{
+				Current: current,
+			},
+			want: []tweet{
+				{
+					account: defaultV4Account,
+					message: "70100 ASNs originate IPv4 prefixes. 47500 originate only IPv4, and 22600 originate both IPv4 and IPv6.",
+				},
+				{
+					account: defaultV6Account,
+					message: "26000 ASNs originate IPv6 prefixes. 3400 originate only IPv6, and 22600 originate both IPv4 and IPv6.",
+				},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tweets, err := asnsTweets(fakeBgpInfo{asns: tc.asns}, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tweets, tc.want) {
+				t.Errorf("got %#v, want %#v", tweets, tc.want)
+			}
+		})
+	}
+
+	if _, err := asnsTweets(fakeBgpInfo{asns: &bpb.AsnCountsResponse{}}, cfg); err == nil {
+		t.Error("expected an error with no ASN counts")
+	}
+}
+
+func TestBots(t *testing.T) {
+	cf, err := ini.ShadowLoad([]byte(`
+[bot.jnb]
+v4 = jnb4table
+v6 = jnb6table
+server = 10.0.0.1
+
+[bot.syd]
+v4 = syd4table
+v6 = syd6table
+server = 10.0.0.2
+actions = current, asns
+`))
+	if err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	if err := checkConfig(cf); err == nil {
+		t.Error("expected missing credentials for the bot accounts to be reported")
+	}
+
+	cfg := config{dryRun: true}
+	cfg.bots = loadBots(cf, cfg)
+
+	// Each bot's servers see a different table.
+	fakes := map[string]fakeBgpInfo{
+		"10.0.0.1": {counts: &bpb.PrefixCountResponse{Active_4: 850000, Active_6: 100000}},
+		"10.0.0.2": {counts: &bpb.PrefixCountResponse{Active_4: 900000, Active_6: 110000}},
+	}
+	todos := make(map[string]toTweet)
+	compose := func(todo toTweet, c config) ([]tweet, error) {
+		todos[c.v4Account] = todo
+		if !todo.tableSize {
+			return nil, nil
+		}
+		return current(fakes[c.servers[0]], c)
+	}
+
+	tweets, err := botTweets(toTweet{tableSize: true, asns: true, rpkiPie: true}, cfg, compose)
+	if err != nil {
+		t.Fatalf("unable to compose tweets: %v", err)
+	}
+
+	wantTodos := map[string]toTweet{
+		"jnb4table": {tableSize: true, asns: true, rpkiPie: true},
+		"syd4table": {tableSize: true, asns: true},
+	}
+	if !reflect.DeepEqual(todos, wantTodos) {
+		t.Errorf("got todo lists %+v, want %+v", todos, wantTodos)
+	}
+
+	want := map[string]string{
+		"jnb4table": "I see 850000 IPv4 prefixes. ",
+		"jnb6table": "I see 100000 IPv6 prefixes. ",
+		"syd4table": "I see 900000 IPv4 prefixes. ",
+		"syd6table": "I see 110000 IPv6 prefixes. ",
+	}
+	if len(tweets) != len(want) {
+		t.Fatalf("got %d tweets, want %d", len(tweets), len(want))
+	}
+	for _, tw := range tweets {
+		if !strings.HasPrefix(tw.message, want[tw.account]) {
+			t.Errorf("%s: got %q, want it to start with %q", tw.account, tw.message, want[tw.account])
+		}
+	}
+}